@@ -1,31 +1,85 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"log"
+	"log/slog"
 	"os"
 	"os/signal"
+	"registry-service/internal/auth"
 	"registry-service/internal/config"
 	"registry-service/internal/database"
+	"registry-service/internal/grpcserver"
 	"registry-service/internal/middleware"
+	"registry-service/internal/observability"
+	"registry-service/internal/ratelimit"
 	"registry-service/internal/registry"
+	"registry-service/internal/render"
 	"registry-service/internal/server"
 	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
 )
 
 func main() {
 	log.Println("Starting registry service...")
 
-	// Load configuration
-	config.LoadConfig("internal/config/config.json")
+	// Load configuration from the file named by --config, with the overrides of the environment and the flags
+	configFile, flags, err := config.ParseFlags(os.Args[0], os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatalf("Invalid command line: %v", err)
+	}
+	cfg, err := config.Load(configFile, flags)
+	if err != nil {
+		log.Fatalf("Failed to load config file: %v", err)
+	}
+	log.Println("Configuration loaded successfully.")
 
-	// Initialize the logger with the configured log level
-	middleware.InitLogger(config.AppConfig.LogLevel)
+	// Create the logger with the configured levels and format. The messages of the standard log package go
+	// through it too.
+	logger, err := middleware.NewLoggerWithOptions(middleware.LoggerOptions{
+		Level:           cfg.LogLevel,
+		ComponentLevels: cfg.LogLevels,
+		Format:          cfg.LogFormat,
+	})
+	if err != nil {
+		log.Fatalf("Failed to create the logger: %v", err)
+	}
+	slog.SetDefault(logger.Slog())
+
+	// Export the traces of the requests, the registry operations and the health checks, if configured
+	shutdownTracing, err := observability.SetupTracing(cfg.Tracing)
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+
+	// Load the networks trusted to forward requests and to register workers on behalf of others
+	networks, err := middleware.NewTrustedNetworks(cfg.TrustedProxies, cfg.TrustedSources)
+	if err != nil {
+		log.Fatalf("Failed to load the trusted networks: %v", err)
+	}
+
+	// Load the API keys, the JWT configuration and the scopes of the client certificates
+	authn, err := auth.NewAuthenticator(cfg)
+	if err != nil {
+		log.Fatalf("Failed to load the credentials: %v", err)
+	}
+
+	// Load the rate limits
+	limiter, err := ratelimit.NewLimiter(cfg.RateLimit)
+	if err != nil {
+		log.Fatalf("Failed to load the rate limits: %v", err)
+	}
 
 	// Connect to the MongoDB database
-	db, err := database.NewMongoDB(config.AppConfig.DB.URI, config.AppConfig.DB.Name, config.AppConfig.DB.Collection)
+	db, err := database.NewMongoDB(cfg.DB.URI, cfg.DB.Name, cfg.DB.Collection, logger)
 	if err != nil {
 		log.Fatalf("Failed to connect to MongoDB: %v", err)
 	}
@@ -41,8 +95,32 @@ func main() {
 	}
 
 	// Create a new registry
-	checkInterval := time.Millisecond * time.Duration(config.AppConfig.CheckIntervalMs)
-	reg := registry.NewRegistry(db, checkInterval)
+	reg, err := registry.New(db, registry.Options{
+		CheckInterval:   time.Millisecond * time.Duration(cfg.CheckIntervalMs),
+		ResolveInterval: time.Millisecond * time.Duration(cfg.ResolveIntervalMs),
+		Probe:           cfg.Probe,
+		Logger:          logger,
+	})
+	if err != nil {
+		log.Fatalf("Failed to create the registry: %v", err)
+	}
+
+	// Render the configuration templates, if any, from the registry content
+	var renderer *render.Renderer
+	if len(cfg.Templates) > 0 {
+		renderer, err = render.New(reg, cfg.Templates, render.Options{
+			Debounce: time.Millisecond * time.Duration(cfg.TemplateDebounceMs),
+			MaxWait:  time.Millisecond * time.Duration(cfg.TemplateMaxWaitMs),
+			Logger:   logger,
+		})
+		if err != nil {
+			log.Fatalf("Failed to load templates: %v", err)
+		}
+		renderer.Start()
+	}
+
+	// The reloader holds the effective configuration, exposed to administrators
+	reloader := config.NewReloader(configFile, flags, cfg)
 
 	// Create a new router
 	router := mux.NewRouter()
@@ -51,25 +129,128 @@ func main() {
 	ready := make(chan struct{})
 
 	// Start the server in a separate goroutine
-	srv := server.StartServer(reg, router, ready, config.AppConfig.ServerPort)
+	srv, httpErrs, err := server.StartServer(reg, router, ready, server.Options{
+		Port:             cfg.ServerPort,
+		TLS:              cfg.TLS,
+		MaxBodyBytes:     cfg.MaxBodyBytes,
+		ConsulDatacenter: cfg.ConsulDatacenter,
+		Logger:           logger,
+		Authenticator:    authn,
+		Limiter:          limiter,
+		TrustedNetworks:  networks,
+		Config:           reloader.Current,
+		MountMetrics:     cfg.Metrics.Mount,
+	})
+	if err != nil {
+		log.Fatalf("Failed to start the HTTP server: %v", err)
+	}
 
 	// Wait for the server to signal readiness
 	<-ready
 	log.Println("Server is ready to handle requests.")
 
+	// Expose the Prometheus metrics on their own listener, unless it is disabled
+	metricsSrv, metricsErrs, err := server.StartMetricsServer(cfg.Metrics, logger)
+	if err != nil {
+		log.Fatalf("Failed to start the metrics server: %v", err)
+	}
+
+	// Start the gRPC server if a port is configured
+	var grpcSrv *grpc.Server
+	var grpcErrs <-chan error // Nil without gRPC server, never ready, like metricsErrs without metrics server
+	if cfg.GRPCPort != "" {
+		grpcSrv, grpcErrs, err = grpcserver.StartServer(reg, grpcserver.Options{
+			Port:            cfg.GRPCPort,
+			TLS:             cfg.TLS,
+			Logger:          logger,
+			Authenticator:   authn,
+			Limiter:         limiter,
+			TrustedNetworks: networks,
+		})
+		if err != nil {
+			log.Fatalf("Failed to start gRPC server: %v", err)
+		}
+	}
+
+	// Apply the reloadable fields of the configuration on SIGHUP and when the file changes
+	reloader.OnChange(func(cfg config.Config) error {
+		return logger.SetLevel(cfg.LogLevel)
+	}, "log_level")
+	reloader.OnChange(func(cfg config.Config) error {
+		return logger.SetComponentLevels(cfg.LogLevels)
+	}, "log_levels")
+	reloader.OnChange(func(cfg config.Config) error {
+		reg.SetCheckInterval(time.Millisecond * time.Duration(cfg.CheckIntervalMs))
+		return nil
+	}, "check_interval_ms")
+	reloader.OnChange(func(cfg config.Config) error {
+		return reg.SetProbe(cfg.Probe)
+	}, "probe")
+	// The keys file may have changed even when its path did not
+	reloader.OnChange(authn.ReloadKeys)
+
+	stopReload := make(chan struct{})
+	go reloader.Watch(2*time.Second, stopReload)
+
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	go func() {
+		for range hups {
+			log.Println("Received SIGHUP, reloading the configuration...")
+			reloader.Reload()
+		}
+	}()
+
 	// Set up signal handling for graceful shutdown
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
-	// Wait for os to signal termination
-	<-sigs
-	log.Println("Shutting down registry service...")
+	// Wait for os to signal termination, or for a server to fail
+	failed := true
+	select {
+	case <-sigs:
+		log.Println("Shutting down registry service...")
+		failed = false
+	case err := <-httpErrs:
+		log.Printf("HTTP server stopped: %v, shutting down registry service...", err)
+	case err := <-metricsErrs:
+		log.Printf("Metrics server stopped: %v, shutting down registry service...", err)
+	case err := <-grpcErrs:
+		log.Printf("gRPC server stopped: %v, shutting down registry service...", err)
+	}
+
+	signal.Stop(hups)
+	close(stopReload)
 
 	// Stop the health check loop
 	reg.StopHealthCheck()
 
+	if renderer != nil {
+		renderer.Stop()
+	}
+
+	if grpcSrv != nil {
+		grpcSrv.Stop()
+	}
+
+	if metricsSrv != nil {
+		if err := metricsSrv.Close(); err != nil {
+			log.Printf("Failed to close the metrics server: %v", err)
+		}
+	}
+
+	// Flush the pending spans
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if err := shutdownTracing(ctx); err != nil {
+		log.Printf("Failed to flush the traces: %v", err)
+	}
+	cancel()
+
 	if err := srv.Close(); err != nil {
 		log.Fatalf("Server Shutdown Failed: %+v", err)
 	}
+	if failed {
+		os.Exit(1)
+	}
 	log.Println("Server exited properly")
 }
@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"crypto/x509"
+	"fmt"
+	"registry-service/internal/config"
+)
+
+// Authenticator holds the credentials accepted by a server: the API keys, the bearer tokens and the verified
+// client certificates. Each server may have its own, so that several registries can run in one process.
+type Authenticator struct {
+	keyStore         *KeyStore
+	jwtValidator     *JWTValidator // nil when bearer tokens are disabled
+	clientCertScopes []Scope
+}
+
+// NewAuthenticator creates the authenticator of the configuration: the API keys of api_key, api_keys and
+// api_keys_file, the bearer tokens when a key set is configured in jwt, and the scopes granted to the client
+// certificates by tls.client_cert_scopes, the register scope by default.
+func NewAuthenticator(cfg config.Config) (*Authenticator, error) {
+	store, err := NewKeyStoreFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	a := &Authenticator{keyStore: store, clientCertScopes: []Scope{ScopeRegister}}
+
+	if cfg.JWT.JWKSFile != "" || cfg.JWT.JWKSURL != "" {
+		validator, err := NewJWTValidator(cfg.JWT)
+		if err != nil {
+			return nil, err
+		}
+		a.jwtValidator = validator
+	}
+
+	if len(cfg.TLS.ClientCertScopes) > 0 {
+		scopes, err := ParseScopes(cfg.TLS.ClientCertScopes)
+		if err != nil {
+			return nil, fmt.Errorf("client_cert_scopes: %w", err)
+		}
+		a.clientCertScopes = scopes
+	}
+	return a, nil
+}
+
+// ReloadKeys replaces the configured API keys with the keys of the configuration. It is called when the
+// configuration is reloaded: the requests authenticated afterwards use the new keys, and the keys created or
+// revoked at runtime are kept as they are. The state file is read at startup only.
+func (a *Authenticator) ReloadKeys(cfg config.Config) error {
+	configured, err := configuredKeys(cfg)
+	if err != nil {
+		return err
+	}
+	return a.keyStore.Reload(configured)
+}
+
+// KeyStore returns the API keys.
+func (a *Authenticator) KeyStore() *KeyStore {
+	return a.keyStore
+}
+
+// JWTValidator returns the validator of the bearer tokens, nil when bearer tokens are disabled.
+func (a *Authenticator) JWTValidator() *JWTValidator {
+	return a.jwtValidator
+}
+
+// CertificateIdentity returns the identity of a verified client certificate, see CertificateIdentity.
+func (a *Authenticator) CertificateIdentity(cert *x509.Certificate) (*Identity, bool) {
+	return CertificateIdentity(cert, a.clientCertScopes)
+}
@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"crypto/x509"
+	"errors"
+	"slices"
+)
+
+// ErrWorkerIdentityMismatch is returned when a caller authenticated by a client certificate acts on a worker ID
+// its certificate does not name.
+var ErrWorkerIdentityMismatch = errors.New("the client certificate does not name the worker")
+
+// CertificateIdentity returns the identity of a verified client certificate, granted the scopes. The DNS and URI
+// subject alternative names of the certificate are the worker IDs the caller may act on. It returns false when the
+// certificate has none.
+func CertificateIdentity(cert *x509.Certificate, scopes []Scope) (*Identity, bool) {
+	names := append([]string(nil), cert.DNSNames...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	if len(names) == 0 {
+		return nil, false
+	}
+	return &Identity{Name: names[0], Scopes: scopes, Method: MethodClientCert, Subjects: names}, true
+}
+
+// CanActOnWorker reports whether the identity may register, heartbeat or deregister the worker ID.
+// Callers authenticated by a client certificate may only act on the IDs named by their certificate.
+func (i *Identity) CanActOnWorker(id string) bool {
+	return i.Method != MethodClientCert || slices.Contains(i.Subjects, id)
+}
+
+// WorkerOverride reports whether the identity may act on the worker ID regardless of its token: the credentials
+// granted the override scope may act on any worker, and workers authenticated by a client certificate on the IDs it
+// names. It returns ErrWorkerIdentityMismatch when a client certificate does not name the ID. A nil identity may not
+// override the token.
+func (i *Identity) WorkerOverride(id string) (bool, error) {
+	if i == nil {
+		return false, nil
+	}
+	if !i.CanActOnWorker(id) {
+		return false, ErrWorkerIdentityMismatch
+	}
+	return i.HasScope(ScopeOverride) || i.Method == MethodClientCert, nil
+}
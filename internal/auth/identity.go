@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"slices"
+)
+
+// Scope is a permission granted to a credential.
+type Scope string
+
+const (
+	ScopeRegister Scope = "register" // Register, heartbeat and deregister workers
+	ScopeRead     Scope = "read"     // Read the registry content
+	ScopeAdmin    Scope = "admin"    // Everything but override, including the administration endpoints
+	ScopeOverride Scope = "override" // Act on any worker without its token, only when granted explicitly
+)
+
+// IsValid reports whether the scope is known.
+func (s Scope) IsValid() bool {
+	return s == ScopeRegister || s == ScopeRead || s == ScopeAdmin || s == ScopeOverride
+}
+
+// ParseScopes converts scope names, rejecting unknown ones.
+func ParseScopes(names []string) ([]Scope, error) {
+	scopes := make([]Scope, 0, len(names))
+	for _, name := range names {
+		scope := Scope(name)
+		if !scope.IsValid() {
+			return nil, fmt.Errorf("unknown scope %q", name)
+		}
+		scopes = append(scopes, scope)
+	}
+	return scopes, nil
+}
+
+// Authentication methods
+const (
+	MethodAPIKey     = "api_key"
+	MethodJWT        = "jwt"
+	MethodClientCert = "client_cert"
+)
+
+// Identity is the authenticated caller of a request.
+type Identity struct {
+	Name     string   // Name of the credential
+	Scopes   []Scope  // Scopes granted to the credential
+	Method   string   // How the caller authenticated
+	Subjects []string // Names of the client certificate, when the caller authenticated with one
+}
+
+// HasScope reports whether the identity was granted the scope. The admin scope grants every scope but override,
+// so that the legacy api_key, often shared by all the workers, cannot take over the worker IDs.
+func (i *Identity) HasScope(scope Scope) bool {
+	return slices.Contains(i.Scopes, scope) || (scope != ScopeOverride && slices.Contains(i.Scopes, ScopeAdmin))
+}
+
+// String returns a representation of the identity for the logs.
+func (i *Identity) String() string {
+	return fmt.Sprintf("%s (%s)", i.Name, i.Method)
+}
+
+// Key type is unexported to prevent collisions with context keys in other packages.
+type key int
+
+// identityKey is the key for identity values in context.
+const identityKey key = 0
+
+// WithIdentity returns a copy of ctx carrying the identity.
+func WithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityKey, identity)
+}
+
+// IdentityFromContext retrieves the identity from the context.
+func IdentityFromContext(ctx context.Context) (*Identity, bool) {
+	identity, ok := ctx.Value(identityKey).(*Identity)
+	return identity, ok
+}
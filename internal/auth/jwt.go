@@ -0,0 +1,309 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"registry-service/internal/config"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultJWKSRefresh = time.Hour
+	defaultJWTLeeway   = time.Minute
+	// minJWKSReload limits the reloads of the key set triggered by tokens signed with an unknown key.
+	minJWKSReload = 30 * time.Second
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTokenExpired = errors.New("token expired")
+)
+
+// JWTValidator authenticates bearer JSON Web Tokens signed by a key of a JSON Web Key Set,
+// and maps their claims to registry scopes.
+type JWTValidator struct {
+	cfg     config.JWTConfig
+	refresh time.Duration
+	leeway  time.Duration
+	allowed []Scope
+	client  *http.Client
+
+	mutex     sync.Mutex
+	keys      []verificationKey
+	loadedAt  time.Time // Last successful load of the key set
+	attemptAt time.Time // Last load attempt
+}
+
+// NewJWTValidator creates a validator from the configuration. The key set file is loaded immediately,
+// the key set URL on the first token so that an unreachable provider does not prevent the registry from starting.
+func NewJWTValidator(cfg config.JWTConfig) (*JWTValidator, error) {
+	if (cfg.JWKSFile == "") == (cfg.JWKSURL == "") {
+		return nil, errors.New("jwt: exactly one of jwks_file and jwks_url must be set")
+	}
+	if cfg.NameClaim == "" {
+		cfg.NameClaim = "sub"
+	}
+	if cfg.ScopeClaim == "" {
+		cfg.ScopeClaim = "scope"
+	}
+	if cfg.AllowedScopes == nil {
+		cfg.AllowedScopes = []string{string(ScopeRead)}
+	}
+	allowed, err := ParseScopes(cfg.AllowedScopes)
+	if err != nil {
+		return nil, fmt.Errorf("jwt: allowed_scopes: %w", err)
+	}
+	for value, scopes := range cfg.ScopeMapping {
+		if _, err := ParseScopes(scopes); err != nil {
+			return nil, fmt.Errorf("jwt: scope_mapping of %q: %w", value, err)
+		}
+	}
+
+	v := &JWTValidator{
+		cfg:     cfg,
+		refresh: defaultJWKSRefresh,
+		leeway:  defaultJWTLeeway,
+		allowed: allowed,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+	if cfg.JWKSRefreshMs > 0 {
+		v.refresh = time.Duration(cfg.JWKSRefreshMs) * time.Millisecond
+	}
+	if cfg.LeewayMs > 0 {
+		v.leeway = time.Duration(cfg.LeewayMs) * time.Millisecond
+	}
+
+	if cfg.JWKSFile != "" {
+		if err := v.reload(time.Now()); err != nil {
+			return nil, fmt.Errorf("jwt: %w", err)
+		}
+	}
+	return v, nil
+}
+
+// reload loads the key set. Must be called with the mutex held, or before the validator is shared.
+func (v *JWTValidator) reload(now time.Time) error {
+	v.attemptAt = now
+	keys, err := loadJWKS(v.client, v.cfg.JWKSFile, v.cfg.JWKSURL)
+	if err != nil {
+		return err
+	}
+	v.keys = keys
+	v.loadedAt = now
+	return nil
+}
+
+// findKey returns the key with the given ID, or the only key of the set when the token does not name one.
+// The key set is reloaded when it is stale, or when the key is unknown, e.g. after a rotation by the provider.
+func (v *JWTValidator) findKey(kid string) (verificationKey, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(v.loadedAt) >= v.refresh && now.Sub(v.attemptAt) >= minJWKSReload {
+		if err := v.reload(now); err != nil && len(v.keys) == 0 {
+			return verificationKey{}, err
+		}
+	}
+
+	if key, ok := v.lookup(kid); ok {
+		return key, nil
+	}
+	if now.Sub(v.attemptAt) >= minJWKSReload {
+		if err := v.reload(now); err != nil {
+			return verificationKey{}, err
+		}
+		if key, ok := v.lookup(kid); ok {
+			return key, nil
+		}
+	}
+	return verificationKey{}, fmt.Errorf("%w: unknown signing key %q", ErrInvalidToken, kid)
+}
+
+// lookup must be called with the mutex held.
+func (v *JWTValidator) lookup(kid string) (verificationKey, bool) {
+	if kid == "" {
+		if len(v.keys) == 1 {
+			return v.keys[0], true
+		}
+		return verificationKey{}, false
+	}
+	for _, key := range v.keys {
+		if key.id == kid {
+			return key, true
+		}
+	}
+	return verificationKey{}, false
+}
+
+// Authenticate verifies the signature and the claims of a compact serialized token,
+// and returns the identity of its subject with the scopes granted by its claims.
+func (v *JWTValidator) Authenticate(token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed token", ErrInvalidToken)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrInvalidToken, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature: %v", ErrInvalidToken, err)
+	}
+
+	key, err := v.findKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if key.alg != "" && key.alg != header.Alg {
+		return nil, fmt.Errorf("%w: algorithm %s does not match the key", ErrInvalidToken, header.Alg)
+	}
+	if err := verifySignature(header.Alg, key.key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: claims: %v", ErrInvalidToken, err)
+	}
+	if err := v.validateClaims(claims, time.Now()); err != nil {
+		return nil, err
+	}
+
+	name, _ := claims[v.cfg.NameClaim].(string)
+	if name == "" {
+		return nil, fmt.Errorf("%w: missing %s claim", ErrInvalidToken, v.cfg.NameClaim)
+	}
+	return &Identity{Name: name, Scopes: v.scopes(claims), Method: MethodJWT}, nil
+}
+
+// validateClaims checks the registered claims: exp is required, nbf, iss and aud are checked when present or configured.
+func (v *JWTValidator) validateClaims(claims map[string]interface{}, now time.Time) error {
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("%w: missing exp claim", ErrInvalidToken)
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(v.leeway)) {
+		return ErrTokenExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(v.leeway).Before(time.Unix(int64(nbf), 0)) {
+		return fmt.Errorf("%w: token not valid yet", ErrInvalidToken)
+	}
+	if v.cfg.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != v.cfg.Issuer {
+			return fmt.Errorf("%w: unexpected issuer %q", ErrInvalidToken, iss)
+		}
+	}
+	if v.cfg.Audience != "" && !slices.Contains(claimValues(claims["aud"]), v.cfg.Audience) {
+		return fmt.Errorf("%w: token is not intended for %q", ErrInvalidToken, v.cfg.Audience)
+	}
+	return nil
+}
+
+// scopes maps the values of the scope claim to registry scopes, through scope_mapping when it is set or
+// by name otherwise, and keeps the allowed ones.
+func (v *JWTValidator) scopes(claims map[string]interface{}) []Scope {
+	var granted []Scope
+	for _, value := range claimValues(claims[v.cfg.ScopeClaim]) {
+		names := []string{value}
+		if v.cfg.ScopeMapping != nil {
+			names = v.cfg.ScopeMapping[value]
+		}
+		for _, name := range names {
+			scope := Scope(name)
+			if slices.Contains(v.allowed, scope) && !slices.Contains(granted, scope) {
+				granted = append(granted, scope)
+			}
+		}
+	}
+	return granted
+}
+
+// claimValues returns the values of a claim given as a space separated string, like scope, or as an array, like aud or groups.
+func claimValues(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return strings.Fields(value)
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// verifySignature checks a JWS signature. Only asymmetric algorithms are accepted: "none" and the HMAC
+// algorithms, which would let anyone knowing the public key forge tokens, are rejected.
+func verifySignature(alg string, key crypto.PublicKey, signingInput []byte, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	case "EdDSA":
+		edKey, ok := key.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(edKey, signingInput, signature) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+
+	h := hash.New()
+	h.Write(signingInput)
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "RS") {
+			return rsa.VerifyPKCS1v15(k, hash, digest, signature)
+		}
+		if strings.HasPrefix(alg, "PS") {
+			return rsa.VerifyPSS(k, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if strings.HasPrefix(alg, "ES") && len(signature) == 2*size {
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if ecdsa.Verify(k, digest, r, s) {
+				return nil
+			}
+			return errors.New("invalid signature")
+		}
+	}
+	return fmt.Errorf("algorithm %s does not match the key type", alg)
+}
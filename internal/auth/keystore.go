@@ -0,0 +1,495 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"registry-service/internal/config"
+	"slices"
+	"sync"
+	"time"
+)
+
+// DefaultKeyName is the name of the key configured with the legacy api_key field.
+const DefaultKeyName = "default"
+
+var (
+	ErrKeyNotFound = errors.New("key not found")
+	ErrKeyExists   = errors.New("key already exists")
+	ErrInvalidKey  = errors.New("invalid key") // Wrapped by the errors of the keys without name, secret or scope
+)
+
+// Key is an API key. Only the SHA-256 hash of the secret is kept in memory.
+type Key struct {
+	Name      string
+	Hash      [sha256.Size]byte
+	Scopes    []Scope
+	CreatedAt time.Time
+	ExpiresAt time.Time // Zero if the key never expires
+}
+
+// expired reports whether the key is expired at the given time.
+func (k *Key) expired(now time.Time) bool {
+	return !k.ExpiresAt.IsZero() && !now.Before(k.ExpiresAt)
+}
+
+// KeyInfo describes a key without its secret.
+type KeyInfo struct {
+	Name      string     `json:"name"`
+	Scopes    []Scope    `json:"scopes"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Expired   bool       `json:"expired"`
+}
+
+func (k *Key) info(now time.Time) KeyInfo {
+	info := KeyInfo{Name: k.Name, Scopes: append([]Scope(nil), k.Scopes...), Expired: k.expired(now)}
+	if !k.CreatedAt.IsZero() {
+		createdAt := k.CreatedAt
+		info.CreatedAt = &createdAt
+	}
+	if !k.ExpiresAt.IsZero() {
+		expiresAt := k.ExpiresAt
+		info.ExpiresAt = &expiresAt
+	}
+	return info
+}
+
+// persistedKey is a key of the persisted state.
+type persistedKey struct {
+	Name      string     `json:"name"`
+	KeySHA256 string     `json:"key_sha256"`
+	Scopes    []Scope    `json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// persistedState records the changes made at runtime to the configured keys: keys created or modified
+// through the API, and names of the revoked keys.
+type persistedState struct {
+	Keys    []persistedKey `json:"keys"`
+	Revoked []string       `json:"revoked"`
+}
+
+// KeyStore holds the API keys accepted by the registry.
+type KeyStore struct {
+	mutex     sync.RWMutex
+	keys      []Key
+	statePath string // Empty when the runtime changes are not persisted
+	state     persistedState
+}
+
+// NewKeyStore creates an empty key store.
+func NewKeyStore() *KeyStore {
+	return &KeyStore{}
+}
+
+// HashKey returns the hex encoded SHA-256 hash of a secret, as expected in the hashed key file.
+func HashKey(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// GenerateSecret returns a random secret suitable for an API key.
+func GenerateSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Add adds a key from its secret. A zero expiresAt means the key never expires.
+func (s *KeyStore) Add(name string, secret string, scopes []Scope, expiresAt time.Time) error {
+	if secret == "" {
+		return fmt.Errorf("%w: key %q has an empty secret", ErrInvalidKey, name)
+	}
+	return s.add(Key{Name: name, Hash: sha256.Sum256([]byte(secret)), Scopes: scopes, ExpiresAt: expiresAt})
+}
+
+// AddHashed adds a key from the hex encoded SHA-256 hash of its secret. A zero expiresAt means the key never expires.
+func (s *KeyStore) AddHashed(name string, hexHash string, scopes []Scope, expiresAt time.Time) error {
+	hash, err := decodeHash(name, hexHash)
+	if err != nil {
+		return err
+	}
+	return s.add(Key{Name: name, Hash: hash, Scopes: scopes, ExpiresAt: expiresAt})
+}
+
+func decodeHash(name string, hexHash string) ([sha256.Size]byte, error) {
+	var hash [sha256.Size]byte
+	decoded, err := hex.DecodeString(hexHash)
+	if err != nil || len(decoded) != sha256.Size {
+		return hash, fmt.Errorf("%w: key %q has an invalid SHA-256 hash", ErrInvalidKey, name)
+	}
+	copy(hash[:], decoded)
+	return hash, nil
+}
+
+func validateKey(key Key) error {
+	if key.Name == "" {
+		return fmt.Errorf("%w: key without a name", ErrInvalidKey)
+	}
+	if len(key.Scopes) == 0 {
+		return fmt.Errorf("%w: key %q has no scope", ErrInvalidKey, key.Name)
+	}
+	for _, scope := range key.Scopes {
+		if !scope.IsValid() {
+			return fmt.Errorf("%w: key %q has an unknown scope %q", ErrInvalidKey, key.Name, scope)
+		}
+	}
+	return nil
+}
+
+func (s *KeyStore) add(key Key) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.find(key.Name) >= 0 {
+		return fmt.Errorf("duplicate key name %q", key.Name)
+	}
+	s.keys = append(s.keys, key)
+	return nil
+}
+
+// find returns the index of the key with the given name, or -1. Must be called with the mutex held.
+func (s *KeyStore) find(name string) int {
+	for i := range s.keys {
+		if s.keys[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Authenticate returns the identity of the unexpired key matching secret.
+// Every key is compared in constant time so that the response time does not reveal which key, if any, matched.
+func (s *KeyStore) Authenticate(secret string) (*Identity, bool) {
+	if secret == "" {
+		return nil, false
+	}
+	hash := sha256.Sum256([]byte(secret))
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var match *Key
+	for i := range s.keys {
+		if subtle.ConstantTimeCompare(hash[:], s.keys[i].Hash[:]) == 1 {
+			match = &s.keys[i]
+		}
+	}
+	if match == nil || match.expired(time.Now()) {
+		return nil, false
+	}
+	return &Identity{Name: match.Name, Scopes: append([]Scope(nil), match.Scopes...), Method: MethodAPIKey}, true
+}
+
+// Len returns the number of keys.
+func (s *KeyStore) Len() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return len(s.keys)
+}
+
+// List describes every key, including the expired ones.
+func (s *KeyStore) List() []KeyInfo {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	now := time.Now()
+	infos := make([]KeyInfo, 0, len(s.keys))
+	for i := range s.keys {
+		infos = append(infos, s.keys[i].info(now))
+	}
+	return infos
+}
+
+// Create adds a key at runtime and persists it. A zero expiresAt means the key never expires.
+func (s *KeyStore) Create(name string, secret string, scopes []Scope, expiresAt time.Time) (KeyInfo, error) {
+	if secret == "" {
+		return KeyInfo{}, fmt.Errorf("%w: key %q has an empty secret", ErrInvalidKey, name)
+	}
+	key := Key{Name: name, Hash: sha256.Sum256([]byte(secret)), Scopes: scopes, CreatedAt: time.Now(), ExpiresAt: expiresAt}
+	if err := validateKey(key); err != nil {
+		return KeyInfo{}, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.find(name) >= 0 {
+		return KeyInfo{}, ErrKeyExists
+	}
+
+	s.keys = append(s.keys, key)
+	s.recordKey(key)
+	s.state.Revoked = slices.DeleteFunc(s.state.Revoked, func(n string) bool { return n == name })
+	if err := s.save(); err != nil {
+		s.keys = s.keys[:len(s.keys)-1]
+		return KeyInfo{}, err
+	}
+	return key.info(time.Now()), nil
+}
+
+// SetExpiry changes the expiry of a key and persists it. A zero expiresAt means the key never expires.
+// Setting an expiry in the future lets the previous key of a rotation remain valid while clients move to the new one.
+func (s *KeyStore) SetExpiry(name string, expiresAt time.Time) (KeyInfo, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	i := s.find(name)
+	if i < 0 {
+		return KeyInfo{}, ErrKeyNotFound
+	}
+
+	previous := s.keys[i].ExpiresAt
+	s.keys[i].ExpiresAt = expiresAt
+	s.recordKey(s.keys[i])
+	if err := s.save(); err != nil {
+		s.keys[i].ExpiresAt = previous
+		return KeyInfo{}, err
+	}
+	return s.keys[i].info(time.Now()), nil
+}
+
+// Revoke removes a key and persists the revocation, so that a configured key stays revoked after a restart.
+func (s *KeyStore) Revoke(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	i := s.find(name)
+	if i < 0 {
+		return ErrKeyNotFound
+	}
+
+	removed := s.keys[i]
+	s.keys = slices.Delete(s.keys, i, i+1)
+	s.state.Keys = slices.DeleteFunc(s.state.Keys, func(k persistedKey) bool { return k.Name == name })
+	if !slices.Contains(s.state.Revoked, name) {
+		s.state.Revoked = append(s.state.Revoked, name)
+	}
+	if err := s.save(); err != nil {
+		s.keys = slices.Insert(s.keys, i, removed)
+		return err
+	}
+	return nil
+}
+
+// recordKey adds or replaces the key in the persisted state. Must be called with the mutex held.
+func (s *KeyStore) recordKey(key Key) {
+	entry := persistedKey{
+		Name:      key.Name,
+		KeySHA256: hex.EncodeToString(key.Hash[:]),
+		Scopes:    key.Scopes,
+		CreatedAt: key.CreatedAt,
+	}
+	if !key.ExpiresAt.IsZero() {
+		expiresAt := key.ExpiresAt
+		entry.ExpiresAt = &expiresAt
+	}
+
+	for i := range s.state.Keys {
+		if s.state.Keys[i].Name == key.Name {
+			s.state.Keys[i] = entry
+			return
+		}
+	}
+	s.state.Keys = append(s.state.Keys, entry)
+}
+
+// save writes the persisted state, if enabled. Must be called with the mutex held.
+func (s *KeyStore) save() error {
+	if s.statePath == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file then rename it, so that a crash never leaves a truncated state
+	tmp, err := os.CreateTemp(filepath.Dir(s.statePath), "."+filepath.Base(s.statePath)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to persist API keys: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to persist API keys: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to persist API keys: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to persist API keys: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.statePath); err != nil {
+		return fmt.Errorf("failed to persist API keys: %w", err)
+	}
+	return nil
+}
+
+// EnablePersistence records the runtime changes in the file at path, and applies the changes it already holds:
+// keys created or modified at runtime replace the configured ones with the same secret, and revoked keys are removed.
+func (s *KeyStore) EnablePersistence(path string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.statePath = path
+	s.state = persistedState{}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read API keys state: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.state); err != nil {
+		return fmt.Errorf("failed to decode API keys state: %w", err)
+	}
+	return s.applyState()
+}
+
+// Reload replaces the configured keys with the keys of configured, typically created from the reloaded
+// configuration, and applies the runtime changes again: the keys created at runtime are kept and the revoked keys
+// stay revoked. It holds the lock of the runtime changes, so that a concurrent Create or Revoke is never lost.
+func (s *KeyStore) Reload(configured *KeyStore) error {
+	configured.mutex.RLock()
+	keys := append([]Key(nil), configured.keys...)
+	configured.mutex.RUnlock()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous := s.keys
+	s.keys = keys
+	if err := s.applyState(); err != nil {
+		s.keys = previous
+		return err
+	}
+	return nil
+}
+
+// applyState applies the runtime changes of the state to the configured keys. Must be called with the mutex held.
+func (s *KeyStore) applyState() error {
+	for _, entry := range s.state.Keys {
+		hash, err := decodeHash(entry.Name, entry.KeySHA256)
+		if err != nil {
+			return err
+		}
+		key := Key{Name: entry.Name, Hash: hash, Scopes: entry.Scopes, CreatedAt: entry.CreatedAt}
+		if entry.ExpiresAt != nil {
+			key.ExpiresAt = *entry.ExpiresAt
+		}
+		if err := validateKey(key); err != nil {
+			return err
+		}
+		if i := s.find(key.Name); i >= 0 {
+			// A configured key whose secret changed since the state was written was rotated in the configuration:
+			// the configuration wins
+			if s.keys[i].Hash != key.Hash {
+				continue
+			}
+			s.keys[i] = key
+		} else {
+			s.keys = append(s.keys, key)
+		}
+	}
+	for _, name := range s.state.Revoked {
+		if i := s.find(name); i >= 0 {
+			s.keys = slices.Delete(s.keys, i, i+1)
+		}
+	}
+	return nil
+}
+
+// hashedKeyEntry is an entry of the hashed key file.
+type hashedKeyEntry struct {
+	Name      string    `json:"name"`
+	KeySHA256 string    `json:"key_sha256"`
+	Scopes    []string  `json:"scopes"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// NewKeyStoreFromConfig creates a key store with the keys of the configuration: the legacy api_key with every
+// scope, the api_keys entries, and the entries of the api_keys_file. When api_keys_state_file is set, the changes
+// made at runtime are applied and persisted there.
+func NewKeyStoreFromConfig(cfg config.Config) (*KeyStore, error) {
+	store, err := configuredKeys(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.APIKeysStateFile != "" {
+		if err := store.EnablePersistence(cfg.APIKeysStateFile); err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+// configuredKeys creates a key store with the keys of the configuration only, without the runtime changes.
+func configuredKeys(cfg config.Config) (*KeyStore, error) {
+	store := NewKeyStore()
+
+	if cfg.APIKey != "" {
+		if err := store.Add(DefaultKeyName, cfg.APIKey, []Scope{ScopeAdmin}, time.Time{}); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, k := range cfg.APIKeys {
+		scopes, err := ParseScopes(k.Scopes)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", k.Name, err)
+		}
+		switch {
+		case k.Key != "" && k.KeySHA256 != "":
+			return nil, fmt.Errorf("key %q: key and key_sha256 are mutually exclusive", k.Name)
+		case k.Key != "":
+			err = store.Add(k.Name, k.Key, scopes, k.ExpiresAt)
+		default:
+			err = store.AddHashed(k.Name, k.KeySHA256, scopes, k.ExpiresAt)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.APIKeysFile != "" {
+		data, err := os.ReadFile(cfg.APIKeysFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read API keys file: %w", err)
+		}
+		var entries []hashedKeyEntry
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, fmt.Errorf("failed to decode API keys file: %w", err)
+		}
+		for _, e := range entries {
+			scopes, err := ParseScopes(e.Scopes)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %w", e.Name, err)
+			}
+			if err := store.AddHashed(e.Name, e.KeySHA256, scopes, e.ExpiresAt); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return store, nil
+}
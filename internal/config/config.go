@@ -2,66 +2,209 @@ package config
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
 	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
 )
 
 // DBConfig holds the database configuration details
 type DBConfig struct {
-	URI        string `json:"uri"`
+	URI        string `json:"uri" secret:"uri"`
 	Name       string `json:"name"`
 	Collection string `json:"collection"`
 }
 
-// Config holds the application configuration
-type Config struct {
-	LogLevel        string   `json:"log_level"`
-	ServerPort      string   `json:"server_port"`
-	CheckIntervalMs int      `json:"check_interval_ms"`
-	APIKey          string   `json:"api_key"`
-	DB              DBConfig `json:"db"`
+// APIKeyConfig describes an API key and the scopes it grants (register, read, admin, override)
+type APIKeyConfig struct {
+	Name      string    `json:"name"`
+	Key       string    `json:"key" secret:"true"` // Secret of the key
+	KeySHA256 string    `json:"key_sha256"`        // Hex encoded SHA-256 of the secret, instead of the secret itself
+	Scopes    []string  `json:"scopes"`
+	ExpiresAt time.Time `json:"expires_at"` // Optional RFC 3339 expiry of the key
+}
+
+// TemplateConfig describes a file rendered from the registry content
+type TemplateConfig struct {
+	Source         string `json:"source"`             // Path to the Go text/template file
+	Destination    string `json:"destination"`        // Path of the rendered file
+	Command        string `json:"command"`            // Optional shell command run after the destination changed
+	CommandTimeout int    `json:"command_timeout_ms"` // Timeout of the command, defaults to 30s
+}
+
+// JWTConfig configures the authentication of bearer JSON Web Tokens, e.g. issued by an OpenID Connect provider
+type JWTConfig struct {
+	JWKSFile      string              `json:"jwks_file"`       // Path to the JSON Web Key Set verifying the tokens
+	JWKSURL       string              `json:"jwks_url"`        // URL of the JSON Web Key Set, instead of jwks_file
+	JWKSRefreshMs int                 `json:"jwks_refresh_ms"` // Interval between reloads of the key set, defaults to 1h
+	Issuer        string              `json:"issuer"`          // Expected iss claim, not checked when empty
+	Audience      string              `json:"audience"`        // Expected aud claim, not checked when empty
+	NameClaim     string              `json:"name_claim"`      // Claim used as the identity name, defaults to sub
+	ScopeClaim    string              `json:"scope_claim"`     // Claim holding the scopes, roles or groups of the caller, defaults to scope
+	ScopeMapping  map[string][]string `json:"scope_mapping"`   // Registry scopes granted by each value of the scope claim
+	AllowedScopes []string            `json:"allowed_scopes"`  // Registry scopes that tokens may grant, defaults to read
+	LeewayMs      int                 `json:"leeway_ms"`       // Tolerated clock skew on exp and nbf, defaults to 60s
+}
+
+// TLSConfig configures HTTPS and the verification of client certificates
+type TLSConfig struct {
+	CertFile         string   `json:"cert_file"`          // Server certificate chain, reloaded when it changes
+	KeyFile          string   `json:"key_file"`           // Server private key, reloaded when it changes
+	ClientCAFile     string   `json:"client_ca_file"`     // CA bundle verifying the client certificates
+	ClientAuth       string   `json:"client_auth"`        // none (default), request (verified when sent) or require
+	ClientCertScopes []string `json:"client_cert_scopes"` // Scopes granted to verified client certificates, defaults to register
+	ReloadIntervalMs int      `json:"reload_interval_ms"` // Minimum interval between checks of the files, defaults to 5s
+}
+
+// ProbeConfig configures the health checks of the workers
+type ProbeConfig struct {
+	Scheme     string `json:"scheme"`                   // http (default) or https
+	Path       string `json:"path"`                     // Health check path, defaults to /healthcheck
+	TimeoutMs  int    `json:"timeout_ms"`               // Timeout of a health check, defaults to 5s
+	CAFile     string `json:"ca_file"`                  // CA bundle verifying the worker certificates, the system roots when empty
+	CertFile   string `json:"cert_file"`                // Client certificate presented to the workers, reloaded when it changes
+	KeyFile    string `json:"key_file"`                 // Key of the client certificate
+	ServerName string `json:"server_name"`              // Name verified in the worker certificates, the worker host when empty
+	Header     string `json:"header"`                   // Header carrying the credential, defaults to X-API-Key
+	Credential string `json:"credential" secret:"true"` // Credential sent to the workers, none when empty
+}
+
+// RateConfig is a token bucket refilled with rate tokens per second and holding up to burst tokens
+type RateConfig struct {
+	Rate  float64 `json:"rate"`  // Requests per second, the limit is disabled when 0
+	Burst int     `json:"burst"` // Maximum number of requests in a burst, defaults to the rate rounded up
+}
+
+// RateLimitConfig configures the rate limits of the HTTP and gRPC APIs
+type RateLimitConfig struct {
+	PerIP  RateConfig            `json:"per_ip"`  // Requests of each client address, checked before authentication
+	PerKey RateConfig            `json:"per_key"` // Requests of each authenticated credential
+	Routes map[string]RateConfig `json:"routes"`  // Requests of each credential on a route, keyed by "METHOD /path/{template}" or "/path/{template}"
+}
+
+// TracingConfig configures the OpenTelemetry traces of the requests, the registry operations, the database calls
+// and the health checks
+type TracingConfig struct {
+	Exporter    string  `json:"exporter"`     // none (default), otlp or stdout
+	Endpoint    string  `json:"endpoint"`     // host:port of the OTLP/HTTP collector, defaults to localhost:4318
+	Insecure    bool    `json:"insecure"`     // Sends the spans to the collector over http instead of https
+	ServiceName string  `json:"service_name"` // Service name of the spans, defaults to registry-service
+	SampleRatio float64 `json:"sample_ratio"` // Ratio of the traces started by the registry that are sampled, defaults to 1
 }
 
-// AppConfig is a global variable that holds the loaded configuration
-var AppConfig Config
+// MetricsConfig configures the endpoint of the Prometheus metrics
+type MetricsConfig struct {
+	Address  string `json:"address"`                // Listen address of the metrics server, e.g. :9090, disabled when empty or none
+	Username string `json:"username"`               // User of the basic authentication required by the metrics server, not checked when empty
+	Password string `json:"password" secret:"true"` // Password of the basic authentication
+	CertFile string `json:"cert_file"`              // Serves the metrics over https, reloaded when it changes
+	KeyFile  string `json:"key_file"`               // Key of the certificate
+	Mount    bool   `json:"mount"`                  // Also serves GET /metrics on the main server, to the callers with the read scope
+}
+
+// Config holds the application configuration
+type Config struct {
+	LogLevel           string            `json:"log_level"`
+	LogLevels          map[string]string `json:"log_levels"` // Levels overriding log_level for some components: http, grpc, registry, probe, db, render, tls
+	LogFormat          string            `json:"log_format"` // text or json, defaults to text
+	ServerPort         string            `json:"server_port"`
+	GRPCPort           string            `json:"grpc_port"`
+	CheckIntervalMs    int               `json:"check_interval_ms"`
+	ResolveIntervalMs  int               `json:"resolve_interval_ms"` // Interval of the resolution of worker hostnames, disabled when 0
+	APIKey             string            `json:"api_key" secret:"true"`
+	APIKeys            []APIKeyConfig    `json:"api_keys"`
+	APIKeysFile        string            `json:"api_keys_file"`
+	APIKeysStateFile   string            `json:"api_keys_state_file"` // Persists the keys created, modified or revoked at runtime
+	DB                 DBConfig          `json:"db"`
+	Templates          []TemplateConfig  `json:"templates"`
+	TemplateDebounceMs int               `json:"template_debounce_ms"`
+	TemplateMaxWaitMs  int               `json:"template_max_wait_ms"`
+	ConsulDatacenter   string            `json:"consul_datacenter"`
+	JWT                JWTConfig         `json:"jwt"`
+	TLS                TLSConfig         `json:"tls"`
+	TrustedProxies     []string          `json:"trusted_proxies"` // CIDR blocks of the proxies whose forwarding headers are honored
+	TrustedSources     []string          `json:"trusted_sources"` // CIDR blocks of the clients allowed to register workers at another address
+	Probe              ProbeConfig       `json:"probe"`
+	RateLimit          RateLimitConfig   `json:"rate_limit"`
+	MaxBodyBytes       int64             `json:"max_body_bytes"` // Maximum size of the request bodies, defaults to 1 MiB
+	Tracing            TracingConfig     `json:"tracing"`
+	Metrics            MetricsConfig     `json:"metrics"`
 
-// LoadConfig loads configuration from a JSON file
-func LoadConfig(configFile string) {
-	log.Println("", "Loading Static Configuration...")
+	secretRefs map[string]string // References of the secrets resolved by Load, keyed by the path of their field
+}
 
-	file, err := os.Open(configFile)
+// Load reads a configuration file, applies the overrides and the defaults, and validates the result. The values
+// are taken, by increasing precedence, from the defaults, the file, the REGISTRY_* environment variables and the
+// command-line flags. Invalid configurations are rejected with a ValidationError listing every problem found.
+func Load(configFile string, flags Flags) (Config, error) {
+	data, err := os.ReadFile(configFile)
 	if err != nil {
-		log.Fatalf("Failed to open config file: %v", err)
+		return Config{}, fmt.Errorf("failed to open config file: %w", err)
+	}
+	if data, err = decodeFile(configFile, data); err != nil {
+		return Config{}, fmt.Errorf("failed to decode config file: %w", err)
 	}
-	defer file.Close()
 
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&AppConfig); err != nil {
-		log.Fatalf("Failed to decode config file: %v", err)
+	var cfg Config
+	var problems []string
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		// The other fields are still decoded after a type mismatch, and validated below
+		var typeErr *json.UnmarshalTypeError
+		if !errors.As(err, &typeErr) {
+			return Config{}, fmt.Errorf("failed to decode config file: %w", err)
+		}
+		problems = append(problems, fmt.Sprintf("%s: expected %s, got %s", typeErr.Field, typeName(typeErr.Type), typeErr.Value))
 	}
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err == nil {
+		problems = append(problems, unknownFields("", raw, reflect.TypeOf(cfg))...)
+	}
+
+	// Override with the environment variables and the command-line flags
+	problems = append(problems, applyOverrides(&cfg, flags)...)
 
-	// Override with environment variables if available
-	overrideWithEnv()
+	// Resolve the file: and env: references of the secrets
+	problems = append(problems, resolveSecrets(&cfg)...)
 
 	// Set default values if not specified in the config file
-	if AppConfig.CheckIntervalMs == 0 {
-		AppConfig.CheckIntervalMs = 100
+	cfg.LogLevel = strings.ToUpper(cfg.LogLevel)
+	for component, level := range cfg.LogLevels {
+		cfg.LogLevels[component] = strings.ToUpper(level)
 	}
-	log.Println("", "Configuration loaded successfully.")
-}
-
-// overrideWithEnv checks for environment variables and overrides config values
-func overrideWithEnv() {
-	if uri := os.Getenv("MONGO_URI"); uri != "" {
-		AppConfig.DB.URI = uri
+	cfg.LogFormat = strings.ToLower(cfg.LogFormat)
+	if cfg.LogFormat == "" {
+		cfg.LogFormat = "text"
+	}
+	if cfg.CheckIntervalMs == 0 {
+		cfg.CheckIntervalMs = 100
+	}
+	if cfg.TemplateDebounceMs == 0 {
+		cfg.TemplateDebounceMs = 500
 	}
-	if port := os.Getenv("REGISTRY_SERVER_PORT"); port != "" {
-		AppConfig.ServerPort = port
+	if cfg.TemplateMaxWaitMs == 0 {
+		cfg.TemplateMaxWaitMs = 5000
 	}
-	if logLevel := os.Getenv("REGISTRYY_LOG_LEVEL"); logLevel != "" {
-		AppConfig.LogLevel = logLevel
+	if cfg.ConsulDatacenter == "" {
+		cfg.ConsulDatacenter = "dc1"
 	}
-	if apiKey := os.Getenv("REGISTRY_API_KEY"); apiKey != "" {
-		AppConfig.APIKey = apiKey
+	cfg.Tracing.Exporter = strings.ToLower(cfg.Tracing.Exporter)
+	if cfg.Tracing.Exporter == "" {
+		cfg.Tracing.Exporter = "none"
+	}
+	if cfg.Tracing.ServiceName == "" {
+		cfg.Tracing.ServiceName = "registry-service"
+	}
+	if cfg.Tracing.SampleRatio == 0 {
+		cfg.Tracing.SampleRatio = 1
+	}
+
+	problems = append(problems, cfg.Problems()...)
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return Config{}, &ValidationError{Problems: problems}
 	}
+	return cfg, nil
 }
@@ -0,0 +1,234 @@
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultConfigFile is the configuration file loaded when no --config flag nor REGISTRY_CONFIG is given.
+const DefaultConfigFile = "internal/config/config.json"
+
+// EnvPrefix prefixes the environment variables overriding the configuration, e.g. REGISTRY_DB_URI for db.uri.
+const EnvPrefix = "REGISTRY_"
+
+// Flags holds the configuration fields set on the command line, keyed by their path, e.g. "db.uri".
+type Flags map[string]string
+
+// field is a configuration field that can be set from a single string: the scalars, the lists of strings,
+// and the lists and maps of objects given as JSON.
+type field struct {
+	path  string // Path of the field in the configuration file, e.g. db.uri
+	index []int
+}
+
+// envName returns the environment variable overriding the field.
+func (f field) envName() string {
+	return EnvPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(f.path))
+}
+
+// flagName returns the command-line flag overriding the field.
+func (f field) flagName() string {
+	return strings.ReplaceAll(f.path, "_", "-")
+}
+
+// fields lists the fields of the configuration, in the order of their declaration.
+func fields() []field {
+	var result []field
+	var walk func(t reflect.Type, path string, index []int)
+	walk = func(t reflect.Type, path string, index []int) {
+		for i := 0; i < t.NumField(); i++ {
+			name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+			if name == "" || name == "-" {
+				continue
+			}
+			fieldPath := join(path, name)
+			fieldIndex := append(append([]int{}, index...), i)
+			if t.Field(i).Type.Kind() == reflect.Struct && t.Field(i).Type != reflect.TypeOf(time.Time{}) {
+				walk(t.Field(i).Type, fieldPath, fieldIndex)
+				continue
+			}
+			result = append(result, field{path: fieldPath, index: fieldIndex})
+		}
+	}
+	walk(reflect.TypeOf(Config{}), "", nil)
+	return result
+}
+
+// set sets the field of the configuration from its string representation.
+func (f field) set(cfg *Config, value string) error {
+	v := reflect.ValueOf(cfg).Elem().FieldByIndex(f.index)
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("expected an integer, got %q", value)
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("expected a number, got %q", value)
+		}
+		v.SetFloat(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("expected a boolean, got %q", value)
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(value), "[") {
+			// A comma separated list
+			var values []string
+			for _, s := range strings.Split(value, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					values = append(values, s)
+				}
+			}
+			v.Set(reflect.ValueOf(values))
+			return nil
+		}
+		fallthrough
+	default:
+		decoded := reflect.New(v.Type())
+		if err := json.Unmarshal([]byte(value), decoded.Interface()); err != nil {
+			return fmt.Errorf("expected %s as JSON: %v", typeName(v.Type()), err)
+		}
+		v.Set(decoded.Elem())
+	}
+	return nil
+}
+
+// applyOverrides sets the fields found in the environment, then the fields set on the command line, and returns
+// the problems of the values that could not be parsed.
+func applyOverrides(cfg *Config, flags Flags) []string {
+	var problems []string
+
+	// MONGO_URI is still honored for the existing deployments, REGISTRY_DB_URI takes precedence
+	if uri := os.Getenv("MONGO_URI"); uri != "" {
+		cfg.DB.URI = uri
+	}
+	for _, f := range fields() {
+		if value, ok := os.LookupEnv(f.envName()); ok && value != "" {
+			if err := f.set(cfg, value); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", f.envName(), err))
+			}
+		}
+	}
+	for _, f := range fields() {
+		if value, ok := flags[f.path]; ok {
+			if err := f.set(cfg, value); err != nil {
+				problems = append(problems, fmt.Sprintf("--%s: %v", f.flagName(), err))
+			}
+		}
+	}
+	return problems
+}
+
+// flagValue records the value of a command-line flag in Flags, after checking that it can be parsed.
+type flagValue struct {
+	field field
+	flags Flags
+}
+
+func (v flagValue) String() string {
+	if v.flags == nil {
+		return ""
+	}
+	return v.flags[v.field.path]
+}
+
+func (v flagValue) Set(value string) error {
+	if err := v.field.set(&Config{}, value); err != nil {
+		return err
+	}
+	v.flags[v.field.path] = value
+	return nil
+}
+
+// ParseFlags parses the command line: --config names the configuration file, and every field of the configuration
+// can be set with a flag named after its path, e.g. --db.uri or --check-interval-ms.
+func ParseFlags(name string, args []string) (string, Flags, error) {
+	set := flag.NewFlagSet(name, flag.ContinueOnError)
+
+	configFile := DefaultConfigFile
+	if file := os.Getenv(EnvPrefix + "CONFIG"); file != "" {
+		configFile = file
+	}
+	set.StringVar(&configFile, "config", configFile, "Configuration file, in JSON, YAML (.yaml, .yml) or TOML (.toml) (env "+EnvPrefix+"CONFIG)")
+
+	flags := make(Flags)
+	for _, f := range fields() {
+		set.Var(flagValue{field: f, flags: flags}, f.flagName(), fmt.Sprintf("Overrides %s (env %s)", f.path, f.envName()))
+	}
+
+	if err := set.Parse(args); err != nil {
+		return "", nil, err
+	}
+	if set.NArg() > 0 {
+		return "", nil, fmt.Errorf("unexpected arguments: %s", strings.Join(set.Args(), " "))
+	}
+	return configFile, flags, nil
+}
+
+// decodeFile returns the JSON encoding of the configuration file content, converted from YAML or TOML according
+// to the extension of the file.
+func decodeFile(configFile string, data []byte) ([]byte, error) {
+	var decoded interface{}
+	switch strings.ToLower(filepath.Ext(configFile)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &decoded); err != nil {
+			return nil, err
+		}
+		decoded = stringKeys(decoded)
+	case ".toml":
+		table := make(map[string]interface{})
+		if err := toml.Unmarshal(data, &table); err != nil {
+			return nil, err
+		}
+		decoded = table
+	default:
+		return data, nil
+	}
+	if decoded == nil {
+		// An empty document
+		return []byte("{}"), nil
+	}
+	return json.Marshal(decoded)
+}
+
+// stringKeys converts the maps with non string keys decoded from YAML, which cannot be encoded as JSON.
+func stringKeys(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, element := range v {
+			v[key] = stringKeys(element)
+		}
+		return v
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for key, element := range v {
+			converted[fmt.Sprint(key)] = stringKeys(element)
+		}
+		return converted
+	case []interface{}:
+		for i, element := range v {
+			v[i] = stringKeys(element)
+		}
+		return v
+	default:
+		return v
+	}
+}
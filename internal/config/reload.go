@@ -0,0 +1,189 @@
+package config
+
+import (
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reloadableFields are the fields applied when the configuration is reloaded. The other fields keep their
+// startup value until the next restart.
+var reloadableFields = map[string]bool{
+	"log_level":         true,
+	"log_levels":        true,
+	"check_interval_ms": true,
+	"api_key":           true,
+	"api_keys":          true,
+	"api_keys_file":     true,
+	"probe":             true,
+}
+
+type reloadHook struct {
+	apply  func(Config) error
+	fields []string
+}
+
+// Reloader reloads the configuration file on demand, e.g. on SIGHUP, or when the file changes, and applies
+// the reloadable fields through the hooks registered with OnChange.
+type Reloader struct {
+	file  string
+	flags Flags
+
+	mutex    sync.Mutex
+	modTimes map[string]time.Time // Modification times of the configuration file and of the secret files
+	hooks    []reloadHook
+
+	currentMutex sync.RWMutex
+	current      Config
+}
+
+// NewReloader creates a reloader of the configuration file, loaded at startup as cfg. The command-line flags keep
+// overriding the reloaded file.
+func NewReloader(configFile string, flags Flags, cfg Config) *Reloader {
+	r := &Reloader{file: configFile, flags: flags, current: cfg}
+	r.modTimes = modTimes(append([]string{configFile}, cfg.SecretFiles()...))
+	return r
+}
+
+// Current returns the effective configuration: the configuration loaded at startup, with the fields reloaded since.
+func (r *Reloader) Current() Config {
+	r.currentMutex.RLock()
+	defer r.currentMutex.RUnlock()
+	return r.current
+}
+
+func (r *Reloader) setCurrent(cfg Config) {
+	r.currentMutex.Lock()
+	defer r.currentMutex.Unlock()
+	r.current = cfg
+}
+
+// modTimes returns the modification times of the files that exist.
+func modTimes(files []string) map[string]time.Time {
+	times := make(map[string]time.Time, len(files))
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			times[file] = info.ModTime()
+		}
+	}
+	return times
+}
+
+// OnChange registers a hook applying the effective configuration when one of the fields changes,
+// or on every reload when no field is given, e.g. to reread the files named by the configuration.
+func (r *Reloader) OnChange(apply func(Config) error, fields ...string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.hooks = append(r.hooks, reloadHook{apply: apply, fields: fields})
+}
+
+// Reload loads the configuration file and applies its reloadable fields. An invalid configuration is rejected
+// as a whole and the effective configuration is kept.
+func (r *Reloader) Reload() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	loaded, err := Load(r.file, r.flags)
+	// The secret files of the current configuration stay watched when the new one is rejected
+	secretFiles := r.Current().SecretFiles()
+	if err == nil {
+		secretFiles = loaded.SecretFiles()
+	}
+	r.modTimes = modTimes(append([]string{r.file}, secretFiles...))
+	if err != nil {
+		log.Printf("Failed to reload the configuration, keeping the current one: %v", err)
+		return err
+	}
+
+	previous := r.Current()
+	next, applied, ignored := mergeReloadable(previous, loaded)
+	if len(ignored) > 0 {
+		log.Printf("Configuration changes that require a restart are ignored: %s", strings.Join(ignored, ", "))
+	}
+	r.setCurrent(next)
+
+	for _, hook := range r.hooks {
+		if len(hook.fields) > 0 && !containsAny(applied, hook.fields) {
+			continue
+		}
+		if err := hook.apply(next); err != nil {
+			log.Printf("Failed to apply the reloaded configuration: %v", err)
+		}
+	}
+
+	if len(applied) > 0 {
+		log.Printf("Configuration reloaded, applied changes: %s", strings.Join(applied, ", "))
+	} else {
+		log.Println("Configuration reloaded, no change to apply")
+	}
+	return nil
+}
+
+// Watch checks the modification time of the configuration file and of the secret files at every interval and
+// reloads the configuration when one of them changed, until stop is closed.
+func (r *Reloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.mutex.Lock()
+			changed := false
+			for file, modTime := range r.modTimes {
+				if info, err := os.Stat(file); err == nil && !info.ModTime().Equal(modTime) {
+					changed = true
+				}
+			}
+			r.mutex.Unlock()
+			if changed {
+				r.Reload()
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// mergeReloadable returns the previous configuration with the reloadable fields of the loaded one, the names
+// of the reloadable fields that changed, and the names of the other fields that changed.
+func mergeReloadable(previous Config, loaded Config) (Config, []string, []string) {
+	next := previous
+	nextValue := reflect.ValueOf(&next).Elem()
+	loadedValue := reflect.ValueOf(loaded)
+
+	var applied, ignored []string
+	for i := 0; i < nextValue.NumField(); i++ {
+		if !nextValue.Type().Field(i).IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(nextValue.Type().Field(i).Tag.Get("json"), ",")
+		if reflect.DeepEqual(nextValue.Field(i).Interface(), loadedValue.Field(i).Interface()) {
+			continue
+		}
+		if reloadableFields[name] {
+			nextValue.Field(i).Set(loadedValue.Field(i))
+			applied = append(applied, name)
+		} else {
+			ignored = append(ignored, name)
+		}
+	}
+	// The secrets of the fields that are not reloaded keep their value, but their files are still watched
+	next.secretRefs = loaded.secretRefs
+	return next, applied, ignored
+}
+
+func containsAny(values []string, wanted []string) bool {
+	for _, v := range values {
+		for _, w := range wanted {
+			if v == w {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,143 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Secret fields are tagged secret:"true", or secret:"uri" when only the password of the URI is secret. Their value
+// may be a reference resolved when the configuration is loaded:
+//
+//   - file:/run/secrets/api_key reads the file, without its trailing new line,
+//   - env:NAME reads the environment variable NAME.
+const (
+	fileReference = "file:"
+	envReference  = "env:"
+)
+
+// redacted replaces the secrets of the configuration.
+const redacted = "REDACTED"
+
+// visitSecrets calls visit with the path and the value of every secret field of the configuration, including
+// the fields of the elements of lists.
+func visitSecrets(cfg *Config, visit func(path string, kind string, v reflect.Value)) {
+	var walk func(v reflect.Value, path string)
+	walk = func(v reflect.Value, path string) {
+		switch v.Kind() {
+		case reflect.Struct:
+			for i := 0; i < v.NumField(); i++ {
+				f := v.Type().Field(i)
+				name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+				if name == "" || name == "-" {
+					continue
+				}
+				if kind := f.Tag.Get("secret"); kind != "" && f.Type.Kind() == reflect.String {
+					visit(join(path, name), kind, v.Field(i))
+					continue
+				}
+				walk(v.Field(i), join(path, name))
+			}
+		case reflect.Slice:
+			for i := 0; i < v.Len(); i++ {
+				walk(v.Index(i), fmt.Sprintf("%s[%d]", path, i))
+			}
+		}
+	}
+	walk(reflect.ValueOf(cfg).Elem(), "")
+}
+
+// resolveSecrets replaces the secret references with the values they point to, records the references, and returns
+// the problems of the references that could not be resolved. The errors never contain the secret values.
+func resolveSecrets(cfg *Config) []string {
+	var problems []string
+	cfg.secretRefs = nil
+	visitSecrets(cfg, func(path string, kind string, v reflect.Value) {
+		reference := v.String()
+		var value string
+		switch {
+		case strings.HasPrefix(reference, fileReference):
+			file := strings.TrimPrefix(reference, fileReference)
+			data, err := os.ReadFile(file)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s: failed to read the secret file %s: %v", path, file, unwrapPathError(err)))
+				return
+			}
+			value = strings.TrimRight(string(data), "\r\n")
+		case strings.HasPrefix(reference, envReference):
+			name := strings.TrimPrefix(reference, envReference)
+			var ok bool
+			if value, ok = os.LookupEnv(name); !ok || value == "" {
+				problems = append(problems, fmt.Sprintf("%s: the environment variable %s is not set", path, name))
+				return
+			}
+		default:
+			return
+		}
+		if value == "" {
+			problems = append(problems, fmt.Sprintf("%s: the secret %s is empty", path, reference))
+			return
+		}
+		if cfg.secretRefs == nil {
+			cfg.secretRefs = make(map[string]string)
+		}
+		cfg.secretRefs[path] = reference
+		v.SetString(value)
+	})
+	return problems
+}
+
+func unwrapPathError(err error) error {
+	if pathErr, ok := err.(*os.PathError); ok {
+		return pathErr.Err
+	}
+	return err
+}
+
+// SecretFiles returns the files the secrets of the configuration were read from, sorted.
+func (c Config) SecretFiles() []string {
+	var files []string
+	for _, reference := range c.secretRefs {
+		if strings.HasPrefix(reference, fileReference) {
+			files = append(files, strings.TrimPrefix(reference, fileReference))
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// Redacted returns a copy of the configuration without its secrets: the secrets read from a reference are replaced
+// with the reference, the others with REDACTED, and only the password of the database URI is replaced.
+func (c Config) Redacted() Config {
+	// The lists are copied so that the configuration itself is not modified
+	c.APIKeys = append([]APIKeyConfig(nil), c.APIKeys...)
+	visitSecrets(&c, func(path string, kind string, v reflect.Value) {
+		switch reference, ok := c.secretRefs[path]; {
+		case ok:
+			v.SetString(reference)
+		case kind == "uri":
+			v.SetString(RedactURI(v.String()))
+		case v.String() != "":
+			v.SetString(redacted)
+		}
+	})
+	return c
+}
+
+// RedactURI replaces the password of a URI, or the whole URI when it cannot be parsed.
+func RedactURI(uri string) string {
+	if uri == "" {
+		return ""
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return redacted
+	}
+	if _, hasPassword := u.User.Password(); hasPassword {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+	return u.String()
+}
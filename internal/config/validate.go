@@ -0,0 +1,260 @@
+package config
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/netip"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ValidationError lists the problems of an invalid configuration.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+// Problems returns every problem of the configuration, after the defaults are applied.
+func (c *Config) Problems() []string {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if !validLogLevel(c.LogLevel) {
+		add("log_level: unknown level %q, expected DEBUG, INFO, WARN or ERROR", c.LogLevel)
+	}
+	for component, level := range c.LogLevels {
+		if !validLogLevel(level) {
+			add("log_levels.%s: unknown level %q, expected DEBUG, INFO, WARN or ERROR", component, level)
+		}
+	}
+	switch c.LogFormat {
+	case "", "text", "json":
+	default:
+		add("log_format: unknown format %q, expected text or json", c.LogFormat)
+	}
+	if c.ServerPort == "" {
+		add("server_port: required")
+	} else if !validPort(c.ServerPort) {
+		add("server_port: %q is not a port between 1 and 65535", c.ServerPort)
+	}
+	if c.GRPCPort != "" && !validPort(c.GRPCPort) {
+		add("grpc_port: %q is not a port between 1 and 65535", c.GRPCPort)
+	}
+	for name, value := range map[string]int64{
+		"check_interval_ms":      int64(c.CheckIntervalMs),
+		"resolve_interval_ms":    int64(c.ResolveIntervalMs),
+		"template_debounce_ms":   int64(c.TemplateDebounceMs),
+		"template_max_wait_ms":   int64(c.TemplateMaxWaitMs),
+		"max_body_bytes":         c.MaxBodyBytes,
+		"probe.timeout_ms":       int64(c.Probe.TimeoutMs),
+		"jwt.jwks_refresh_ms":    int64(c.JWT.JWKSRefreshMs),
+		"jwt.leeway_ms":          int64(c.JWT.LeewayMs),
+		"tls.reload_interval_ms": int64(c.TLS.ReloadIntervalMs),
+	} {
+		if value < 0 {
+			add("%s: must not be negative", name)
+		}
+	}
+
+	if c.DB.URI == "" {
+		add("db.uri: required")
+	}
+	if c.DB.Name == "" {
+		add("db.name: required")
+	}
+	if c.DB.Collection == "" {
+		add("db.collection: required")
+	}
+
+	names := make(map[string]bool)
+	for i, k := range c.APIKeys {
+		field := fmt.Sprintf("api_keys[%d]", i)
+		switch {
+		case k.Name == "":
+			add("%s.name: required", field)
+		case names[k.Name]:
+			add("%s.name: duplicate key name %q", field, k.Name)
+		}
+		names[k.Name] = true
+		switch {
+		case k.Key == "" && k.KeySHA256 == "":
+			add("%s: one of key and key_sha256 is required", field)
+		case k.Key != "" && k.KeySHA256 != "":
+			add("%s: key and key_sha256 are mutually exclusive", field)
+		case k.KeySHA256 != "":
+			if decoded, err := hex.DecodeString(k.KeySHA256); err != nil || len(decoded) != 32 {
+				add("%s.key_sha256: not a hex encoded SHA-256", field)
+			}
+		}
+	}
+
+	for i, t := range c.Templates {
+		if t.Source == "" {
+			add("templates[%d].source: required", i)
+		}
+		if t.Destination == "" {
+			add("templates[%d].destination: required", i)
+		}
+	}
+
+	if c.JWT.JWKSFile != "" && c.JWT.JWKSURL != "" {
+		add("jwt: jwks_file and jwks_url are mutually exclusive")
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		add("tls: cert_file and key_file must be set together")
+	}
+	switch c.TLS.ClientAuth {
+	case "", "none":
+	case "request", "require":
+		if c.TLS.ClientCAFile == "" {
+			add("tls.client_ca_file: required to verify client certificates")
+		}
+	default:
+		add("tls.client_auth: unknown mode %q, expected none, request or require", c.TLS.ClientAuth)
+	}
+
+	switch c.Probe.Scheme {
+	case "", "http", "https":
+	default:
+		add("probe.scheme: unknown scheme %q, expected http or https", c.Probe.Scheme)
+	}
+	if (c.Probe.CertFile == "") != (c.Probe.KeyFile == "") {
+		add("probe: cert_file and key_file must be set together")
+	}
+
+	for name, networks := range map[string][]string{"trusted_proxies": c.TrustedProxies, "trusted_sources": c.TrustedSources} {
+		for i, network := range networks {
+			if _, err := netip.ParsePrefix(network); err != nil {
+				if _, err := netip.ParseAddr(network); err != nil {
+					add("%s[%d]: %q is not a CIDR block nor an IP address", name, i, network)
+				}
+			}
+		}
+	}
+
+	for name, rate := range map[string]RateConfig{"rate_limit.per_ip": c.RateLimit.PerIP, "rate_limit.per_key": c.RateLimit.PerKey} {
+		if rate.Rate < 0 || rate.Burst < 0 {
+			add("%s: rate and burst must not be negative", name)
+		}
+	}
+	for route, rate := range c.RateLimit.Routes {
+		if rate.Rate < 0 || rate.Burst < 0 {
+			add("rate_limit.routes[%q]: rate and burst must not be negative", route)
+		}
+	}
+
+	if c.Metrics.Address != "" && c.Metrics.Address != "none" {
+		if _, port, err := net.SplitHostPort(c.Metrics.Address); err != nil || !validPort(port) && port != "0" {
+			add("metrics.address: %q is not a host:port address", c.Metrics.Address)
+		}
+	}
+	if (c.Metrics.Username == "") != (c.Metrics.Password == "") {
+		add("metrics: username and password must be set together")
+	}
+	if (c.Metrics.CertFile == "") != (c.Metrics.KeyFile == "") {
+		add("metrics: cert_file and key_file must be set together")
+	}
+
+	switch c.Tracing.Exporter {
+	case "", "none", "otlp", "stdout":
+	default:
+		add("tracing.exporter: unknown exporter %q, expected none, otlp or stdout", c.Tracing.Exporter)
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		add("tracing.sample_ratio: must be between 0 and 1")
+	}
+
+	// The problems of maps are found in random order
+	sort.Strings(problems)
+	return problems
+}
+
+// validLogLevel reports whether the level, in upper case, is a level of the logger.
+func validLogLevel(level string) bool {
+	switch level {
+	case "", "DEBUG", "INFO", "WARN", "WARNING", "ERROR":
+		return true
+	}
+	return false
+}
+
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n >= 1 && n <= 65535
+}
+
+// unknownFields returns the fields of the decoded JSON value raw that have no counterpart in the type t.
+func unknownFields(path string, raw interface{}, t reflect.Type) []string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	var problems []string
+	switch value := raw.(type) {
+	case map[string]interface{}:
+		switch t.Kind() {
+		case reflect.Struct:
+			fields := make(map[string]reflect.Type)
+			for i := 0; i < t.NumField(); i++ {
+				name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+				if name != "" && name != "-" {
+					fields[name] = t.Field(i).Type
+				}
+			}
+			for key, v := range value {
+				fieldType, known := fields[key]
+				if !known {
+					problems = append(problems, fmt.Sprintf("%s: unknown field", join(path, key)))
+					continue
+				}
+				problems = append(problems, unknownFields(join(path, key), v, fieldType)...)
+			}
+		case reflect.Map:
+			for key, v := range value {
+				problems = append(problems, unknownFields(fmt.Sprintf("%s[%q]", path, key), v, t.Elem())...)
+			}
+		}
+	case []interface{}:
+		if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			for i, v := range value {
+				problems = append(problems, unknownFields(fmt.Sprintf("%s[%d]", path, i), v, t.Elem())...)
+			}
+		}
+	}
+	return problems
+}
+
+func join(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// typeName names the JSON type expected for a Go type.
+func typeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	default:
+		return "an object"
+	}
+}
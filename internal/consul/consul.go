@@ -0,0 +1,402 @@
+// Package consul exposes a subset of the Consul HTTP API backed by the registry,
+// so that tools and libraries speaking Consul can discover and register workers.
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"registry-service/internal/auth"
+	"registry-service/internal/middleware"
+	"registry-service/internal/registry"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultWait = 5 * time.Minute  // Blocking query duration when the wait parameter is not set
+	maxWait     = 10 * time.Minute // Upper bound of the wait parameter, as enforced by Consul
+
+	statusPassing  = "passing"
+	statusCritical = "critical"
+)
+
+// Source is the registry view served by the API, implemented by *registry.Registry.
+type Source interface {
+	Snapshot() []registry.Worker
+	Index() uint64
+	WaitForChange(ctx context.Context, index uint64) uint64
+	Register(ctx context.Context, reg registry.Registration, override bool) (registry.Worker, string, error)
+	DeregisterWorker(ctx context.Context, id string, token string, override bool) error
+}
+
+// API serves the Consul compatible endpoints.
+type API struct {
+	reg        Source
+	datacenter string
+}
+
+// NewAPI creates the Consul compatibility layer for the registry.
+func NewAPI(reg Source, datacenter string) *API {
+	return &API{reg: reg, datacenter: datacenter}
+}
+
+// RegisterRoutes mounts the Consul endpoints on the router.
+func (a *API) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/v1/catalog/services", middleware.RequireScope(auth.ScopeRead, a.catalogServicesHandler)).Methods("GET")
+	router.HandleFunc("/v1/catalog/service/{name}", middleware.RequireScope(auth.ScopeRead, a.catalogServiceHandler)).Methods("GET")
+	router.HandleFunc("/v1/health/service/{name}", middleware.RequireScope(auth.ScopeRead, a.healthServiceHandler)).Methods("GET")
+	router.HandleFunc("/v1/agent/service/register", middleware.RequireScope(auth.ScopeRegister, a.registerHandler)).Methods("PUT")
+	router.HandleFunc("/v1/agent/service/deregister/{id}", middleware.RequireScope(auth.ScopeRegister, a.deregisterHandler)).Methods("PUT")
+}
+
+// CatalogService is an entry of /v1/catalog/service/{name}.
+type CatalogService struct {
+	ID             string
+	Node           string
+	Address        string
+	Datacenter     string
+	ServiceID      string
+	ServiceName    string
+	ServiceAddress string
+	ServicePort    int
+	ServiceTags    []string
+	ServiceMeta    map[string]string
+	CreateIndex    uint64
+	ModifyIndex    uint64
+}
+
+// Node describes the node hosting a service. Each worker is reported as its own node.
+type Node struct {
+	ID         string
+	Node       string
+	Address    string
+	Datacenter string
+}
+
+// AgentService describes a service instance.
+type AgentService struct {
+	ID      string
+	Service string
+	Tags    []string
+	Address string
+	Port    int
+	Meta    map[string]string
+}
+
+// HealthCheck describes the registry health check of a service instance.
+type HealthCheck struct {
+	Node        string
+	CheckID     string
+	Name        string
+	Status      string
+	Output      string
+	ServiceID   string
+	ServiceName string
+}
+
+// ServiceEntry is an entry of /v1/health/service/{name}.
+type ServiceEntry struct {
+	Node    Node
+	Service AgentService
+	Checks  []HealthCheck
+}
+
+// ServiceDefinition is the body of /v1/agent/service/register.
+type ServiceDefinition struct {
+	ID      string
+	Name    string
+	Tags    []string
+	Address string
+	Port    int
+	Meta    map[string]string
+}
+
+func (a *API) catalogServicesHandler(w http.ResponseWriter, r *http.Request) {
+	workers, index, ok := a.blockingSnapshot(w, r)
+	if !ok {
+		return
+	}
+
+	services := make(map[string][]string)
+	for _, worker := range workers {
+		tags := services[worker.Service]
+		for _, tag := range worker.Tags {
+			if !slices.Contains(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+		if tags == nil {
+			tags = []string{}
+		}
+		sort.Strings(tags)
+		services[worker.Service] = tags
+	}
+
+	a.writeJSON(w, r, index, services)
+}
+
+func (a *API) catalogServiceHandler(w http.ResponseWriter, r *http.Request) {
+	workers, index, ok := a.blockingSnapshot(w, r)
+	if !ok {
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	tag := r.URL.Query().Get("tag")
+	services := make([]CatalogService, 0)
+	for _, worker := range workers {
+		if worker.Service != name || (tag != "" && !slices.Contains(worker.Tags, tag)) {
+			continue
+		}
+		services = append(services, CatalogService{
+			ID:             worker.ID,
+			Node:           worker.ID,
+			Address:        worker.Host,
+			Datacenter:     a.datacenter,
+			ServiceID:      worker.ID,
+			ServiceName:    worker.Service,
+			ServiceAddress: worker.Host,
+			ServicePort:    int(worker.HTTPPort),
+			ServiceTags:    nonNilTags(worker.Tags),
+			ServiceMeta:    serviceMeta(worker),
+			CreateIndex:    index,
+			ModifyIndex:    index,
+		})
+	}
+
+	a.writeJSON(w, r, index, services)
+}
+
+func (a *API) healthServiceHandler(w http.ResponseWriter, r *http.Request) {
+	workers, index, ok := a.blockingSnapshot(w, r)
+	if !ok {
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	query := r.URL.Query()
+	_, passingOnly := query["passing"]
+	if passingOnly && query.Get("passing") == "false" {
+		passingOnly = false
+	}
+	tag := query.Get("tag")
+
+	entries := make([]ServiceEntry, 0)
+	for _, worker := range workers {
+		if worker.Service != name || (tag != "" && !slices.Contains(worker.Tags, tag)) {
+			continue
+		}
+		if passingOnly && !worker.IsHealthy {
+			continue
+		}
+
+		status := statusCritical
+		if worker.IsHealthy {
+			status = statusPassing
+		}
+		entries = append(entries, ServiceEntry{
+			Node: Node{
+				ID:         worker.ID,
+				Node:       worker.ID,
+				Address:    worker.Host,
+				Datacenter: a.datacenter,
+			},
+			Service: AgentService{
+				ID:      worker.ID,
+				Service: worker.Service,
+				Tags:    nonNilTags(worker.Tags),
+				Address: worker.Host,
+				Port:    int(worker.HTTPPort),
+				Meta:    serviceMeta(worker),
+			},
+			Checks: []HealthCheck{{
+				Node:        worker.ID,
+				CheckID:     "service:" + worker.ID,
+				Name:        "Registry health check",
+				Status:      status,
+				Output:      "Last checked at " + worker.LastHealthCheck.Format(time.RFC3339),
+				ServiceID:   worker.ID,
+				ServiceName: worker.Service,
+			}},
+		})
+	}
+
+	a.writeJSON(w, r, index, entries)
+}
+
+func (a *API) registerHandler(w http.ResponseWriter, r *http.Request) {
+	requestID := middleware.GetRequestIDFromContext(r.Context())
+	logger := middleware.LoggerFromContext(r.Context())
+	logger.Debug(requestID, "Handling Consul service registration")
+
+	// Unknown fields are accepted, as Consul clients send service definitions with checks, weights...
+	var def ServiceDefinition
+	if err := json.NewDecoder(r.Body).Decode(&def); err != nil {
+		err = middleware.BodyError(err)
+		if middleware.IsBodyTooLarge(err) {
+			http.Error(w, "Request decode failed: "+err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Request decode failed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if def.Name == "" {
+		http.Error(w, "Missing service name", http.StatusBadRequest)
+		return
+	}
+	if def.ID == "" {
+		def.ID = def.Name
+	}
+	if def.Port < 0 || def.Port > 65535 {
+		http.Error(w, "Invalid service port", http.StatusBadRequest)
+		return
+	}
+	host, err := middleware.RequestWorkerHost(r, def.Address)
+	if errors.Is(err, middleware.ErrUntrustedHost) {
+		http.Error(w, "Permission denied: "+err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Invalid service address: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var grpcPort int
+	if value, ok := def.Meta["grpc_port"]; ok {
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 0 || port > 65535 {
+			http.Error(w, "Invalid grpc_port meta", http.StatusBadRequest)
+			return
+		}
+		grpcPort = port
+	}
+
+	token, override, err := middleware.WorkerToken(r, def.ID)
+	if err != nil {
+		writeRegistryError(w, def.ID, err)
+		return
+	}
+	_, issued, err := a.reg.Register(r.Context(), registry.Registration{
+		ID:       def.ID,
+		Service:  def.Name,
+		Tags:     def.Tags,
+		Host:     host,
+		HTTPPort: int32(def.Port),
+		GRPCPort: int32(grpcPort),
+		Token:    token,
+	}, override)
+	if err != nil {
+		writeRegistryError(w, def.ID, err)
+		return
+	}
+	if issued != "" {
+		w.Header().Set(middleware.WorkerTokenHeader, issued)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (a *API) deregisterHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	middleware.LoggerFromContext(r.Context()).Debug(middleware.GetRequestIDFromContext(r.Context()), "Handling Consul service deregistration of %s", id)
+
+	token, override, err := middleware.WorkerToken(r, id)
+	if err == nil {
+		err = a.reg.DeregisterWorker(r.Context(), id, token, override)
+	}
+	if err != nil {
+		writeRegistryError(w, id, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// writeRegistryError writes the error returned by the registry as a plain text response, like Consul does.
+func writeRegistryError(w http.ResponseWriter, id string, err error) {
+	var validationErr *registry.ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		http.Error(w, "Invalid service definition: "+strings.Join(validationErr.Problems, "; "), http.StatusBadRequest)
+	case errors.Is(err, registry.ErrTokenMismatch):
+		http.Error(w, "Permission denied: service "+id+" is bound to another worker token", http.StatusForbidden)
+	case errors.Is(err, auth.ErrWorkerIdentityMismatch):
+		http.Error(w, "Permission denied: the client certificate does not name service "+id, http.StatusForbidden)
+	case errors.Is(err, registry.ErrInvalidToken):
+		http.Error(w, "Invalid worker token", http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// blockingSnapshot implements Consul blocking queries: when the index query parameter is set,
+// it waits until the registry modification index exceeds it or the wait duration elapses.
+// An index greater than the one of the registry, e.g. from another registry behind the same address, is answered
+// at once: the client sees the index go backwards and resets it, as with Consul.
+func (a *API) blockingSnapshot(w http.ResponseWriter, r *http.Request) ([]registry.Worker, uint64, bool) {
+	query := r.URL.Query()
+	if value := query.Get("index"); value != "" {
+		index, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid index", http.StatusBadRequest)
+			return nil, 0, false
+		}
+
+		wait := defaultWait
+		if value := query.Get("wait"); value != "" {
+			wait, err = parseWait(value)
+			if err != nil || wait < 0 {
+				http.Error(w, "Invalid wait time", http.StatusBadRequest)
+				return nil, 0, false
+			}
+		}
+		if wait > maxWait {
+			wait = maxWait
+		}
+
+		if index <= a.reg.Index() {
+			ctx, cancel := context.WithTimeout(r.Context(), wait)
+			defer cancel()
+			a.reg.WaitForChange(ctx, index)
+		}
+	}
+
+	// Read the index before the snapshot: a change in between makes the next blocking query return immediately
+	index := a.reg.Index()
+	return a.reg.Snapshot(), index, true
+}
+
+// parseWait parses a Consul wait duration, which defaults to seconds when no unit is given.
+func parseWait(value string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(value)
+}
+
+func (a *API) writeJSON(w http.ResponseWriter, r *http.Request, index uint64, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+	w.Header().Set("X-Consul-KnownLeader", "true")
+	w.Header().Set("X-Consul-LastContact", "0")
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		middleware.LoggerFromContext(r.Context()).Debug(middleware.GetRequestIDFromContext(r.Context()), "Error encoding response: %v", err)
+	}
+}
+
+func serviceMeta(worker registry.Worker) map[string]string {
+	return map[string]string{
+		"grpc_port": strconv.Itoa(int(worker.GRPCPort)),
+	}
+}
+
+func nonNilTags(tags []string) []string {
+	if tags == nil {
+		return []string{}
+	}
+	return tags
+}
@@ -4,26 +4,33 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"net"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
+	"registry-service/internal/config"
 	"registry-service/internal/middleware"
+	"registry-service/internal/observability"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type MongoDB struct {
 	client     *mongo.Client
 	collection *mongo.Collection
+	logger     *middleware.Logger
+	metrics    *observability.RegistryMetrics // Labeled with the namespace of the collection
 }
 
-// NewMongoDB creates a new MongoDB instance
-func NewMongoDB(uri string, dbName string, collectionName string) (*MongoDB, error) {
-	logger := middleware.GetLogger()
+// NewMongoDB creates a new MongoDB instance. Nothing is logged when logger is nil.
+func NewMongoDB(uri string, dbName string, collectionName string, logger *middleware.Logger) (*MongoDB, error) {
+	logger = logger.Component("db")
 
-	logger.Debug("DB - ", "Connecting to MongoDB at URI: %s", uri)
+	// The URI may contain credentials
+	logger.Debug("", "Connecting to MongoDB at URI: %s", config.RedactURI(uri))
 
 	clientOptions := options.Client().ApplyURI(uri)
 	client, err := mongo.Connect(context.TODO(), clientOptions)
@@ -31,28 +38,35 @@ func NewMongoDB(uri string, dbName string, collectionName string) (*MongoDB, err
 		return nil, fmt.Errorf("failed to connect to MongoDB: %w", err)
 	}
 
-	logger.Debug("DB - ", "Connected to MongoDB. Using database: %s, collection: %s", dbName, collectionName)
+	logger.Debug("", "Connected to MongoDB. Using database: %s, collection: %s", dbName, collectionName)
 	collection := client.Database(dbName).Collection(collectionName)
 
 	return &MongoDB{
 		client:     client,
 		collection: collection,
+		logger:     logger,
+		metrics:    observability.NewRegistryMetrics(dbName + "." + collectionName),
 	}, nil
 }
 
+// Namespace returns the name of the database and of the collection of the workers, e.g. registry.workers.
+func (db *MongoDB) Namespace() string {
+	return db.collection.Database().Name() + "." + db.collection.Name()
+}
+
 // Disconnect closes the connection to the MongoDB database
 func (db *MongoDB) Disconnect() error {
-	logger := middleware.GetLogger()
+	logger := db.logger
 
-	logger.Debug("DB - ", "Disconnecting from MongoDB...")
+	logger.Debug("", "Disconnecting from MongoDB...")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	err := db.client.Disconnect(ctx)
 	if err != nil {
-		logger.Info("DB - ", "Failed to disconnect from MongoDB: %v", err)
+		logger.Error("", "Failed to disconnect from MongoDB: %v", err)
 	} else {
-		logger.Debug("DB - ", "Disconnected from MongoDB successfully.")
+		logger.Debug("", "Disconnected from MongoDB successfully.")
 	}
 	return err
 }
@@ -63,7 +77,7 @@ func (db *MongoDB) CreateIndexes() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	logger := middleware.GetLogger()
+	logger := db.logger
 
 	indexModel := mongo.IndexModel{
 		Keys:    bson.D{{Key: "id", Value: 1}},
@@ -72,7 +86,7 @@ func (db *MongoDB) CreateIndexes() error {
 
 	_, err := db.collection.Indexes().CreateOne(ctx, indexModel)
 	if err != nil {
-		logger.Info("", "Failed to create index on MongoDB collection: %v", err)
+		logger.Error("", "Failed to create index on MongoDB collection: %v", err)
 		return err
 	}
 
@@ -80,40 +94,163 @@ func (db *MongoDB) CreateIndexes() error {
 	return nil
 }
 
+// operation is a MongoDB operation in progress, traced and measured.
+type operation struct {
+	name    string
+	start   time.Time
+	span    trace.Span
+	metrics *observability.RegistryMetrics
+}
+
+// startOperation starts an operation, named after the method running it, that sends command to the collection
+// for the worker id, if any. The returned context carries the client span of the operation.
+func (db *MongoDB) startOperation(ctx context.Context, name string, command string, id string) (context.Context, *operation) {
+	attributes := []attribute.KeyValue{
+		attribute.String("db.system", "mongodb"),
+		attribute.String("db.namespace", db.collection.Database().Name()),
+		attribute.String("db.collection.name", db.collection.Name()),
+		attribute.String("db.operation.name", command),
+	}
+	if id != "" {
+		attributes = append(attributes, observability.AttrWorkerID.String(id))
+	}
+	ctx, span := observability.StartSpan(ctx, command+" "+db.collection.Name(),
+		trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attributes...))
+	return ctx, &operation{name: name, start: time.Now(), span: span, metrics: db.metrics}
+}
+
+// end records the duration and the error, if any, of the operation and ends its span.
+func (op *operation) end(err error) {
+	op.metrics.RecordStorageOperation(op.name, time.Since(op.start), err)
+	observability.EndSpan(op.span, err)
+}
+
 // InsertWorker inserts a new worker into the collection
-func (db *MongoDB) InsertWorker(id string, host string, httpport int32, grpcport int32) error {
-	logger := middleware.GetLogger()
+func (db *MongoDB) InsertWorker(ctx context.Context, id string, host string, httpport int32, grpcport int32) error {
+	return db.InsertServiceWorker(ctx, id, "", nil, host, httpport, grpcport)
+}
+
+// InsertServiceWorker inserts a new worker providing the given service into the collection
+func (db *MongoDB) InsertServiceWorker(ctx context.Context, id string, service string, tags []string, host string, httpport int32, grpcport int32) error {
+	logger := db.logger.With(middleware.FieldWorkerID, id)
+	requestID := middleware.GetRequestIDFromContext(ctx)
 
-	// Expect a validate IP address
-	if net.ParseIP(host) == nil {
-		logger.Info("DB - ", "Invalid worker IP: %s", host)
-		return errors.New("invalid worker IP")
+	// Expect a valid IP address or hostname
+	if !middleware.IsValidHost(host) {
+		logger.Warn(requestID, "Invalid worker host: %s", host)
+		return errors.New("invalid worker host")
 	}
 
-	logger.Debug("DB - ", "Inserting new worker: host %s http port %d grpc port %d", host, httpport, grpcport)
+	logger.Debug(requestID, "Inserting new worker: service %s host %s http port %d grpc port %d", service, host, httpport, grpcport)
 
 	worker := bson.M{
 		"id":                id,
+		"service":           service,
+		"tags":              tags,
 		"host":              host,
 		"http_port":         int32(httpport), // MongoDB supports int32 or int64 and defaults to int64, thus must cast to int32 when inserting values in DB
 		"grpc_port":         int32(grpcport), // MongoDB supports int32 or int64 and defaults to int64, thus must cast to int32 when inserting values in DB
 		"is_healthy":        true,
 		"last_health_check": time.Now(),
 	}
-	_, err := db.collection.InsertOne(context.TODO(), worker)
+	ctx, op := db.startOperation(ctx, "InsertServiceWorker", "insertOne", id)
+	_, err := db.collection.InsertOne(ctx, worker)
+	if err != nil {
+		logger.Error(requestID, "Failed to insert worker: %v", err)
+	} else {
+		logger.Debug(requestID, "Worker inserted successfully with id %s", id)
+	}
+	op.end(err)
+	return err
+}
+
+// UpdateWorker updates the service, tags and address of an existing worker
+func (db *MongoDB) UpdateWorker(ctx context.Context, id string, service string, tags []string, host string, httpport int32, grpcport int32) error {
+	logger := db.logger.With(middleware.FieldWorkerID, id)
+	requestID := middleware.GetRequestIDFromContext(ctx)
+
+	if !middleware.IsValidHost(host) {
+		logger.Warn(requestID, "Invalid worker host: %s", host)
+		return errors.New("invalid worker host")
+	}
+
+	logger.Debug(requestID, "Updating worker with id %s: service %s host %s http port %d grpc port %d", id, service, host, httpport, grpcport)
+
+	filter := bson.M{"id": id}
+	update := bson.M{
+		"$set": bson.M{
+			"service":   service,
+			"tags":      tags,
+			"host":      host,
+			"http_port": int32(httpport),
+			"grpc_port": int32(grpcport),
+		},
+	}
+	ctx, op := db.startOperation(ctx, "UpdateWorker", "updateOne", id)
+	_, err := db.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		logger.Error(requestID, "Failed to update worker: %v", err)
+	} else {
+		logger.Debug(requestID, "Worker updated successfully")
+	}
+	op.end(err)
+	return err
+}
+
+// SetWorkerTokenHash stores the SHA-256 of the token a worker ID is bound to
+func (db *MongoDB) SetWorkerTokenHash(ctx context.Context, id string, tokenHash string) error {
+	logger := db.logger.With(middleware.FieldWorkerID, id)
+	requestID := middleware.GetRequestIDFromContext(ctx)
+
+	logger.Debug(requestID, "Binding worker with id %s to its token", id)
+
+	filter := bson.M{"id": id}
+	update := bson.M{
+		"$set": bson.M{
+			"token_sha256": tokenHash,
+		},
+	}
+	ctx, op := db.startOperation(ctx, "SetWorkerTokenHash", "updateOne", id)
+	_, err := db.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		logger.Error(requestID, "Failed to update worker token: %v", err)
+	} else {
+		logger.Debug(requestID, "Worker token updated successfully")
+	}
+	op.end(err)
+	return err
+}
+
+// UpdateWorkerAddresses stores the addresses resolved from the hostname of a worker
+func (db *MongoDB) UpdateWorkerAddresses(ctx context.Context, id string, addresses []string) error {
+	logger := db.logger.With(middleware.FieldWorkerID, id)
+	requestID := middleware.GetRequestIDFromContext(ctx)
+
+	logger.Debug(requestID, "Updating addresses of worker with id %s: %v", id, addresses)
+
+	filter := bson.M{"id": id}
+	update := bson.M{
+		"$set": bson.M{
+			"addresses": addresses,
+		},
+	}
+	ctx, op := db.startOperation(ctx, "UpdateWorkerAddresses", "updateOne", id)
+	_, err := db.collection.UpdateOne(ctx, filter, update)
 	if err != nil {
-		logger.Info("DB - ", "Failed to insert worker: %v", err)
+		logger.Error(requestID, "Failed to update worker addresses: %v", err)
 	} else {
-		logger.Debug("DB - ", "Worker inserted successfully with id %s", id)
+		logger.Debug(requestID, "Worker addresses updated successfully")
 	}
+	op.end(err)
 	return err
 }
 
 // UpdateWorkerHealth updates the health status of a worker
-func (db *MongoDB) UpdateWorkerHealth(id string, isHealthy bool) error {
-	logger := middleware.GetLogger()
+func (db *MongoDB) UpdateWorkerHealth(ctx context.Context, id string, isHealthy bool) error {
+	logger := db.logger.With(middleware.FieldWorkerID, id)
+	requestID := middleware.GetRequestIDFromContext(ctx)
 
-	logger.Debug("DB - ", "Updating health for worker with id %s", id)
+	logger.Debug(requestID, "Updating health for worker with id %s", id)
 
 	filter := bson.M{"id": id}
 	update := bson.M{
@@ -122,60 +259,71 @@ func (db *MongoDB) UpdateWorkerHealth(id string, isHealthy bool) error {
 			"last_health_check": time.Now(),
 		},
 	}
-	_, err := db.collection.UpdateOne(context.TODO(), filter, update)
+	ctx, op := db.startOperation(ctx, "UpdateWorkerHealth", "updateOne", id)
+	_, err := db.collection.UpdateOne(ctx, filter, update)
 	if err != nil {
-		logger.Info("DB - ", "Failed to update worker health: %v", err)
+		logger.Error(requestID, "Failed to update worker health: %v", err)
 	} else {
-		logger.Debug("DB - ", "Worker health updated successfully")
+		logger.Debug(requestID, "Worker health updated successfully")
 	}
+	op.end(err)
 	return err
 }
 
 // GetAllWorkers retrieves all workers from the collection
-func (db *MongoDB) GetAllWorkers() ([]bson.M, error) {
-	logger := middleware.GetLogger()
+func (db *MongoDB) GetAllWorkers(ctx context.Context) ([]bson.M, error) {
+	logger := db.logger
+	requestID := middleware.GetRequestIDFromContext(ctx)
 
-	logger.Debug("DB - ", "Retrieving all workers from MongoDB collection.")
+	logger.Debug(requestID, "Retrieving all workers from MongoDB collection.")
 
+	ctx, op := db.startOperation(ctx, "GetAllWorkers", "find", "")
 	var workers []bson.M
-	cursor, err := db.collection.Find(context.TODO(), bson.M{})
+	cursor, err := db.collection.Find(ctx, bson.M{})
 	if err != nil {
-		logger.Info("DB - ", "Failed to retrieve workers: %v", err)
+		logger.Error(requestID, "Failed to retrieve workers: %v", err)
+		op.end(err)
 		return nil, err
 	}
-	if err = cursor.All(context.TODO(), &workers); err != nil {
-		logger.Info("DB - ", "Failed to decode workers: %v", err)
+	if err = cursor.All(ctx, &workers); err != nil {
+		logger.Error(requestID, "Failed to decode workers: %v", err)
+		op.end(err)
 		return nil, err
 	}
-	logger.Debug("DB - ", "Retrieved %d workers from MongoDB.", len(workers))
+	op.span.SetAttributes(attribute.Int("db.response.returned_rows", len(workers)))
+	op.end(nil)
+	logger.Debug(requestID, "Retrieved %d workers from MongoDB.", len(workers))
 	return workers, nil
 }
 
 // ClearCollection clears all documents in the collection for testing purposes
 func (db *MongoDB) ClearCollection() error {
-	logger := middleware.GetLogger()
+	logger := db.logger
 
-	logger.Debug("DB - ", "Clearing MongoDB collection for testing.")
+	logger.Debug("", "Clearing MongoDB collection for testing.")
 	_, err := db.collection.DeleteMany(context.TODO(), bson.M{})
 	if err != nil {
-		logger.Info("DB - ", "Failed to clear collection: %v", err)
+		logger.Error("", "Failed to clear collection: %v", err)
 	} else {
-		logger.Debug("DB - ", "MongoDB collection cleared successfully.")
+		logger.Debug("", "MongoDB collection cleared successfully.")
 	}
 	return err
 }
 
 // DeleteWorker removes a worker from the MongoDB collection
-func (db *MongoDB) DeleteWorker(id string) error {
-	logger := middleware.GetLogger()
+func (db *MongoDB) DeleteWorker(ctx context.Context, id string) error {
+	logger := db.logger.With(middleware.FieldWorkerID, id)
+	requestID := middleware.GetRequestIDFromContext(ctx)
 
-	logger.Debug("DB - ", "Removing worker with id %s", id)
+	logger.Debug(requestID, "Removing worker with id %s", id)
 	filter := bson.M{"id": id}
-	_, err := db.collection.DeleteOne(context.TODO(), filter)
+	ctx, op := db.startOperation(ctx, "DeleteWorker", "deleteOne", id)
+	_, err := db.collection.DeleteOne(ctx, filter)
 	if err != nil {
-		logger.Debug("DB - ", "Failed to delete worker from database: %v", err)
+		logger.Debug(requestID, "Failed to delete worker from database: %v", err)
 	} else {
-		logger.Debug("DB - ", "Worker deleted successfully.")
+		logger.Debug(requestID, "Worker deleted successfully.")
 	}
+	op.end(err)
 	return err
 }
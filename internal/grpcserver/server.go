@@ -0,0 +1,455 @@
+package grpcserver
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"registry-service/internal/auth"
+	"registry-service/internal/config"
+	"registry-service/internal/grpcserver/registrypb"
+	"registry-service/internal/middleware"
+	"registry-service/internal/observability"
+	"registry-service/internal/ratelimit"
+	"registry-service/internal/registry"
+	"registry-service/internal/tlsutil"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// registryServer implements registrypb.RegistryServiceServer on top of the registry.
+type registryServer struct {
+	registrypb.UnimplementedRegistryServiceServer
+	reg  *registry.Registry
+	opts Options
+}
+
+func (s *registryServer) Register(ctx context.Context, req *registrypb.RegisterRequest) (*registrypb.RegisterResponse, error) {
+	if req.GetId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing worker id")
+	}
+	if req.GetHttpPort() < 0 || req.GetHttpPort() > 65535 || req.GetGrpcPort() < 0 || req.GetGrpcPort() > 65535 {
+		return nil, status.Error(codes.InvalidArgument, "invalid port")
+	}
+
+	override, err := workerOverride(ctx, req.GetId())
+	if err != nil {
+		return nil, registryError(req.GetId(), err)
+	}
+
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "unknown peer address")
+	}
+	host, err := s.opts.TrustedNetworks.WorkerHost(middleware.GetIPFromRemoteAddr(p.Addr.String()), req.GetHost())
+	if errors.Is(err, middleware.ErrUntrustedHost) {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	worker, issued, err := s.reg.Register(ctx, registry.Registration{
+		ID:       req.GetId(),
+		Service:  req.GetService(),
+		Tags:     req.GetTags(),
+		Host:     host,
+		HTTPPort: req.GetHttpPort(),
+		GRPCPort: req.GetGrpcPort(),
+		Token:    req.GetToken(),
+	}, override)
+	if err != nil {
+		return nil, registryError(req.GetId(), err)
+	}
+	return &registrypb.RegisterResponse{Worker: toProto(worker), Token: issued}, nil
+}
+
+func (s *registryServer) Deregister(ctx context.Context, req *registrypb.DeregisterRequest) (*registrypb.DeregisterResponse, error) {
+	if req.GetId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing worker id")
+	}
+
+	override, err := workerOverride(ctx, req.GetId())
+	if err != nil {
+		return nil, registryError(req.GetId(), err)
+	}
+	if err := s.reg.DeregisterWorker(ctx, req.GetId(), req.GetToken(), override); err != nil {
+		return nil, registryError(req.GetId(), err)
+	}
+	return &registrypb.DeregisterResponse{}, nil
+}
+
+func (s *registryServer) Heartbeat(ctx context.Context, req *registrypb.HeartbeatRequest) (*registrypb.HeartbeatResponse, error) {
+	override, err := workerOverride(ctx, req.GetId())
+	if err != nil {
+		return nil, registryError(req.GetId(), err)
+	}
+	worker, err := s.reg.Heartbeat(ctx, req.GetId(), req.GetToken(), override)
+	if err != nil {
+		return nil, registryError(req.GetId(), err)
+	}
+	return &registrypb.HeartbeatResponse{Worker: toProto(worker)}, nil
+}
+
+func (s *registryServer) GetWorker(ctx context.Context, req *registrypb.GetWorkerRequest) (*registrypb.GetWorkerResponse, error) {
+	worker, found := s.reg.GetWorker(req.GetId())
+	if !found {
+		return nil, status.Errorf(codes.NotFound, "worker %q is not registered", req.GetId())
+	}
+	return &registrypb.GetWorkerResponse{Worker: toProto(worker)}, nil
+}
+
+func (s *registryServer) ListWorkers(ctx context.Context, req *registrypb.ListWorkersRequest) (*registrypb.ListWorkersResponse, error) {
+	workers, index := s.list(req.GetService(), req.GetHealthyOnly())
+	return &registrypb.ListWorkersResponse{Workers: workers, Index: index}, nil
+}
+
+func (s *registryServer) Watch(req *registrypb.WatchRequest, stream registrypb.RegistryService_WatchServer) error {
+	ctx := stream.Context()
+
+	for {
+		workers, index := s.list(req.GetService(), req.GetHealthyOnly())
+		if err := stream.Send(&registrypb.WatchResponse{Workers: workers, Index: index}); err != nil {
+			return err
+		}
+
+		s.reg.WaitForChange(ctx, index)
+		if ctx.Err() != nil {
+			return status.FromContextError(ctx.Err()).Err()
+		}
+	}
+}
+
+// list returns the matching workers along with the registry modification index.
+func (s *registryServer) list(service string, healthyOnly bool) ([]*registrypb.Worker, uint64) {
+	index := s.reg.Index()
+	workers := make([]*registrypb.Worker, 0)
+	for _, worker := range s.reg.Snapshot() {
+		if service != "" && worker.Service != service {
+			continue
+		}
+		if healthyOnly && !worker.IsHealthy {
+			continue
+		}
+		workers = append(workers, toProto(worker))
+	}
+	return workers, index
+}
+
+func toProto(worker registry.Worker) *registrypb.Worker {
+	return &registrypb.Worker{
+		Id:              worker.ID,
+		Service:         worker.Service,
+		Tags:            worker.Tags,
+		Host:            worker.Host,
+		Addresses:       worker.Addresses,
+		HttpPort:        worker.HTTPPort,
+		GrpcPort:        worker.GRPCPort,
+		Healthy:         worker.IsHealthy,
+		LastHealthCheck: timestamppb.New(worker.LastHealthCheck),
+	}
+}
+
+// workerOverride reports whether the caller may act on the worker regardless of its token, see
+// auth.Identity.WorkerOverride.
+func workerOverride(ctx context.Context, id string) (bool, error) {
+	identity, _ := auth.IdentityFromContext(ctx)
+	return identity.WorkerOverride(id)
+}
+
+// registryError converts an error returned by the registry for an operation on a worker to a gRPC status.
+func registryError(id string, err error) error {
+	var validationErr *registry.ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		return status.Error(codes.InvalidArgument, validationErr.Error())
+	case errors.Is(err, registry.ErrTokenMismatch):
+		return status.Errorf(codes.PermissionDenied, "worker %q is bound to another token", id)
+	case errors.Is(err, auth.ErrWorkerIdentityMismatch):
+		return status.Errorf(codes.PermissionDenied, "the client certificate does not name worker %q", id)
+	case errors.Is(err, registry.ErrInvalidToken):
+		return status.Errorf(codes.InvalidArgument, "the worker token must be at least %d characters long", registry.MinTokenLength)
+	case errors.Is(err, registry.ErrWorkerNotFound):
+		return status.Errorf(codes.NotFound, "worker %q is not registered", id)
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+// methodScopes are the scopes required by each method of the service.
+var methodScopes = map[string]auth.Scope{
+	registrypb.RegistryService_Register_FullMethodName:    auth.ScopeRegister,
+	registrypb.RegistryService_Deregister_FullMethodName:  auth.ScopeRegister,
+	registrypb.RegistryService_Heartbeat_FullMethodName:   auth.ScopeRegister,
+	registrypb.RegistryService_GetWorker_FullMethodName:   auth.ScopeRead,
+	registrypb.RegistryService_ListWorkers_FullMethodName: auth.ScopeRead,
+	registrypb.RegistryService_Watch_FullMethodName:       auth.ScopeRead,
+}
+
+// authorize checks the API key sent in the x-api-key metadata, like the X-API-Key header of the HTTP server,
+// the bearer token of the authorization metadata, or else the verified client certificate of the TLS connection,
+// and returns a context carrying the identity of the credential.
+func (s *registryServer) authorize(ctx context.Context, method string, requestID string) (context.Context, error) {
+	limiter := s.opts.Limiter
+	if limiter.Enabled() {
+		var clientIP string
+		if p, ok := peer.FromContext(ctx); ok {
+			clientIP = middleware.GetIPFromRemoteAddr(p.Addr.String())
+		}
+		if ok, retryAfter := limiter.AllowIP(clientIP); !ok {
+			return ctx, s.throttled(ctx, ratelimit.LimitIP, method, retryAfter, requestID)
+		}
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	var identity *auth.Identity
+	if keys := md.Get("x-api-key"); len(keys) > 0 {
+		var ok bool
+		if identity, ok = s.opts.Authenticator.KeyStore().Authenticate(keys[0]); !ok {
+			return ctx, status.Error(codes.Unauthenticated, "Missing or invalid API key")
+		}
+	} else if values := md.Get("authorization"); len(values) > 0 {
+		token, isBearer := middleware.BearerToken(values[0])
+		validator := s.opts.Authenticator.JWTValidator()
+		if !isBearer || validator == nil {
+			return ctx, status.Error(codes.Unauthenticated, "Bearer tokens are not accepted")
+		}
+		var err error
+		if identity, err = validator.Authenticate(token); err != nil {
+			s.opts.Logger.Warn(requestID, "Rejected bearer token: %v", err)
+			return ctx, status.Error(codes.Unauthenticated, "Invalid bearer token")
+		}
+	} else if cert := verifiedCertificate(ctx); cert != nil {
+		var ok bool
+		if identity, ok = s.opts.Authenticator.CertificateIdentity(cert); !ok {
+			return ctx, status.Error(codes.Unauthenticated, "The client certificate has no subject alternative name")
+		}
+	} else {
+		return ctx, status.Error(codes.Unauthenticated, "Missing or invalid API key")
+	}
+
+	scope, known := methodScopes[method]
+	if !known {
+		scope = auth.ScopeAdmin
+	}
+	if !identity.HasScope(scope) {
+		s.opts.Logger.Warn(requestID, "%s is not allowed to call %s: missing scope %s", identity, method, scope)
+		return ctx, status.Errorf(codes.PermissionDenied, "The credential does not grant the %s scope", scope)
+	}
+
+	if limiter.Enabled() {
+		if ok, retryAfter, name := limiter.AllowIdentity(identity, "", method); !ok {
+			return ctx, s.throttled(ctx, name, method, retryAfter, requestID)
+		}
+	}
+
+	s.opts.Logger.Debug(requestID, "Authenticated as %s", identity)
+	return auth.WithIdentity(ctx, identity), nil
+}
+
+// verifiedCertificate returns the verified client certificate of the TLS connection of the call, nil without one.
+func verifiedCertificate(ctx context.Context) *x509.Certificate {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 {
+		return nil
+	}
+	return info.State.VerifiedChains[0][0]
+}
+
+// throttled returns the error of a call rejected by a rate limit, and sends the delay after which the client
+// may retry in the retry-after metadata.
+func (s *registryServer) throttled(ctx context.Context, name string, method string, retryAfter time.Duration, requestID string) error {
+	s.opts.Logger.Info(requestID, "Rate limit %s exceeded on %s", name, method)
+	s.opts.Metrics.RecordThrottledRequest(name, method)
+	grpc.SetHeader(ctx, metadata.Pairs("retry-after", ratelimit.RetryAfter(retryAfter)))
+	return status.Error(codes.ResourceExhausted, "Too many requests, retry later")
+}
+
+// authorizedStream overrides the context of a stream with the authorized one.
+type authorizedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authorizedStream) Context() context.Context {
+	return s.ctx
+}
+
+// requestIDMetadata carries the request ID, like the X-Request-ID header of the HTTP server.
+const requestIDMetadata = "x-request-id"
+
+// withRequestID returns a copy of the context carrying the request ID sent by the client in the x-request-id
+// metadata when it is valid, or else a new one.
+func withRequestID(ctx context.Context) (context.Context, string) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	requestID := middleware.NewRequestID()
+	if values := md.Get(requestIDMetadata); len(values) > 0 && middleware.ValidRequestID(values[0]) {
+		requestID = values[0]
+	}
+	return middleware.ContextWithRequestID(ctx, requestID), requestID
+}
+
+// metadataCarrier reads the W3C trace context from the metadata of a call.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if values := metadata.MD(c).Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key string, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// startSpan starts the server span of a call, continuing the trace of the client when its metadata has a
+// traceparent entry.
+func startSpan(ctx context.Context, method string, requestID string) (context.Context, trace.Span) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = observability.ExtractTraceContext(ctx, metadataCarrier(md))
+	return observability.StartSpan(ctx, strings.TrimPrefix(method, "/"),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("rpc.system", "grpc"),
+			attribute.String("rpc.method", method),
+			observability.AttrRequestID.String(requestID),
+		),
+	)
+}
+
+// endSpan records the status code of a call on its span and ends it.
+func endSpan(span trace.Span, err error) {
+	span.SetAttributes(attribute.Int("rpc.grpc.status_code", int(status.Code(err))))
+	observability.EndSpan(span, err)
+}
+
+// unaryInterceptor authenticates, logs, measures and traces unary calls.
+func (s *registryServer) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	ctx, requestID := withRequestID(ctx)
+	ctx, span := startSpan(ctx, info.FullMethod, requestID)
+	grpc.SetHeader(ctx, metadata.Pairs(requestIDMetadata, requestID))
+	s.opts.Logger.Debug(requestID, "Incoming gRPC request %s", info.FullMethod)
+
+	var resp interface{}
+	ctx, err := s.authorize(ctx, info.FullMethod, requestID)
+	if err == nil {
+		resp, err = handler(ctx, req)
+	}
+
+	s.opts.Metrics.RecordGRPCRequest(info.FullMethod, status.Code(err).String(), time.Since(start))
+	endSpan(span, err)
+	if err != nil {
+		s.opts.Logger.Debug(requestID, "gRPC request %s failed: %v", info.FullMethod, err)
+	}
+	return resp, err
+}
+
+// streamInterceptor authenticates, logs, measures and traces streaming calls.
+func (s *registryServer) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	ctx, requestID := withRequestID(ss.Context())
+	ctx, span := startSpan(ctx, info.FullMethod, requestID)
+	ss.SetHeader(metadata.Pairs(requestIDMetadata, requestID))
+	s.opts.Logger.Debug(requestID, "Incoming gRPC stream %s", info.FullMethod)
+
+	ctx, err := s.authorize(ctx, info.FullMethod, requestID)
+	if err == nil {
+		err = handler(srv, &authorizedStream{ServerStream: ss, ctx: ctx})
+	}
+
+	s.opts.Metrics.RecordGRPCRequest(info.FullMethod, status.Code(err).String(), time.Since(start))
+	endSpan(span, err)
+	if err != nil {
+		s.opts.Logger.Debug(requestID, "gRPC stream %s ended: %v", info.FullMethod, err)
+	}
+	return err
+}
+
+// Options are the settings and the dependencies of a gRPC server.
+type Options struct {
+	Port            string
+	TLS             config.TLSConfig // Serves plaintext when no certificate is set
+	Logger          *middleware.Logger
+	Authenticator   *auth.Authenticator
+	Limiter         *ratelimit.Limiter             // Nil to disable rate limiting
+	TrustedNetworks *middleware.TrustedNetworks    // Nil to trust no source
+	Metrics         *observability.RegistryMetrics // Records the requests, defaults to the metrics of the registry
+}
+
+// StartServer starts the gRPC server for the registry service on the given port and returns the server instance.
+// The channel receives the error of the server when it stops serving before it is stopped, and is closed when
+// the server returns.
+func StartServer(reg *registry.Registry, opts Options) (*grpc.Server, <-chan error, error) {
+	if opts.Authenticator == nil {
+		return nil, nil, errors.New("the gRPC server requires an authenticator")
+	}
+
+	serverOpts := []grpc.ServerOption{}
+	if opts.TLS.CertFile != "" {
+		tlsConfig, err := tlsutil.NewServerConfig(opts.TLS, opts.Logger)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load the TLS configuration of the gRPC server: %w", err)
+		}
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	listener, err := net.Listen("tcp", ":"+opts.Port)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	opts.Logger = opts.Logger.Component("grpc")
+	if opts.Metrics == nil {
+		opts.Metrics = observability.NewRegistryMetrics("")
+		if reg != nil {
+			opts.Metrics = reg.Metrics()
+		}
+	}
+	server := &registryServer{reg: reg, opts: opts}
+	srv := grpc.NewServer(append(serverOpts,
+		grpc.UnaryInterceptor(server.unaryInterceptor),
+		grpc.StreamInterceptor(server.streamInterceptor),
+	)...)
+	registrypb.RegisterRegistryServiceServer(srv, server)
+
+	if opts.TLS.CertFile != "" {
+		log.Printf("Starting gRPC server with TLS on %s...", listener.Addr())
+	} else {
+		log.Printf("Starting gRPC server on %s...", listener.Addr())
+	}
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		if err := srv.Serve(listener); err != nil {
+			errs <- err
+		}
+	}()
+
+	return srv, errs, nil
+}
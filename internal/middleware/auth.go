@@ -2,17 +2,99 @@ package middleware
 
 import (
 	"net/http"
-	"registry-service/internal/config"
+	"registry-service/internal/auth"
+	"strings"
 )
 
-// AuthMiddleware is a middleware that checks for a valid API key in the request.
-func AuthMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		apiKey := r.Header.Get("X-API-Key")
-		if apiKey == "" || apiKey != config.AppConfig.APIKey {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+// Authenticate is a middleware that checks for a valid API key or bearer token in the request and attaches
+// the identity of the credential to the request context.
+// The key is read from X-API-Key, or from X-Consul-Token for Consul API clients. Without a key, a JSON Web Token
+// is read from the Authorization header when bearer tokens are enabled, or else the verified client certificate
+// of the TLS connection is used.
+func Authenticate(authenticator *auth.Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestID := GetRequestIDFromContext(r.Context())
+			logger := LoggerFromContext(r.Context())
+
+			apiKey := r.Header.Get("X-API-Key")
+			if apiKey == "" {
+				apiKey = r.Header.Get("X-Consul-Token")
+			}
+
+			var identity *auth.Identity
+			token, isBearer := BearerToken(r.Header.Get("Authorization"))
+			switch {
+			case apiKey == "" && isBearer:
+				validator := authenticator.JWTValidator()
+				if validator == nil {
+					WriteError(w, r, http.StatusUnauthorized, ErrCodeUnauthorized, "Bearer tokens are not accepted")
+					return
+				}
+				var err error
+				if identity, err = validator.Authenticate(token); err != nil {
+					logger.Warn(requestID, "Rejected bearer token: %v", err)
+					w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+					WriteError(w, r, http.StatusUnauthorized, ErrCodeUnauthorized, "Invalid bearer token")
+					return
+				}
+			case apiKey == "" && r.TLS != nil && len(r.TLS.VerifiedChains) > 0:
+				var ok bool
+				if identity, ok = authenticator.CertificateIdentity(r.TLS.VerifiedChains[0][0]); !ok {
+					WriteError(w, r, http.StatusUnauthorized, ErrCodeUnauthorized, "The client certificate has no subject alternative name")
+					return
+				}
+			default:
+				var ok bool
+				if identity, ok = authenticator.KeyStore().Authenticate(apiKey); !ok {
+					WriteError(w, r, http.StatusUnauthorized, ErrCodeUnauthorized, "Missing or invalid API key")
+					return
+				}
+			}
+
+			logger.Debug(requestID, "Authenticated as %s", identity)
+			next.ServeHTTP(w, r.WithContext(auth.WithIdentity(r.Context(), identity)))
+		})
+	}
+}
+
+// BearerToken extracts the token of an Authorization header using the Bearer scheme.
+func BearerToken(authorization string) (string, bool) {
+	scheme, token, found := strings.Cut(authorization, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// RequireScope wraps a handler so that it only serves requests whose identity was granted the scope.
+func RequireScope(scope auth.Scope, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		identity, ok := auth.IdentityFromContext(r.Context())
+		if !ok {
+			WriteError(w, r, http.StatusUnauthorized, ErrCodeUnauthorized, "Missing or invalid API key")
+			return
+		}
+		if !identity.HasScope(scope) {
+			LoggerFromContext(r.Context()).Warn(GetRequestIDFromContext(r.Context()), "%s is not allowed to %s %s: missing scope %s", identity, r.Method, r.URL.Path, scope)
+			WriteError(w, r, http.StatusForbidden, ErrCodeForbidden, "The credential does not grant the "+string(scope)+" scope")
 			return
 		}
-		next.ServeHTTP(w, r)
-	})
+		next(w, r)
+	}
+}
+
+// WorkerTokenHeader is the header carrying the token a worker ID is bound to.
+const WorkerTokenHeader = "X-Worker-Token"
+
+// WorkerToken returns the worker token presented with the request, and whether the caller may act on the worker
+// regardless of its token, see auth.Identity.WorkerOverride.
+func WorkerToken(r *http.Request, id string) (string, bool, error) {
+	identity, _ := auth.IdentityFromContext(r.Context())
+	override, err := identity.WorkerOverride(id)
+	if err != nil {
+		return "", false, err
+	}
+	return r.Header.Get(WorkerTokenHeader), override, nil
 }
@@ -0,0 +1,116 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// DefaultMaxBodyBytes is the maximum size of a request body when none is configured.
+const DefaultMaxBodyBytes = 1 << 20
+
+var (
+	ErrBodyTooLarge = errors.New("request body too large")
+	ErrInvalidBody  = errors.New("invalid request body")
+)
+
+// MaxBodySize returns a middleware rejecting the request bodies larger than limit bytes, or DefaultMaxBodyBytes
+// when limit is not positive. Bodies announcing a larger Content-Length are rejected before being read,
+// the others are cut at the limit.
+func MaxBodySize(limit int64) func(http.Handler) http.Handler {
+	if limit <= 0 {
+		limit = DefaultMaxBodyBytes
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > limit {
+				LoggerFromContext(r.Context()).Info(GetRequestIDFromContext(r.Context()), "Rejected request body of %d bytes from %s", r.ContentLength, ClientIP(r))
+				WriteError(w, r, http.StatusRequestEntityTooLarge, ErrCodePayloadTooLarge, fmt.Sprintf("The request body must not exceed %d bytes", limit))
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// DecodeJSON decodes the JSON request body into v. Unknown fields and data after the JSON value are rejected.
+// The errors wrap ErrBodyTooLarge or ErrInvalidBody and describe the problem for the client.
+func DecodeJSON(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return BodyError(err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		if IsBodyTooLarge(err) {
+			return BodyError(err)
+		}
+		return fmt.Errorf("%w: unexpected data after the JSON object", ErrInvalidBody)
+	}
+	return nil
+}
+
+// BodyError converts an error returned while reading or decoding a JSON request body to an error wrapping
+// ErrBodyTooLarge or ErrInvalidBody, with a message naming the problem.
+func BodyError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return fmt.Errorf("%w: the request body must not exceed %d bytes", ErrBodyTooLarge, maxBytesErr.Limit)
+	case errors.Is(err, io.EOF):
+		return fmt.Errorf("%w: the request body is empty", ErrInvalidBody)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return fmt.Errorf("%w: the JSON is truncated", ErrInvalidBody)
+	case errors.As(err, &syntaxErr):
+		return fmt.Errorf("%w: malformed JSON at offset %d: %s", ErrInvalidBody, syntaxErr.Offset, strings.TrimPrefix(syntaxErr.Error(), "json: "))
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return fmt.Errorf("%w: the body must be a JSON %s", ErrInvalidBody, jsonType(typeErr.Type.Kind().String()))
+		}
+		return fmt.Errorf("%w: field %s must be %s, not %s", ErrInvalidBody, typeErr.Field, jsonType(typeErr.Type.Kind().String()), typeErr.Value)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return fmt.Errorf("%w: unknown field %s", ErrInvalidBody, strings.TrimPrefix(err.Error(), "json: unknown field "))
+	default:
+		return fmt.Errorf("%w: %s", ErrInvalidBody, strings.TrimPrefix(err.Error(), "json: "))
+	}
+}
+
+// jsonType names the JSON type expected for a Go kind.
+func jsonType(kind string) string {
+	switch {
+	case strings.HasPrefix(kind, "int"), strings.HasPrefix(kind, "uint"):
+		return "an integer"
+	case strings.HasPrefix(kind, "float"):
+		return "a number"
+	case kind == "string":
+		return "a string"
+	case kind == "bool":
+		return "a boolean"
+	case kind == "slice", kind == "array":
+		return "an array"
+	default:
+		return "an object"
+	}
+}
+
+// IsBodyTooLarge reports whether err was caused by a request body larger than the limit of MaxBodySize.
+func IsBodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr) || errors.Is(err, ErrBodyTooLarge)
+}
+
+// WriteBodyError writes the error envelope of an error returned by DecodeJSON: 413 when the body is too large,
+// 400 otherwise.
+func WriteBodyError(w http.ResponseWriter, r *http.Request, err error) {
+	if IsBodyTooLarge(err) {
+		WriteError(w, r, http.StatusRequestEntityTooLarge, ErrCodePayloadTooLarge, err.Error())
+		return
+	}
+	WriteError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+}
@@ -1,16 +1,58 @@
 package middleware
 
 import (
+	"encoding/json"
 	"net/http"
 )
 
+// Error codes returned in the error envelope
+const (
+	ErrCodeInvalidRequest   = "invalid_request"
+	ErrCodeValidationFailed = "validation_failed"
+	ErrCodeUnauthorized     = "unauthorized"
+	ErrCodeForbidden        = "forbidden"
+	ErrCodeNotFound         = "not_found"
+	ErrCodeMethodNotAllowed = "method_not_allowed"
+	ErrCodeConflict         = "conflict"
+	ErrCodePayloadTooLarge  = "payload_too_large"
+	ErrCodeRateLimited      = "rate_limited"
+	ErrCodeInternal         = "internal_error"
+)
+
+// ErrorBody is the content of the error envelope.
+type ErrorBody struct {
+	Code      string   `json:"code"`
+	Message   string   `json:"message"`
+	Details   []string `json:"details,omitempty"`
+	RequestID string   `json:"request_id,omitempty"`
+}
+
+// ErrorResponse is the JSON envelope of every error returned by the API.
+type ErrorResponse struct {
+	Error ErrorBody `json:"error"`
+}
+
+// WriteError writes an error envelope with the given status, code and message.
+func WriteError(w http.ResponseWriter, r *http.Request, status int, code string, message string, details ...string) {
+	requestID := GetRequestIDFromContext(r.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Error", code)
+	w.WriteHeader(status)
+
+	body := ErrorResponse{Error: ErrorBody{Code: code, Message: message, Details: details, RequestID: requestID}}
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		LoggerFromContext(r.Context()).Debug(requestID, "Error encoding error response: %v", err)
+	}
+}
+
 // ErrorHandler middleware handles errors during request processing.
 func ErrorHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		next.ServeHTTP(w, r)
 		if status := w.Header().Get("X-Error"); status != "" {
 			requestID := GetRequestIDFromContext(r.Context())
-			GetLogger().Debug(requestID, "Error encountered: %s %s", r.Method, status)
+			LoggerFromContext(r.Context()).Debug(requestID, "Error encountered: %s %s", r.Method, status)
 		}
 	})
 }
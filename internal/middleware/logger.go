@@ -4,27 +4,62 @@ import (
 	"bytes"
 	"io"
 	"net/http"
+	"time"
 )
 
-// Logger middleware logs the details of incoming requests.
+// maxLoggedBody is the number of bytes of the request bodies that are logged.
+const maxLoggedBody = 1024
+
+// Logger middleware logs the details of incoming requests at the debug level, and their status and duration
+// once served. The beginning of the body is logged too: the body is not buffered beyond it, so that large bodies
+// are not held in memory.
 func LoggerMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := LoggerFromContext(r.Context())
+		if !logger.DebugEnabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
 		requestID := GetRequestIDFromContext(r.Context())
-		// Read the request body
-		bodyBytes, err := io.ReadAll(r.Body)
-		if err != nil {
-			http.Error(w, "Unable to read body", http.StatusBadRequest)
-			bodyBytes = []byte("Unable to read body")
+
+		// Read the beginning of the request body. Errors, such as a body exceeding the limit, are left to the handlers
+		// that read the rest of it.
+		preview, _ := io.ReadAll(io.LimitReader(r.Body, maxLoggedBody))
+		bodyString := string(preview)
+		if r.ContentLength > int64(len(preview)) || (r.ContentLength < 0 && len(preview) == maxLoggedBody) {
+			bodyString += "... (truncated)"
 		}
-		defer r.Body.Close()
+		logger.Debug(requestID, "Incoming request from %s : %s %s %s", ClientIP(r), r.Method, r.URL.Path, bodyString)
 
-		// Convert the body to a string and print it
-		bodyString := string(bodyBytes)
-		GetLogger().Debug(requestID, "Incoming request from %s : %s %s %s", r.RemoteAddr, r.Method, r.URL.Path, bodyString)
+		// Put the logged bytes back in front of the rest of the body
+		r.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(preview), r.Body), Closer: r.Body}
 
-		// Reset r.Body so that other parts of the program can read it again.
-		r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
 
-		next.ServeHTTP(w, r)
+		logger.With(FieldDuration, time.Since(start)).Debug(requestID, "Completed %s %s with status %d", r.Method, r.URL.Path, recorder.status)
 	})
 }
+
+// statusRecorder captures the status of a response for the logs.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(statusCode int) {
+	w.status = statusCode
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Unwrap returns the underlying writer, so that http.ResponseController can flush it.
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
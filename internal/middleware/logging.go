@@ -3,9 +3,13 @@ package middleware
 import (
 	"context"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
 	"os"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -13,65 +17,325 @@ import (
 // Key type is unexported to prevent collisions with context keys in other packages.
 type key int
 
-// requestIDKey is the key for request ID values in context.
-const requestIDKey key = 0
+// Keys of the values of the request contexts.
+const (
+	requestIDKey key = iota
+	loggerKey
+	trustedNetworksKey
+)
+
+// Fields of the structured log records.
+const (
+	FieldRequestID = "request_id"
+	FieldWorkerID  = "worker_id"
+	FieldComponent = "component"
+	FieldDuration  = "duration"
+)
+
+// Log formats.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
 
-// Logger is a custom logger that wraps the standard log.Logger.
+// LoggerOptions configure a Logger.
+type LoggerOptions struct {
+	Level           string            // DEBUG, INFO, WARN or ERROR, defaults to INFO
+	ComponentLevels map[string]string // Levels overriding Level for the messages of a component, keyed by component
+	Format          string            // text or json, defaults to text
+	Output          io.Writer         // Defaults to the standard output
+	Handler         slog.Handler      // Receives the records instead of Output, e.g. the handler of an embedding process
+}
+
+// Logger is a structured logger based on log/slog. The messages are filtered by the level of their component,
+// which can be changed at runtime. A nil Logger discards the messages, so that the components created without
+// a logger are silent.
 type Logger struct {
-	logger   *log.Logger
-	logLevel string
+	handler *levelHandler
 }
 
-// NewLogger initializes a new Logger instance with the given log level.
+// NewLogger creates a Logger writing text records with the given level to the standard output. An unknown
+// level is replaced by INFO.
 func NewLogger(logLevel string) *Logger {
-	return &Logger{
-		logger:   log.New(os.Stdout, "", log.LstdFlags),
-		logLevel: logLevel,
+	l, err := NewLoggerWithOptions(LoggerOptions{Level: logLevel})
+	if err != nil {
+		l, _ = NewLoggerWithOptions(LoggerOptions{})
 	}
+	return l
 }
 
-// Debug logs debug messages if the log level is set to DEBUG.
-func (l *Logger) Debug(requestID, format string, v ...interface{}) {
-	if l.logLevel == "DEBUG" {
-		msg := fmt.Sprintf(format, v...)
-		l.logger.Printf("[DEBUG] %s %s", requestID, msg)
+// NewLoggerWithOptions creates a Logger from the options.
+func NewLoggerWithOptions(opts LoggerOptions) (*Logger, error) {
+	handler := opts.Handler
+	if handler == nil {
+		output := opts.Output
+		if output == nil {
+			output = os.Stdout
+		}
+		// The level is checked by levelHandler, the handler itself accepts every record
+		handlerOpts := &slog.HandlerOptions{Level: slog.LevelDebug - 4}
+		switch strings.ToLower(opts.Format) {
+		case "", LogFormatText:
+			handler = slog.NewTextHandler(output, handlerOpts)
+		case LogFormatJSON:
+			handlerOpts.ReplaceAttr = durationMilliseconds
+			handler = slog.NewJSONHandler(output, handlerOpts)
+		default:
+			return nil, fmt.Errorf("unknown log format %q, expected text or json", opts.Format)
+		}
+	}
+
+	l := &Logger{handler: &levelHandler{handler: handler, levels: &levels{}}}
+	if err := l.SetLevel(opts.Level); err != nil {
+		return nil, err
+	}
+	if err := l.SetComponentLevels(opts.ComponentLevels); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// durationMilliseconds writes the durations of the JSON records as a number of milliseconds.
+func durationMilliseconds(groups []string, a slog.Attr) slog.Attr {
+	if a.Value.Kind() == slog.KindDuration {
+		return slog.Float64(a.Key, float64(a.Value.Duration())/float64(time.Millisecond))
+	}
+	return a
+}
+
+// ParseLevel parses a log level: DEBUG, INFO, WARN (or WARNING) or ERROR, in any case. The empty level is INFO.
+func ParseLevel(level string) (slog.Level, error) {
+	switch strings.ToUpper(level) {
+	case "DEBUG":
+		return slog.LevelDebug, nil
+	case "", "INFO":
+		return slog.LevelInfo, nil
+	case "WARN", "WARNING":
+		return slog.LevelWarn, nil
+	case "ERROR":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q, expected DEBUG, INFO, WARN or ERROR", level)
+}
+
+// levels are the levels shared by a logger and the loggers derived from it.
+type levels struct {
+	base       atomic.Int64
+	components atomic.Pointer[map[string]slog.Level]
+}
+
+func (l *levels) of(component string) slog.Level {
+	if components := l.components.Load(); components != nil {
+		if level, ok := (*components)[component]; ok {
+			return level
+		}
+	}
+	return slog.Level(l.base.Load())
+}
+
+// levelHandler filters the records with the level of the component of the logger.
+type levelHandler struct {
+	handler   slog.Handler
+	levels    *levels
+	component string
+}
+
+func (h *levelHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.levels.of(h.component)
+}
+
+func (h *levelHandler) Handle(ctx context.Context, record slog.Record) error {
+	return h.handler.Handle(ctx, record)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{handler: h.handler.WithAttrs(attrs), levels: h.levels, component: h.component}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{handler: h.handler.WithGroup(name), levels: h.levels, component: h.component}
+}
+
+// SetLevel changes the level of the logger and of the loggers derived from it, except for the components
+// whose level is overridden.
+func (l *Logger) SetLevel(logLevel string) error {
+	level, err := ParseLevel(logLevel)
+	if err != nil {
+		return err
 	}
+	l.handler.levels.base.Store(int64(level))
+	return nil
+}
+
+// SetComponentLevels replaces the levels overriding the level of the logger for some components.
+func (l *Logger) SetComponentLevels(componentLevels map[string]string) error {
+	components := make(map[string]slog.Level, len(componentLevels))
+	for component, logLevel := range componentLevels {
+		level, err := ParseLevel(logLevel)
+		if err != nil {
+			return fmt.Errorf("component %s: %w", component, err)
+		}
+		components[strings.ToLower(component)] = level
+	}
+	l.handler.levels.components.Store(&components)
+	return nil
+}
+
+// Component returns a logger adding the component field to the records, and filtering them with the level
+// of the component.
+func (l *Logger) Component(name string) *Logger {
+	if l == nil {
+		return nil
+	}
+	name = strings.ToLower(name)
+	return &Logger{handler: &levelHandler{
+		handler:   l.handler.handler.WithAttrs([]slog.Attr{slog.String(FieldComponent, name)}),
+		levels:    l.handler.levels,
+		component: name,
+	}}
+}
+
+// With returns a logger adding the fields, given as key-value pairs like slog.Logger.With, to the records.
+func (l *Logger) With(args ...interface{}) *Logger {
+	if l == nil {
+		return nil
+	}
+	return &Logger{handler: slog.New(l.handler).With(args...).Handler().(*levelHandler)}
+}
+
+// Slog returns the slog.Logger of the logger, for the callers logging structured messages. It discards the
+// messages of a nil Logger.
+func (l *Logger) Slog() *slog.Logger {
+	if l == nil {
+		return slog.New(discardHandler{})
+	}
+	return slog.New(l.handler)
+}
+
+// Enabled reports whether messages of the level are logged.
+func (l *Logger) Enabled(level slog.Level) bool {
+	return l != nil && l.handler.Enabled(context.Background(), level)
+}
+
+// DebugEnabled reports whether debug messages are logged.
+func (l *Logger) DebugEnabled() bool {
+	return l.Enabled(slog.LevelDebug)
+}
+
+// Debug logs debug messages.
+func (l *Logger) Debug(requestID, format string, v ...interface{}) {
+	l.logf(slog.LevelDebug, requestID, format, v)
 }
 
 // Info logs information messages.
 func (l *Logger) Info(requestID, format string, v ...interface{}) {
-	msg := fmt.Sprintf(format, v...)
-	l.logger.Printf("[INFO] %s %s", requestID, msg)
+	l.logf(slog.LevelInfo, requestID, format, v)
+}
+
+// Warn logs warnings: failures that are recovered from, such as a rejected request or a retried operation.
+func (l *Logger) Warn(requestID, format string, v ...interface{}) {
+	l.logf(slog.LevelWarn, requestID, format, v)
+}
+
+// Error logs errors: failures that lose data or leave the registry inconsistent.
+func (l *Logger) Error(requestID, format string, v ...interface{}) {
+	l.logf(slog.LevelError, requestID, format, v)
 }
 
-// RequestID is a middleware that adds a unique request ID to each request context.
+// logf logs a printf-style message, with the request ID field when there is one.
+func (l *Logger) logf(level slog.Level, requestID string, format string, v []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	record := slog.NewRecord(time.Now(), level, strings.TrimSpace(fmt.Sprintf(format, v...)), 0)
+	if requestID != "" {
+		record.AddAttrs(slog.String(FieldRequestID, requestID))
+	}
+	_ = l.handler.Handle(context.Background(), record)
+}
+
+// discardHandler drops every record.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+// RequestIDHeader carries the ID of a request, from the callers, in the responses and in the health checks.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the length of the longest request ID accepted from a caller.
+const maxRequestIDLength = 128
+
+// ValidRequestID reports whether a request ID sent by a caller is accepted: 1 to 128 letters, digits or
+// -_.:+/= characters, so that it cannot forge log records or headers.
+func ValidRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range requestID {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("-_.:+/=", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// NewRequestID generates a request ID.
+func NewRequestID() string {
+	return uuid.New().String()
+}
+
+// RequestID is a middleware that adds the request ID to each request context and to the response. The ID sent
+// by the caller in X-Request-ID is kept when it is valid, otherwise a new one is generated.
 func RequestID(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		requestID := uuid.New().String()
-		ctx := context.WithValue(r.Context(), requestIDKey, requestID)
-		w.Header().Set("X-Request-ID", requestID)
-		next.ServeHTTP(w, r.WithContext(ctx))
+		requestID := r.Header.Get(RequestIDHeader)
+		if !ValidRequestID(requestID) {
+			if requestID != "" {
+				LoggerFromContext(r.Context()).Debug("", "Ignored invalid %s header from %s", RequestIDHeader, ClientIP(r))
+			}
+			requestID = NewRequestID()
+		}
+		w.Header().Set(RequestIDHeader, requestID)
+		next.ServeHTTP(w, r.WithContext(ContextWithRequestID(r.Context(), requestID)))
 	})
 }
 
-// GetRequestIDFromContext retrieves the request ID from the context.
+// ContextWithRequestID returns a copy of the context carrying the request ID, logged by the operations run
+// on behalf of the request.
+func ContextWithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey, requestID)
+}
+
+// GetRequestIDFromContext retrieves the request ID from the context, empty when there is none, e.g. for the
+// operations run in the background.
 func GetRequestIDFromContext(ctx context.Context) string {
-	requestID, ok := ctx.Value(requestIDKey).(string)
-	if !ok {
-		return "unknown"
-	}
+	requestID, _ := ctx.Value(requestIDKey).(string)
 	return requestID
 }
 
-// Example of how you might initialize the logger
-var logger *Logger
-
-// InitLogger initializes the global logger instance.
-func InitLogger(logLevel string) {
-	logger = NewLogger(logLevel)
+// ContextWithLogger returns a copy of the context carrying the logger.
+func ContextWithLogger(ctx context.Context, logger *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, logger)
 }
 
-// GetLogger retrieves the global logger instance.
-func GetLogger() *Logger {
+// LoggerFromContext retrieves the logger of the server handling a request, nil when there is none.
+func LoggerFromContext(ctx context.Context) *Logger {
+	logger, _ := ctx.Value(loggerKey).(*Logger)
 	return logger
 }
+
+// UseLogger is a middleware that attaches the logger to the request context, for the middleware and handlers
+// that follow it.
+func UseLogger(logger *Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(ContextWithLogger(r.Context(), logger)))
+		})
+	}
+}
@@ -1,7 +1,12 @@
 package middleware
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net"
+	"net/http"
+	"net/netip"
 	"net/url"
 	"regexp"
 	"strconv"
@@ -68,3 +73,215 @@ func GetURLFromHostPort(host string, port int32) string {
 
 	return url
 }
+
+// GetIPFromRemoteAddr extracts the IP from a request remote address formatted as ip:port, or [ipv6]:port
+func GetIPFromRemoteAddr(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		// No port
+		return strings.TrimSuffix(strings.TrimPrefix(remoteAddr, "["), "]")
+	}
+	return host
+}
+
+// TrustedNetworks are the networks trusted by a server. A nil TrustedNetworks trusts no network.
+type TrustedNetworks struct {
+	proxies []netip.Prefix // Peers whose X-Forwarded-For and Forwarded headers are honored
+	sources []netip.Prefix // Clients allowed to register workers at another address than their own
+}
+
+// NewTrustedNetworks creates the trusted proxies and sources from lists of CIDR blocks or IP addresses.
+func NewTrustedNetworks(proxies []string, sources []string) (*TrustedNetworks, error) {
+	p, err := parsePrefixes(proxies)
+	if err != nil {
+		return nil, fmt.Errorf("trusted_proxies: %w", err)
+	}
+	s, err := parsePrefixes(sources)
+	if err != nil {
+		return nil, fmt.Errorf("trusted_sources: %w", err)
+	}
+	return &TrustedNetworks{proxies: p, sources: s}, nil
+}
+
+// ContextWithTrustedNetworks returns a copy of the context carrying the trusted networks.
+func ContextWithTrustedNetworks(ctx context.Context, networks *TrustedNetworks) context.Context {
+	return context.WithValue(ctx, trustedNetworksKey, networks)
+}
+
+// TrustedNetworksFromContext retrieves the networks trusted by the server handling a request, nil when there are none.
+func TrustedNetworksFromContext(ctx context.Context) *TrustedNetworks {
+	networks, _ := ctx.Value(trustedNetworksKey).(*TrustedNetworks)
+	return networks
+}
+
+// UseTrustedNetworks is a middleware that attaches the trusted networks to the request context, for ClientIP
+// and RequestWorkerHost.
+func UseTrustedNetworks(networks *TrustedNetworks) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(ContextWithTrustedNetworks(r.Context(), networks)))
+		})
+	}
+}
+
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		if strings.Contains(value, "/") {
+			prefix, err := netip.ParsePrefix(value)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return nil, err
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+func contains(prefixes []netip.Prefix, ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap().WithZone("")
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsTrustedSource reports whether the client may register workers at another address than its own.
+func (n *TrustedNetworks) IsTrustedSource(ip string) bool {
+	return n != nil && contains(n.sources, ip)
+}
+
+// isTrustedProxy reports whether the forwarding headers sent by the peer are honored.
+func (n *TrustedNetworks) isTrustedProxy(ip string) bool {
+	return n != nil && contains(n.proxies, ip)
+}
+
+var (
+	ErrInvalidHost   = errors.New("the worker host must be an IP address or a hostname")
+	ErrUntrustedHost = errors.New("only trusted sources may register a worker at another address than their own")
+)
+
+// IsValidHost reports whether host is an IP address or a hostname made of RFC 1123 labels.
+func IsValidHost(host string) bool {
+	if _, err := netip.ParseAddr(host); err == nil {
+		return true
+	}
+	return isValidHostname(host)
+}
+
+func isValidHostname(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// WorkerHost returns the host to register for a worker on behalf of the client at clientIP: the requested host,
+// accepted when it is the address of the client or when the client is a trusted source, or the address of the
+// client when no host is requested. Hostnames are never the address of the client: only trusted sources may
+// register them.
+func (n *TrustedNetworks) WorkerHost(clientIP string, requested string) (string, error) {
+	if requested == "" {
+		return clientIP, nil
+	}
+	addr, err := netip.ParseAddr(requested)
+	if err != nil {
+		if !isValidHostname(requested) {
+			return "", ErrInvalidHost
+		}
+		if !n.IsTrustedSource(clientIP) {
+			return "", ErrUntrustedHost
+		}
+		return strings.ToLower(strings.TrimSuffix(requested, ".")), nil
+	}
+	client, err := netip.ParseAddr(clientIP)
+	if (err != nil || addr.Unmap() != client.Unmap()) && !n.IsTrustedSource(clientIP) {
+		return "", ErrUntrustedHost
+	}
+	return addr.Unmap().String(), nil
+}
+
+// RequestWorkerHost returns the host to register for a worker on behalf of the client of a request, with the
+// networks trusted by the server, see WorkerHost.
+func RequestWorkerHost(r *http.Request, requested string) (string, error) {
+	return TrustedNetworksFromContext(r.Context()).WorkerHost(ClientIP(r), requested)
+}
+
+// ClientIP returns the IP address of the client of a request, with the networks trusted by the server.
+func ClientIP(r *http.Request) string {
+	return TrustedNetworksFromContext(r.Context()).ClientIP(r)
+}
+
+// ClientIP returns the IP address of the client of a request. The forwarding headers are only honored when the
+// request comes from a trusted proxy: the Forwarded header (RFC 7239), or else X-Forwarded-For, is read from the
+// right, skipping the trusted proxies, and the first other address is the client.
+func (n *TrustedNetworks) ClientIP(r *http.Request) string {
+	ip := GetIPFromRemoteAddr(r.RemoteAddr)
+	if !n.isTrustedProxy(ip) {
+		return ip
+	}
+
+	var hops []string
+	if values := r.Header.Values("Forwarded"); len(values) > 0 {
+		hops = forwardedFor(values)
+	} else {
+		for _, value := range r.Header.Values("X-Forwarded-For") {
+			for _, hop := range strings.Split(value, ",") {
+				hops = append(hops, strings.TrimSpace(hop))
+			}
+		}
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := GetIPFromRemoteAddr(hops[i])
+		if _, err := netip.ParseAddr(hop); err != nil {
+			// Obfuscated or invalid address: the chain cannot be trusted further
+			break
+		}
+		ip = hop
+		if !n.isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// forwardedFor returns the for parameters of Forwarded header values, e.g. for=192.0.2.60;proto=http, for="[2001:db8::1]:4711".
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				name, v, found := strings.Cut(strings.TrimSpace(pair), "=")
+				if found && strings.EqualFold(name, "for") {
+					hops = append(hops, strings.Trim(v, `"`))
+				}
+			}
+		}
+	}
+	return hops
+}
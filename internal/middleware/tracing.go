@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"net/http"
+
+	"registry-service/internal/observability"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracing is a middleware that runs each request in a server span, named after the method and the route template
+// of the request, or the method only when it matches no route. The span continues the trace of the caller when
+// the request has a W3C traceparent header. It must follow RequestID, whose ID is added to the span.
+func Tracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.Method
+		attributes := []attribute.KeyValue{
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.path", r.URL.Path),
+			attribute.String("client.address", ClientIP(r)),
+			observability.AttrRequestID.String(GetRequestIDFromContext(r.Context())),
+		}
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				name += " " + template
+				attributes = append(attributes, attribute.String("http.route", template))
+			}
+		}
+
+		ctx := observability.ExtractTraceContext(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := observability.StartSpan(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attributes...),
+		)
+		defer span.End()
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.response.status_code", recorder.status))
+		if recorder.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+	})
+}
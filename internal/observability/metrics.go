@@ -1,13 +1,14 @@
 package observability
 
 import (
-	"fmt"
-	"log"
+	"context"
 	"net/http"
-	"registry-service/internal/middleware"
-	"sync"
+	"strconv"
+	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
@@ -18,7 +19,7 @@ var (
 			Name: "http_requests_total",
 			Help: "Total number of HTTP requests.",
 		},
-		[]string{"method", "endpoint", "status"},
+		[]string{"registry", "method", "endpoint", "status"},
 	)
 
 	httpRequestDuration = prometheus.NewHistogramVec(
@@ -27,7 +28,49 @@ var (
 			Help:    "Duration of HTTP requests in seconds.",
 			Buckets: prometheus.DefBuckets,
 		},
-		[]string{"method", "endpoint", "status"},
+		[]string{"registry", "method", "endpoint", "status"},
+	)
+
+	httpRequestsInFlight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "http_requests_in_flight",
+			Help: "Number of HTTP requests being served.",
+		},
+		[]string{"registry"},
+	)
+
+	httpResponseSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "http_response_size_bytes",
+			Help:    "Size of the HTTP response bodies in bytes.",
+			Buckets: prometheus.ExponentialBuckets(64, 4, 8), // 64 B to 1 MiB
+		},
+		[]string{"registry", "method", "endpoint", "status"},
+	)
+
+	grpcRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "grpc_requests_total",
+			Help: "Total number of gRPC requests.",
+		},
+		[]string{"registry", "method", "code"},
+	)
+
+	grpcRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "grpc_request_duration_seconds",
+			Help:    "Duration of gRPC requests in seconds. Streams are measured until they end.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"registry", "method", "code"},
+	)
+
+	throttledRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "throttled_requests_total",
+			Help: "Total number of requests rejected by a rate limit.",
+		},
+		[]string{"registry", "limit", "route"},
 	)
 
 	workerHealthStatus = prometheus.NewGaugeVec(
@@ -35,65 +78,343 @@ var (
 			Name: "worker_health_status",
 			Help: "Health status of workers (1 for healthy, 0 for unhealthy).",
 		},
-		[]string{"id", "address"},
+		[]string{"registry", "id", "address"},
 	)
+
+	probeDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "health_probe_duration_seconds",
+			Help:    "Duration of the health probes of each worker in seconds, failed probes included.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"registry", "worker"},
+	)
+
+	probeFailuresTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "health_probe_failures_total",
+			Help: "Total number of failed health probes by worker and reason: timeout, refused, non_200 or error.",
+		},
+		[]string{"registry", "worker", "reason"},
+	)
+
+	checkCycleDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "health_check_cycle_duration_seconds",
+			Help:    "Duration of the health check cycles, checking every worker, in seconds.",
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+		},
+		[]string{"registry"},
+	)
+
+	checkCycleOverlapsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "health_check_cycle_overlaps_total",
+			Help: "Total number of health check cycles that lasted longer than the check interval, delaying the next cycle.",
+		},
+		[]string{"registry"},
+	)
+
+	registryWorkers = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "registry_workers",
+			Help: "Number of registered workers by service and state (healthy or unhealthy).",
+		},
+		[]string{"registry", "service", "state"},
+	)
+
+	registrationsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "worker_registrations_total",
+			Help: "Total number of worker registrations by outcome: created, refreshed or rejected.",
+		},
+		[]string{"registry", "outcome"},
+	)
+
+	evictionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "worker_evictions_total",
+			Help: "Total number of workers evicted after failing their health checks.",
+		},
+		[]string{"registry"},
+	)
+
+	storageOperationDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "storage_operation_duration_seconds",
+			Help:    "Duration of the database operations in seconds.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"registry", "operation"},
+	)
+
+	storageErrorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "storage_operation_errors_total",
+			Help: "Total number of failed database operations.",
+		},
+		[]string{"registry", "operation"},
+	)
+)
+
+// Reasons of the failures of the health probes.
+const (
+	ProbeTimeout = "timeout"
+	ProbeRefused = "refused"
+	ProbeNon200  = "non_200"
+	ProbeError   = "error" // Any other failure, e.g. a TLS handshake or a reset connection
 )
 
+// Outcomes of the registrations.
+const (
+	RegistrationCreated   = "created"
+	RegistrationRefreshed = "refreshed"
+	RegistrationRejected  = "rejected"
+)
+
+// WorkerCount is the number of workers of a service in a state, healthy or not.
+type WorkerCount struct {
+	Service string
+	Healthy bool
+	Count   int
+}
+
+// metricsRegistry holds the metrics of the registry service. It is not the default registry of the prometheus
+// package, so that the metrics of a process embedding the service do not collide with them.
+var metricsRegistry = prometheus.NewRegistry()
+
 func init() {
 	// Register Prometheus metrics
-	prometheus.MustRegister(httpRequestsTotal)
-	prometheus.MustRegister(httpRequestDuration)
-	prometheus.MustRegister(workerHealthStatus)
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequestsTotal,
+		httpRequestDuration,
+		httpRequestsInFlight,
+		httpResponseSize,
+		grpcRequestsTotal,
+		grpcRequestDuration,
+		throttledRequestsTotal,
+		workerHealthStatus,
+		probeDuration,
+		probeFailuresTotal,
+		checkCycleDuration,
+		checkCycleOverlapsTotal,
+		registryWorkers,
+		registrationsTotal,
+		evictionsTotal,
+		storageOperationDuration,
+		storageErrorsTotal,
+	)
+}
+
+// Gatherer returns the metrics of the registry service, e.g. for a process embedding the service to expose them
+// with its own.
+func Gatherer() prometheus.Gatherer {
+	return metricsRegistry
 }
 
-// MetricsMiddleware is a middleware to collect metrics for each HTTP request
-func MetricsMiddleware(next http.Handler) http.Handler {
+// MetricsHandler returns the handler exposing the metrics of the registry service in the Prometheus format.
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// UnmatchedEndpoint labels the requests matching no route, answered 404 or 405, so that the paths probed by
+// scanners do not create series.
+const UnmatchedEndpoint = "unmatched"
+
+// Middleware is a middleware to collect metrics for each HTTP request. The requests are labeled with the path
+// template of their route, e.g. /v1/workers/{id}, so that the number of series does not grow with the IDs, and with
+// the status of the response. The metrics are attached to the request context for the middlewares that follow,
+// see MetricsFromContext.
+func (m *RegistryMetrics) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Start timer
-		timer := prometheus.NewTimer(httpRequestDuration.WithLabelValues(r.Method, r.URL.Path, "200"))
-		defer timer.ObserveDuration()
+		start := time.Now()
+		inFlight := httpRequestsInFlight.WithLabelValues(m.name)
+		inFlight.Inc()
+		defer inFlight.Dec()
 
-		// Capture status code
+		// Capture status code and size
 		ww := &statusWriter{ResponseWriter: w}
-		next.ServeHTTP(ww, r)
+		next.ServeHTTP(ww, r.WithContext(WithMetrics(r.Context(), m)))
 
-		// Update Prometheus counters
-		httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, fmt.Sprint(ww.status)).Inc()
+		endpoint := UnmatchedEndpoint
+		if route := mux.CurrentRoute(r); route != nil {
+			if template, err := route.GetPathTemplate(); err == nil {
+				endpoint = template
+			}
+		}
+		status := strconv.Itoa(ww.Status())
+
+		// Update Prometheus metrics
+		httpRequestsTotal.WithLabelValues(m.name, r.Method, endpoint, status).Inc()
+		httpRequestDuration.WithLabelValues(m.name, r.Method, endpoint, status).Observe(time.Since(start).Seconds())
+		httpResponseSize.WithLabelValues(m.name, r.Method, endpoint, status).Observe(float64(ww.size))
 	})
 }
 
-// statusWriter captures the HTTP status code for Prometheus metrics
+// statusWriter captures the HTTP status code and the size of the response for Prometheus metrics
 type statusWriter struct {
 	http.ResponseWriter
 	status int
+	size   int64
 }
 
 func (w *statusWriter) WriteHeader(statusCode int) {
-	w.status = statusCode
+	// Only the first call sets the status, like for the underlying writer. Informational responses precede it.
+	if w.status == 0 && statusCode >= http.StatusOK {
+		w.status = statusCode
+	}
 	w.ResponseWriter.WriteHeader(statusCode)
 }
 
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK // Written implicitly by the underlying writer
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+// Status returns the status of the response: 200 when the handler wrote nothing or only a body.
+func (w *statusWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// Unwrap returns the underlying writer, so that http.ResponseController can flush it.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// RecordGRPCRequest records the outcome of a gRPC request
+func (m *RegistryMetrics) RecordGRPCRequest(method string, code string, duration time.Duration) {
+	grpcRequestsTotal.WithLabelValues(m.name, method, code).Inc()
+	grpcRequestDuration.WithLabelValues(m.name, method, code).Observe(duration.Seconds())
+}
+
+// RecordThrottledRequest records a request on route rejected by the limit: ip, key or route
+func (m *RegistryMetrics) RecordThrottledRequest(limit string, route string) {
+	throttledRequestsTotal.WithLabelValues(m.name, limit, route).Inc()
+}
+
+// RegistryMetrics records the metrics of one registry: its workers, and the requests of its servers and database.
+// Its series carry the name of the registry in the registry label, so that the registries of one process never
+// mix, remove or overwrite the series of the others.
+type RegistryMetrics struct {
+	name string
+}
+
+// NewRegistryMetrics returns the recorder of the metrics of the registry with the given name.
+func NewRegistryMetrics(name string) *RegistryMetrics {
+	return &RegistryMetrics{name: name}
+}
+
+// Key type is unexported to prevent collisions with context keys in other packages.
+type metricsKey int
+
+// metricsContextKey is the key for metrics values in context.
+const metricsContextKey metricsKey = 0
+
+// unnamedMetrics records the requests handled outside of the middleware of a registry.
+var unnamedMetrics = NewRegistryMetrics("")
+
+// WithMetrics returns a copy of ctx carrying the metrics.
+func WithMetrics(ctx context.Context, metrics *RegistryMetrics) context.Context {
+	return context.WithValue(ctx, metricsContextKey, metrics)
+}
+
+// MetricsFromContext retrieves the metrics from the context, or the metrics with an empty registry label.
+func MetricsFromContext(ctx context.Context) *RegistryMetrics {
+	if metrics, ok := ctx.Value(metricsContextKey).(*RegistryMetrics); ok {
+		return metrics
+	}
+	return unnamedMetrics
+}
+
 // RecordWorkerHealth updates the worker health metric
-func RecordWorkerHealth(id string, address string, isHealthy bool) {
+func (m *RegistryMetrics) RecordWorkerHealth(id string, address string, isHealthy bool) {
 	value := 0.0
 	if isHealthy {
 		value = 1.0
 	}
-	middleware.GetLogger().Debug("", "Metrics - Recording health for worker ID %s (%s): %f\n", id, address, value)
-	workerHealthStatus.WithLabelValues(id, address).Set(value)
+	workerHealthStatus.WithLabelValues(m.name, id, address).Set(value)
+}
+
+// WorkerHealth is the health of a worker at its address, reported by worker_health_status.
+type WorkerHealth struct {
+	ID      string
+	Address string
+	Healthy bool
+}
+
+// ResetWorkerHealth replaces the health statuses of the registry by the ones of the workers, removing the series
+// of its other workers, e.g. to reconcile the metrics with the workers loaded from the database
+func (m *RegistryMetrics) ResetWorkerHealth(workers []WorkerHealth) {
+	workerHealthStatus.DeletePartialMatch(prometheus.Labels{"registry": m.name})
+	for _, worker := range workers {
+		m.RecordWorkerHealth(worker.ID, worker.Address, worker.Healthy)
+	}
+}
+
+// ForgetWorkerAddress removes the health status of the worker at a previous address
+func (m *RegistryMetrics) ForgetWorkerAddress(id string, address string) {
+	workerHealthStatus.DeleteLabelValues(m.name, id, address)
 }
 
-var metricsOnce sync.Once
+// ForgetWorker removes the series of a worker that left the registry: its health status, and the durations and
+// failures of its probes
+func (m *RegistryMetrics) ForgetWorker(id string) {
+	workerHealthStatus.DeletePartialMatch(prometheus.Labels{"registry": m.name, "id": id})
+	probeDuration.DeletePartialMatch(prometheus.Labels{"registry": m.name, "worker": id})
+	probeFailuresTotal.DeletePartialMatch(prometheus.Labels{"registry": m.name, "worker": id})
+}
+
+// RecordProbe records a health probe of the worker, failed for reason unless reason is empty
+func (m *RegistryMetrics) RecordProbe(worker string, duration time.Duration, reason string) {
+	probeDuration.WithLabelValues(m.name, worker).Observe(duration.Seconds())
+	if reason != "" {
+		probeFailuresTotal.WithLabelValues(m.name, worker, reason).Inc()
+	}
+}
 
-// ServeMetrics starts an HTTP server that exposes the Prometheus metrics endpoint
-func ServeMetrics(addr string) {
-	metricsOnce.Do(func() {
-		http.Handle("/metrics", promhttp.Handler()) // Expose the /metrics endpoint for Prometheus
-		middleware.GetLogger().Info("", "Starting registry metrics server on %s\n", addr)
+// RecordCheckCycle records a health check cycle, which overlaps the next one when it lasted longer than interval
+func (m *RegistryMetrics) RecordCheckCycle(duration time.Duration, interval time.Duration) {
+	checkCycleDuration.WithLabelValues(m.name).Observe(duration.Seconds())
+	if interval > 0 && duration > interval {
+		checkCycleOverlapsTotal.WithLabelValues(m.name).Inc()
+	}
+}
 
-		// Start the HTTP server to expose metrics
-		if err := http.ListenAndServe(addr, nil); err != nil {
-			log.Fatalf("Error starting metrics server: %v", err)
+// RecordRegistrySize replaces the numbers of registered workers of the registry
+func (m *RegistryMetrics) RecordRegistrySize(counts []WorkerCount) {
+	registryWorkers.DeletePartialMatch(prometheus.Labels{"registry": m.name})
+	for _, c := range counts {
+		state := "unhealthy"
+		if c.Healthy {
+			state = "healthy"
 		}
-	})
+		registryWorkers.WithLabelValues(m.name, c.Service, state).Set(float64(c.Count))
+	}
+}
+
+// RecordRegistration records a registration with its outcome: created, refreshed or rejected
+func (m *RegistryMetrics) RecordRegistration(outcome string) {
+	registrationsTotal.WithLabelValues(m.name, outcome).Inc()
+}
+
+// RecordEviction records the eviction of a worker failing its health checks
+func (m *RegistryMetrics) RecordEviction() {
+	evictionsTotal.WithLabelValues(m.name).Inc()
+}
+
+// RecordStorageOperation records a database operation, failed when err is not nil
+func (m *RegistryMetrics) RecordStorageOperation(operation string, duration time.Duration, err error) {
+	storageOperationDuration.WithLabelValues(m.name, operation).Observe(duration.Seconds())
+	if err != nil {
+		storageErrorsTotal.WithLabelValues(m.name, operation).Inc()
+	}
 }
@@ -0,0 +1,130 @@
+package observability
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"registry-service/internal/config"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName is the instrumentation scope of the spans of the registry service.
+const TracerName = "registry-service"
+
+// Attributes of the spans specific to the registry.
+const (
+	AttrWorkerID  = attribute.Key("registry.worker.id")
+	AttrRequestID = attribute.Key("registry.request.id")
+)
+
+// propagator reads and writes the span contexts in the W3C traceparent and tracestate headers. It does not
+// depend on the global propagator, so that the traces are propagated whatever the embedding process installed.
+var propagator = propagation.TraceContext{}
+
+// NewTracerProvider creates a tracer provider exporting the spans as configured: to an OTLP/HTTP collector, or
+// as JSON lines to output (the standard output when nil) for the stdout exporter. It returns nil when tracing
+// is disabled.
+func NewTracerProvider(cfg config.TracingConfig, output io.Writer) (*sdktrace.TracerProvider, error) {
+	var processor sdktrace.SpanProcessor
+	switch cfg.Exporter {
+	case "", "none":
+		return nil, nil
+	case "otlp":
+		opts := []otlptracehttp.Option{}
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err := otlptracehttp.New(context.Background(), opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the OTLP exporter: %w", err)
+		}
+		processor = sdktrace.NewBatchSpanProcessor(exporter)
+	case "stdout":
+		if output == nil {
+			output = os.Stdout
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(output))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the stdout exporter: %w", err)
+		}
+		// The spans are written as soon as they end, so that tests can read them
+		processor = sdktrace.NewSimpleSpanProcessor(exporter)
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q, expected none, otlp or stdout", cfg.Exporter)
+	}
+
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = TracerName
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(serviceName)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe the service: %w", err)
+	}
+
+	ratio := cfg.SampleRatio
+	if ratio == 0 {
+		ratio = 1
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithResource(res),
+		sdktrace.WithSpanProcessor(processor),
+		// The decision of the caller is followed for the traces it started
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	), nil
+}
+
+// SetupTracing installs the tracer provider configured by cfg as the global provider of OpenTelemetry, used by
+// the spans of the registry. It returns a function flushing and stopping the exporter, to call on shutdown.
+// Nothing is installed when tracing is disabled, so that the provider of an embedding process is kept.
+func SetupTracing(cfg config.TracingConfig) (func(context.Context) error, error) {
+	provider, err := NewTracerProvider(cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+	if provider == nil {
+		return func(context.Context) error { return nil }, nil
+	}
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// StartSpan starts a span of the registry service, child of the span of ctx if any.
+func StartSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(TracerName).Start(ctx, name, opts...)
+}
+
+// EndSpan records the error, if any, on the span and ends it.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// ExtractTraceContext returns a copy of the context carrying the span context sent by a caller in the traceparent
+// and tracestate fields of carrier, e.g. propagation.HeaderCarrier of the request headers.
+func ExtractTraceContext(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	return propagator.Extract(ctx, carrier)
+}
+
+// InjectTraceContext writes the span context of ctx in the traceparent and tracestate fields of carrier.
+func InjectTraceContext(ctx context.Context, carrier propagation.TextMapCarrier) {
+	propagator.Inject(ctx, carrier)
+}
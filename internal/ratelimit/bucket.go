@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is the interval at which the buckets back to full capacity are forgotten.
+const sweepInterval = time.Minute
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// limit is a set of token buckets, one per key, refilled with rate tokens per second and holding up to burst tokens.
+type limit struct {
+	rate  float64
+	burst float64
+
+	mutex   sync.Mutex
+	buckets map[string]*bucket
+	sweptAt time.Time
+}
+
+func newLimit(rate float64, burst int) *limit {
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	return &limit{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket)}
+}
+
+// take takes a token from the bucket of key. When the bucket is empty, it returns false and the time until
+// a token is available.
+func (l *limit) take(key string, now time.Time) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if now.Sub(l.sweptAt) >= sweepInterval {
+		l.sweep(now)
+	}
+
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &bucket{tokens: l.burst, updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.updated = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// refill returns the tokens of the bucket at now. Must be called with the mutex held.
+func (l *limit) refill(b *bucket, now time.Time) float64 {
+	return math.Min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+}
+
+// sweep forgets the buckets back to full capacity, which behave like new ones. Must be called with the mutex held.
+func (l *limit) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if l.refill(b, now) >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.sweptAt = now
+}
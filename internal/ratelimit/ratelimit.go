@@ -0,0 +1,173 @@
+// Package ratelimit limits the rate of the API requests with token buckets per client address, per credential
+// and per route, so that a misbehaving client cannot overload the registry and its database.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"registry-service/internal/auth"
+	"registry-service/internal/config"
+	"registry-service/internal/middleware"
+	"registry-service/internal/observability"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Names of the limits, reported in the metrics
+const (
+	LimitIP    = "ip"
+	LimitKey   = "key"
+	LimitRoute = "route"
+)
+
+// Limiter holds the token buckets of the configured limits. Limits that are not configured are disabled.
+type Limiter struct {
+	perIP  *limit
+	perKey *limit
+	routes map[string]*limit // Keyed by "METHOD /path/{template}" or "/path/{template}"
+}
+
+// NewLimiter creates a limiter from the configuration.
+func NewLimiter(cfg config.RateLimitConfig) (*Limiter, error) {
+	l := &Limiter{routes: make(map[string]*limit)}
+
+	var err error
+	if l.perIP, err = newConfiguredLimit("per_ip", cfg.PerIP); err != nil {
+		return nil, err
+	}
+	if l.perKey, err = newConfiguredLimit("per_key", cfg.PerKey); err != nil {
+		return nil, err
+	}
+	for route, rate := range cfg.Routes {
+		path := route
+		if method, rest, found := strings.Cut(route, " "); found {
+			if method == "" || strings.ToUpper(method) != method {
+				return nil, fmt.Errorf("ratelimit: route %q: the method must be upper case", route)
+			}
+			path = rest
+		}
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("ratelimit: route %q: the path must start with /", route)
+		}
+		routeLimit, err := newConfiguredLimit("route "+route, rate)
+		if err != nil {
+			return nil, err
+		}
+		if routeLimit != nil {
+			l.routes[route] = routeLimit
+		}
+	}
+	return l, nil
+}
+
+// newConfiguredLimit returns the limit of the configuration, nil when it is disabled.
+func newConfiguredLimit(name string, cfg config.RateConfig) (*limit, error) {
+	if cfg.Rate < 0 || cfg.Burst < 0 {
+		return nil, fmt.Errorf("ratelimit: %s: rate and burst must not be negative", name)
+	}
+	if cfg.Rate == 0 {
+		return nil, nil
+	}
+	return newLimit(cfg.Rate, cfg.Burst), nil
+}
+
+// Enabled reports whether at least one limit is configured. A nil Limiter limits nothing.
+func (l *Limiter) Enabled() bool {
+	return l != nil && (l.perIP != nil || l.perKey != nil || len(l.routes) > 0)
+}
+
+// AllowIP takes a token from the bucket of the client address. When the request is rejected,
+// it returns the time until the client may retry.
+func (l *Limiter) AllowIP(ip string) (bool, time.Duration) {
+	if l.perIP == nil {
+		return true, 0
+	}
+	return l.perIP.take(ip, time.Now())
+}
+
+// AllowIdentity takes a token from the buckets of the credential: the per_key bucket, then the bucket of the route,
+// identified by its method and path template. When the request is rejected, it returns the time until the client
+// may retry and the name of the limit.
+func (l *Limiter) AllowIdentity(identity *auth.Identity, method string, route string) (bool, time.Duration, string) {
+	now := time.Now()
+	key := identity.Method + ":" + identity.Name
+
+	if l.perKey != nil {
+		if ok, retryAfter := l.perKey.take(key, now); !ok {
+			return false, retryAfter, LimitKey
+		}
+	}
+
+	name := method + " " + route
+	routeLimit, found := l.routes[name]
+	if !found {
+		name = route
+		routeLimit, found = l.routes[name]
+	}
+	if found {
+		if ok, retryAfter := routeLimit.take(name+"|"+key, now); !ok {
+			return false, retryAfter, LimitRoute
+		}
+	}
+	return true, 0, ""
+}
+
+// RetryAfter formats a delay as the value of a Retry-After header, in whole seconds rounded up.
+func RetryAfter(delay time.Duration) string {
+	return strconv.Itoa(int(math.Max(1, math.Ceil(delay.Seconds()))))
+}
+
+// routeTemplate returns the path template of the route matching the request, or the label of the unmatched
+// requests, so that the paths probed by scanners do not create series.
+func routeTemplate(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return observability.UnmatchedEndpoint
+}
+
+// reject answers 429 Too Many Requests with the delay after which the client may retry.
+func reject(w http.ResponseWriter, r *http.Request, name string, route string, retryAfter time.Duration) {
+	middleware.LoggerFromContext(r.Context()).Info(middleware.GetRequestIDFromContext(r.Context()), "Rate limit %s exceeded by %s on %s %s", name, middleware.ClientIP(r), r.Method, route)
+	observability.MetricsFromContext(r.Context()).RecordThrottledRequest(name, route)
+
+	w.Header().Set("Retry-After", RetryAfter(retryAfter))
+	middleware.WriteError(w, r, http.StatusTooManyRequests, middleware.ErrCodeRateLimited, "Too many requests, retry later")
+}
+
+// ClientIPMiddleware rejects the requests of the clients exceeding the per_ip limit. It runs before the
+// authentication, so that the requests with invalid credentials are limited too.
+func (l *Limiter) ClientIPMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.Enabled() {
+			if ok, retryAfter := l.AllowIP(middleware.ClientIP(r)); !ok {
+				reject(w, r, LimitIP, routeTemplate(r), retryAfter)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// IdentityMiddleware rejects the requests of the credentials exceeding the per_key limit or the limit of the route.
+// It runs after the authentication.
+func (l *Limiter) IdentityMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.Enabled() {
+			if identity, ok := auth.IdentityFromContext(r.Context()); ok {
+				route := routeTemplate(r)
+				if ok, retryAfter, name := l.AllowIdentity(identity, r.Method, route); !ok {
+					reject(w, r, name, route, retryAfter)
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
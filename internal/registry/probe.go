@@ -0,0 +1,168 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"registry-service/internal/config"
+	"registry-service/internal/middleware"
+	"registry-service/internal/observability"
+	"registry-service/internal/tlsutil"
+	"strconv"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultProbePath    = "/healthcheck"
+	defaultProbeTimeout = 5 * time.Second
+	defaultProbeHeader  = "X-API-Key"
+)
+
+// dialAddressKey is the context key of the address a health check must connect to, instead of resolving the
+// hostname of its URL.
+type dialAddressKey struct{}
+
+// prober runs the health checks of the workers.
+type prober struct {
+	client     *http.Client
+	scheme     string
+	path       string
+	header     string
+	credential string
+	logger     *middleware.Logger
+}
+
+// newProber creates a prober from the configuration. Over https, the worker certificates are verified with the
+// CA bundle and the client certificate, if any, is presented to the workers.
+func newProber(cfg config.ProbeConfig, logger *middleware.Logger) (*prober, error) {
+	// Each address of a worker is checked on its own connection: connections are not reused since the pool
+	// of the transport is keyed by hostname and not by address. Proxies are not used for workers.
+	dialer := &net.Dialer{Timeout: defaultProbeTimeout}
+	transport := &http.Transport{
+		DisableKeepAlives: true,
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			if address, ok := ctx.Value(dialAddressKey{}).(string); ok {
+				if _, port, err := net.SplitHostPort(addr); err == nil {
+					addr = net.JoinHostPort(address, port)
+				}
+			}
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+
+	p := &prober{
+		client:     &http.Client{Timeout: defaultProbeTimeout, Transport: transport},
+		scheme:     "http",
+		path:       defaultProbePath,
+		header:     defaultProbeHeader,
+		credential: cfg.Credential,
+		logger:     logger,
+	}
+	if cfg.TimeoutMs > 0 {
+		p.client.Timeout = time.Duration(cfg.TimeoutMs) * time.Millisecond
+	}
+	if cfg.Path != "" {
+		p.path = cfg.Path
+	}
+	if cfg.Header != "" {
+		p.header = cfg.Header
+	}
+
+	switch cfg.Scheme {
+	case "", "http":
+	case "https":
+		tlsConfig, err := tlsutil.NewClientConfig(cfg.CAFile, cfg.CertFile, cfg.KeyFile, cfg.ServerName, logger)
+		if err != nil {
+			return nil, fmt.Errorf("probe: %w", err)
+		}
+		p.scheme = "https"
+		transport.TLSClientConfig = tlsConfig
+	default:
+		return nil, fmt.Errorf("probe: unknown scheme %q", cfg.Scheme)
+	}
+	return p, nil
+}
+
+// url returns the health check URL of a worker.
+func (p *prober) url(host string, port int32) string {
+	return p.scheme + "://" + net.JoinHostPort(host, strconv.Itoa(int(port))) + p.path
+}
+
+// check runs a health check of the worker at url. When address is set, the check connects to it instead of the
+// host of the URL, which is still used for the Host header and the verification of the worker certificate.
+// The request ID of the context is sent in the X-Request-ID header, and its span in the traceparent header.
+// It returns the reason of the failure of the check, empty when the worker is healthy.
+func (p *prober) check(ctx context.Context, url string, address string) string {
+	logger := p.logger
+	probeID := middleware.GetRequestIDFromContext(ctx)
+
+	ctx, span := observability.StartSpan(ctx, "probe GET",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", "GET"),
+			attribute.String("url.full", url),
+			attribute.String("network.peer.address", address),
+		),
+	)
+	defer span.End()
+
+	if address != "" {
+		ctx = context.WithValue(ctx, dialAddressKey{}, address)
+	}
+
+	// Create a new GET request
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		logger.Debug(probeID, "Failed to create request GET %s : %s", url, err)
+		span.SetStatus(codes.Error, err.Error())
+		return observability.ProbeError
+	}
+
+	observability.InjectTraceContext(ctx, propagation.HeaderCarrier(req.Header))
+	if probeID != "" {
+		req.Header.Set(middleware.RequestIDHeader, probeID)
+	}
+
+	// Authenticate with the probe credential, never with the keys of the registry
+	if p.credential != "" {
+		req.Header.Set(p.header, p.credential)
+	}
+
+	// Send the request
+	resp, err := p.client.Do(req)
+	if err != nil {
+		logger.Debug(probeID, "Failed to create request GET %s : %s", url, err)
+		span.SetStatus(codes.Error, err.Error())
+		return failureReason(err)
+	}
+	defer resp.Body.Close()
+
+	// Compute health result
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode != http.StatusOK {
+		span.SetStatus(codes.Error, resp.Status)
+		return observability.ProbeNon200
+	}
+	return ""
+}
+
+// failureReason classifies the error of a health check request.
+func failureReason(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return observability.ProbeTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return observability.ProbeRefused
+	default:
+		return observability.ProbeError
+	}
+}
@@ -1,44 +1,111 @@
 package registry
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"net"
-	"net/http"
+	"registry-service/internal/auth"
 	"registry-service/internal/config"
 	"registry-service/internal/database"
 	"registry-service/internal/middleware"
 	"registry-service/internal/observability"
+	"slices"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// DefaultService is the service name of workers registered without one.
+const DefaultService = "worker"
+
 type Registry struct {
 	mutex           sync.Mutex
 	workers         map[string]*Worker
 	db              *database.MongoDB
+	logger          *middleware.Logger
 	checkInterval   time.Duration
+	intervalChanged chan struct{} // Signals the health check loop that checkInterval changed
+	prober          *prober
+	resolveInterval time.Duration // Interval of the resolution of worker hostnames, disabled when 0
+	resolveNow      chan struct{}
+	lookup          func(ctx context.Context, host string) ([]net.IPAddr, error)
 	stopHealthCheck chan struct{}
+	subscribers     map[chan struct{}]struct{}
+	index           uint64        // Modification index, seeded with the startup time and incremented on every change
+	changeCh        chan struct{} // Closed and replaced on every change to wake up waiters
+	metrics         *observability.RegistryMetrics
 }
 
-func NewRegistry(db *database.MongoDB, checkInterval time.Duration) *Registry {
+// Options configures a registry.
+type Options struct {
+	CheckInterval   time.Duration      // Interval of the health checks
+	ResolveInterval time.Duration      // Interval of the resolution of worker hostnames, disabled when 0
+	Probe           config.ProbeConfig // Health checks of the workers, over http by default
+	Logger          *middleware.Logger // Nothing is logged when nil
+	Name            string             // Registry label of the metrics, the namespace of the database by default
+}
+
+// New creates a registry holding the workers stored in the database, and starts the health check loop.
+func New(db *database.MongoDB, opts Options) (*Registry, error) {
+	prober, err := newProber(opts.Probe, opts.Logger.Component("probe"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure the health checks: %w", err)
+	}
+
+	name := opts.Name
+	if name == "" {
+		name = db.Namespace()
+	}
+
 	r := &Registry{
-		workers:       make(map[string]*Worker),
-		db:            db,
-		checkInterval: checkInterval,
+		workers:         make(map[string]*Worker),
+		db:              db,
+		logger:          opts.Logger.Component("registry"),
+		checkInterval:   opts.CheckInterval,
+		intervalChanged: make(chan struct{}, 1),
+		prober:          prober,
+		resolveInterval: opts.ResolveInterval,
+		resolveNow:      make(chan struct{}, 1),
+		lookup:          defaultLookup,
+		stopHealthCheck: make(chan struct{}),
+		subscribers:     make(map[chan struct{}]struct{}),
+		// The index never goes backwards across restarts, so that the clients of blocking queries see the changes
+		index:    uint64(time.Now().UnixNano()),
+		changeCh: make(chan struct{}),
+		metrics:  observability.NewRegistryMetrics(name),
+	}
+	if err := r.loadWorkersFromDB(); err != nil {
+		return nil, fmt.Errorf("failed to load workers from database: %w", err)
 	}
-	r.loadWorkersFromDB()
+	r.reconcileMetrics()
 	go r.startHealthCheckLoop() // Start health check loop in the background
+	if r.resolveInterval > 0 {
+		go r.startResolveLoop()
+	}
+	return r, nil
+}
+
+// NewRegistry creates a registry with the default options and the given health check interval, and exits
+// when the workers cannot be loaded.
+func NewRegistry(db *database.MongoDB, checkInterval time.Duration) *Registry {
+	r, err := New(db, Options{CheckInterval: checkInterval})
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
 	return r
 }
 
 // Load workers from the database into memory
-func (r *Registry) loadWorkersFromDB() {
-	workers, err := r.db.GetAllWorkers()
+func (r *Registry) loadWorkersFromDB() error {
+	workers, err := r.db.GetAllWorkers(context.Background())
 	if err != nil {
-		log.Fatalf("Failed to load workers from database: %v", err)
+		return err
 	}
 
 	for _, w := range workers {
@@ -48,27 +115,66 @@ func (r *Registry) loadWorkersFromDB() {
 		grpcport := w["grpc_port"].(int32) // values are stored as int32
 		isHealthy := w["is_healthy"].(bool)
 		lastHealthCheck := w["last_health_check"].(primitive.DateTime).Time()
+		tokenHash, _ := w["token_sha256"].(string) // Empty for workers registered before tokens were introduced
+
+		// service and tags were introduced after the first releases, default them for older documents
+		service, _ := w["service"].(string)
+		if service == "" {
+			service = DefaultService
+		}
+		tags := stringValues(w["tags"])
+
+		// Addresses resolved by a previous run are only trusted while resolution is enabled
+		var addresses []string
+		if r.resolveInterval > 0 {
+			addresses = stringValues(w["addresses"])
+		}
 
 		r.workers[id] = &Worker{
+			ID:              id,
+			Service:         service,
+			Tags:            tags,
 			Host:            host,
+			Addresses:       addresses,
 			HTTPPort:        httpport,
 			GRPCPort:        grpcport,
 			IsHealthy:       isHealthy,
 			LastHealthCheck: lastHealthCheck,
+			tokenHash:       tokenHash,
+		}
+	}
+	return nil
+}
+
+// stringValues returns the strings of a BSON array, nil if the value is not an array.
+func stringValues(value interface{}) []string {
+	var values []string
+	if array, ok := value.(primitive.A); ok {
+		for _, v := range array {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
 		}
 	}
+	return values
 }
 
 // startHealthCheckLoop runs the health check loop at a configured interval.
 func (r *Registry) startHealthCheckLoop() {
-	logger := middleware.GetLogger()
+	logger := r.logger
+	r.mutex.Lock()
 	ticker := time.NewTicker(r.checkInterval)
+	r.mutex.Unlock()
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
 			r.CheckAllWorkers()
+		case <-r.intervalChanged:
+			r.mutex.Lock()
+			ticker.Reset(r.checkInterval)
+			r.mutex.Unlock()
 		case <-r.stopHealthCheck:
 			logger.Info("", "Stopping health check loop...")
 			return
@@ -76,6 +182,38 @@ func (r *Registry) startHealthCheckLoop() {
 	}
 }
 
+// SetCheckInterval changes the interval of the health check loop.
+func (r *Registry) SetCheckInterval(checkInterval time.Duration) {
+	r.mutex.Lock()
+	r.checkInterval = checkInterval
+	r.mutex.Unlock()
+
+	select {
+	case r.intervalChanged <- struct{}{}:
+	default:
+	}
+	r.logger.Info("", "Health check interval changed to %s", checkInterval)
+}
+
+// SetProbe replaces the configuration of the health checks, from the next check cycle.
+func (r *Registry) SetProbe(cfg config.ProbeConfig) error {
+	r.mutex.Lock()
+	logger := r.prober.logger
+	r.mutex.Unlock()
+
+	prober, err := newProber(cfg, logger)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	r.prober = prober
+	r.mutex.Unlock()
+
+	r.logger.Info("", "Health check configuration changed")
+	return nil
+}
+
 // StopHealthCheck stops the health check loop.
 func (r *Registry) StopHealthCheck() {
 	close(r.stopHealthCheck)
@@ -83,162 +221,379 @@ func (r *Registry) StopHealthCheck() {
 
 // Register a new worker
 func (r *Registry) RegisterWorker(id string, host string, httpPort int32, grpcPort int32) {
+	r.RegisterServiceWorker(id, DefaultService, nil, host, httpPort, grpcPort)
+}
+
+// RegisterServiceWorker registers a worker providing the given service, or refreshes it if the ID is already known.
+// It does not check the worker token: the APIs register workers through Register.
+func (r *Registry) RegisterServiceWorker(id string, service string, tags []string, host string, httpPort int32, grpcPort int32) {
+	ctx, span := observability.StartSpan(context.Background(), "Registry.RegisterServiceWorker", workerAttributes(id))
+	defer span.End()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.upsertWorker(ctx, id, service, tags, host, httpPort, grpcPort)
+}
+
+// workerAttributes returns the option adding the worker ID to a span.
+func workerAttributes(id string) trace.SpanStartEventOption {
+	return trace.WithAttributes(observability.AttrWorkerID.String(id))
+}
+
+// Register registers or refreshes a worker on behalf of an API caller.
+// A worker ID is bound to a token on its first registration: the token presented in the registration
+// (pre-provisioned) or, when none is presented, a generated one that is returned so that the worker can
+// use it in its next requests. Registrations of a bound ID must then present the same token, unless
+// override is set, which callers use for administrators. Invalid registrations are rejected with a ValidationError.
+// The request ID of the context is logged with the operations on the worker.
+func (r *Registry) Register(ctx context.Context, reg Registration, override bool) (Worker, string, error) {
+	ctx, span := observability.StartSpan(ctx, "Registry.Register", workerAttributes(reg.ID))
+	worker, issued, err := r.register(ctx, reg, override)
+	observability.EndSpan(span, err)
+	return worker, issued, err
+}
+
+// register implements Register, in its span.
+func (r *Registry) register(ctx context.Context, reg Registration, override bool) (Worker, string, error) {
+	if err := reg.Validate(); err != nil {
+		r.recordRegistration(observability.RegistrationRejected)
+		return Worker{}, "", err
+	}
+
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	logger := middleware.GetLogger()
+	logger := r.logger.With(middleware.FieldWorkerID, reg.ID)
+	requestID := middleware.GetRequestIDFromContext(ctx)
 
-	logger.Debug("", "Registring Worker with IP %s HTTP port %d GRPC port %d", host, httpPort, grpcPort)
+	worker, exists := r.workers[reg.ID]
+	bound := exists && worker.tokenHash != ""
+	if bound && !override && !worker.matchesToken(reg.Token) {
+		logger.Warn(requestID, "Rejected registration of worker %s: token mismatch", reg.ID)
+		r.recordRegistration(observability.RegistrationRejected)
+		return Worker{}, "", ErrTokenMismatch
+	}
+
+	var issued, tokenHash string
+	if !bound {
+		token := reg.Token
+		if token == "" {
+			var err error
+			if token, err = auth.GenerateSecret(); err != nil {
+				return Worker{}, "", err
+			}
+			issued = token
+		} else if len(token) < MinTokenLength {
+			r.recordRegistration(observability.RegistrationRejected)
+			return Worker{}, "", ErrInvalidToken
+		}
+		tokenHash = auth.HashKey(token)
+	}
+
+	worker = r.upsertWorker(ctx, reg.ID, reg.Service, reg.Tags, reg.Host, reg.HTTPPort, reg.GRPCPort)
+	if tokenHash != "" {
+		worker.tokenHash = tokenHash
+		if err := r.db.SetWorkerTokenHash(storeContext(ctx), reg.ID, tokenHash); err != nil {
+			logger.Error(requestID, "Failed to store worker token in database: %v", err)
+		}
+	}
+
+	return *worker, issued, nil
+}
+
+// storeContext returns the context of the database operations run on behalf of a caller: the database must be
+// updated like the cache even when the caller goes away.
+func storeContext(ctx context.Context) context.Context {
+	return context.WithoutCancel(ctx)
+}
+
+// Metrics returns the recorder of the metrics of the registry, shared with its servers.
+func (r *Registry) Metrics() *observability.RegistryMetrics {
+	return r.metrics
+}
+
+// recordRegistration records the outcome of a registration. The invalid registrations are rejected before the
+// registry is used, so that a server can validate them without one: nothing is recorded then.
+func (r *Registry) recordRegistration(outcome string) {
+	if r != nil {
+		r.metrics.RecordRegistration(outcome)
+	}
+}
+
+// upsertWorker inserts the worker or updates it if the ID is already known.
+// Must be called with the mutex held.
+func (r *Registry) upsertWorker(ctx context.Context, id string, service string, tags []string, host string, httpPort int32, grpcPort int32) *Worker {
+	logger := r.logger.With(middleware.FieldWorkerID, id)
+	requestID := middleware.GetRequestIDFromContext(ctx)
+	ctx = storeContext(ctx)
+
+	if service == "" {
+		service = DefaultService
+	}
+
+	logger.Debug(requestID, "Registring Worker for service %s with host %s HTTP port %d GRPC port %d", service, host, httpPort, grpcPort)
 
 	// Use the worker ID as mapping key
 	worker, exists := r.workers[id]
 	if !exists {
-		logger.Debug("", "Worker cache miss, insert in Cache and DB")
-		worker = &Worker{Host: host, HTTPPort: httpPort, GRPCPort: grpcPort, IsHealthy: true, LastHealthCheck: time.Now()}
+		logger.Debug(requestID, "Worker cache miss, insert in Cache and DB")
+		r.recordRegistration(observability.RegistrationCreated)
+		worker = &Worker{ID: id, Service: service, Tags: tags, Host: host, HTTPPort: httpPort, GRPCPort: grpcPort, IsHealthy: true, LastHealthCheck: time.Now()}
 		r.workers[id] = worker
-		if err := r.db.InsertWorker(id, host, httpPort, grpcPort); err != nil {
-			logger.Info("", "Failed to insert worker into database: %v", err)
+		if err := r.db.InsertServiceWorker(ctx, id, service, tags, host, httpPort, grpcPort); err != nil {
+			logger.Error(requestID, "Failed to insert worker into database: %v", err)
+		}
+		r.changed()
+		if isHostname(host) {
+			r.requestResolution()
 		}
 	} else {
-		logger.Debug("", "Worker cache match, update health status in Cache and DB")
+		logger.Debug(requestID, "Worker cache match, update health status in Cache and DB")
+		r.recordRegistration(observability.RegistrationRefreshed)
+		updated := !worker.IsHealthy
+		if worker.Service != service || !slices.Equal(worker.Tags, tags) || worker.Host != host || worker.HTTPPort != httpPort || worker.GRPCPort != grpcPort {
+			logger.Debug(requestID, "Worker %s changed, update it in Cache and DB", id)
+			if worker.Host != host || worker.HTTPPort != httpPort {
+				// The health status is reported at the new address below
+				r.metrics.ForgetWorkerAddress(id, middleware.GetURLFromHostPort(worker.Host, worker.HTTPPort))
+			}
+			if worker.Host != host {
+				// The addresses of the previous host are stale
+				if len(worker.Addresses) > 0 {
+					worker.Addresses = nil
+					if err := r.db.UpdateWorkerAddresses(ctx, id, nil); err != nil {
+						logger.Error(requestID, "Failed to update worker in database: %v", err)
+					}
+				}
+				if isHostname(host) {
+					r.requestResolution()
+				}
+			}
+			worker.Service = service
+			worker.Tags = tags
+			worker.Host = host
+			worker.HTTPPort = httpPort
+			worker.GRPCPort = grpcPort
+			if err := r.db.UpdateWorker(ctx, id, service, tags, host, httpPort, grpcPort); err != nil {
+				logger.Error(requestID, "Failed to update worker in database: %v", err)
+			}
+			updated = true
+		}
 		worker.IsHealthy = true
 		worker.LastHealthCheck = time.Now()
-		if err := r.db.UpdateWorkerHealth(id, true); err != nil {
-			logger.Info("", "Failed to update worker in database: %v", err)
+		if err := r.db.UpdateWorkerHealth(ctx, id, true); err != nil {
+			logger.Error(requestID, "Failed to update worker in database: %v", err)
+		}
+		if updated {
+			r.changed()
 		}
 	}
 
 	// Record the health status in Prometheus metrics
 	url := middleware.GetURLFromHostPort(host, httpPort)
-	observability.RecordWorkerHealth(id, url, true)
+	r.metrics.RecordWorkerHealth(id, url, true)
+
+	return worker
 }
 
 // UpdateHealth updates the health status of a worker
-func (r *Registry) UpdateHealth(id string, isHealthy bool) {
+func (r *Registry) UpdateHealth(ctx context.Context, id string, isHealthy bool) {
+	ctx, span := observability.StartSpan(ctx, "Registry.UpdateHealth", workerAttributes(id))
+	defer span.End()
+
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	logger := middleware.GetLogger()
-	logger.Debug("", "UpdateHealth worker ID %s isHealthy %v", id, isHealthy)
+	logger := r.logger.With(middleware.FieldWorkerID, id)
+	requestID := middleware.GetRequestIDFromContext(ctx)
+	logger.Debug(requestID, "UpdateHealth worker ID %s isHealthy %v", id, isHealthy)
 
 	worker, exists := r.workers[id]
 	if !exists {
+		// The worker left during its health check, whose probes recreated its series
+		r.metrics.ForgetWorker(id)
 		return
 	}
 
 	if worker.IsHealthy != isHealthy {
 		worker.IsHealthy = isHealthy
 		worker.LastHealthCheck = time.Now()
-		if err := r.db.UpdateWorkerHealth(id, isHealthy); err != nil {
-			logger.Info("Cache - ", "Failed to update worker in database: %v", err)
+		if err := r.db.UpdateWorkerHealth(storeContext(ctx), id, isHealthy); err != nil {
+			logger.Error(requestID, "Failed to update worker in database: %v", err)
 		}
 
 		// Record the health status in Prometheus metrics
 		url := middleware.GetURLFromHostPort(worker.Host, worker.HTTPPort)
-		observability.RecordWorkerHealth(id, url, isHealthy)
+		r.metrics.RecordWorkerHealth(id, url, isHealthy)
+
+		r.changed()
 	}
 }
 
-func getWorkerHealth(url string, apiKey string) bool {
-	logger := middleware.GetLogger()
+// CheckAllWorkers checks the health of all workers in the cache. The workers resolved to several addresses
+// are checked at each of them: the addresses failing the check are dropped until the next resolution, and the
+// worker is evicted when none passes it. Each check of a worker has its own ID, sent to the worker in the
+// X-Request-ID header of the probes and logged with the resulting operations.
+// The checks of a cycle are traced in the span of the cycle.
+func (r *Registry) CheckAllWorkers() {
+	start := time.Now()
+	cycleCtx, cycleSpan := observability.StartSpan(context.Background(), "Registry.CheckAllWorkers")
+	defer cycleSpan.End()
 
-	// Create a new GET request
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		logger.Debug("", "Failed to create request GET %s : %s", url, err)
-		return false
+	r.mutex.Lock()
+	prober := r.prober
+	interval := r.checkInterval
+	workers := make([]Worker, 0, len(r.workers))
+	for _, worker := range r.workers {
+		workers = append(workers, *worker)
 	}
+	r.mutex.Unlock()
+	cycleSpan.SetAttributes(attribute.Int("registry.workers", len(workers)))
 
-	// Set the X-API-Key header
-	req.Header.Set("X-API-Key", apiKey)
-
-	// Send the request
-	client := &http.Client{
-		Timeout: 5 * time.Second,
+	for _, worker := range workers {
+		r.checkWorker(cycleCtx, prober, worker)
 	}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		logger.Debug("", "Failed to create request GET %s : %s", url, err)
-		return false
+	r.metrics.RecordCheckCycle(time.Since(start), interval)
+	if r.logger.DebugEnabled() {
+		r.logger.With(middleware.FieldDuration, time.Since(start)).Debug("", "Checked the health of %d workers", len(workers))
 	}
-	defer resp.Body.Close()
-
-	// Compute health result
-	isHealthy := resp.StatusCode == http.StatusOK
-
-	return isHealthy
 }
 
-// CheckAllWorkers checks the health of all workers in the cache.
-func (r *Registry) CheckAllWorkers() {
-	logger := middleware.GetLogger()
+// checkWorker checks the health of a worker, with its own ID, and updates or evicts it.
+func (r *Registry) checkWorker(ctx context.Context, prober *prober, worker Worker) {
+	probeID := middleware.NewRequestID()
+	ctx = middleware.ContextWithRequestID(ctx, probeID)
+	ctx, span := observability.StartSpan(ctx, "Registry.CheckWorker", trace.WithAttributes(
+		observability.AttrWorkerID.String(worker.ID),
+		observability.AttrRequestID.String(probeID),
+	))
+	defer span.End()
 
-	r.mutex.Lock()
-	workers := r.workers
-	r.mutex.Unlock()
+	logger := r.logger.With(middleware.FieldWorkerID, worker.ID)
+	url := prober.url(worker.Host, worker.HTTPPort)
+	logger.Debug(probeID, "Checking health of worker at url: %s", url)
 
 	isHealthy := false
-	for key := range workers {
-
-		url := middleware.GetURLFromHostPort(workers[key].Host, workers[key].HTTPPort)
-		logger.Debug("", "Checking health of worker at url: %s", url)
-
-		retries := 4
-		for i := 0; i < retries; i++ {
-			isHealthy = getWorkerHealth(url+"/healthcheck", config.AppConfig.APIKey)
-			if isHealthy {
-				r.UpdateHealth(key, true)
-				logger.Debug("", "Worker %s is healthy", url)
-				break
-			} else {
-				// Log the error and retry
-				str := ""
-				if i < retries {
-					str = " Retrying..."
-				}
-				logger.Debug("", "Try #%d: Error checking worker (%s) health.%s", i, url, str)
+	if len(worker.Addresses) == 0 {
+		isHealthy = r.checkWithRetries(ctx, logger, prober, worker.ID, url, "")
+	} else {
+		healthy := make([]string, 0, len(worker.Addresses))
+		for _, address := range worker.Addresses {
+			if r.checkWithRetries(ctx, logger, prober, worker.ID, url, address) {
+				healthy = append(healthy, address)
 			}
-			time.Sleep(100 * time.Millisecond) // Backoff
 		}
+		isHealthy = len(healthy) > 0
+		if isHealthy && len(healthy) < len(worker.Addresses) {
+			r.setAddresses(ctx, worker.ID, worker.Host, healthy)
+		}
+	}
+
+	if isHealthy {
+		r.UpdateHealth(ctx, worker.ID, true)
+	} else {
+		logger.Warn(probeID, "Worker %s is not healthy after retries. Removing it from cache and database.", url)
+		r.metrics.RecordEviction()
+		r.RemoveWorker(ctx, worker.ID)
+	}
+}
+
+// checkWithRetries checks the health of the worker id at url, connecting to address when it is set, and retries
+// failed checks.
+func (r *Registry) checkWithRetries(ctx context.Context, logger *middleware.Logger, prober *prober, id string, url string, address string) bool {
+	probeID := middleware.GetRequestIDFromContext(ctx)
+	target := url
+	if address != "" {
+		target = url + " at " + address
+	}
 
-		if !isHealthy {
-			logger.Info("", "Worker %s is not healthy after retries. Removing it from cache and database.", url)
-			r.RemoveWorker(key)
+	retries := 4
+	for i := 0; i < retries; i++ {
+		start := time.Now()
+		reason := prober.check(ctx, url, address)
+		r.metrics.RecordProbe(id, time.Since(start), reason)
+		if reason == "" {
+			logger.Debug(probeID, "Worker %s is healthy", target)
+			return true
 		}
+		// Log the error and retry
+		str := ""
+		if i < retries-1 {
+			str = " Retrying..."
+		}
+		logger.Debug(probeID, "Try #%d: Error checking worker (%s) health: %s.%s", i, target, reason, str)
+		time.Sleep(100 * time.Millisecond) // Backoff
 	}
+	return false
 }
 
 // RemoveWorker removes a worker from the cache and database
-func (r *Registry) RemoveWorker(key string) {
+func (r *Registry) RemoveWorker(ctx context.Context, key string) {
+	ctx, span := observability.StartSpan(ctx, "Registry.RemoveWorker", workerAttributes(key))
+	defer span.End()
+
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	logger := middleware.GetLogger()
+	r.removeWorkerLocked(ctx, key)
+}
+
+// removeWorkerLocked removes a worker from the cache and database. Must be called with the mutex held.
+func (r *Registry) removeWorkerLocked(ctx context.Context, key string) {
+	logger := r.logger.With(middleware.FieldWorkerID, key)
+	requestID := middleware.GetRequestIDFromContext(ctx)
 
-	logger.Debug("Cache - ", "Removing worker with id %s", key)
-	delete(r.workers, key)
-	if err := r.db.DeleteWorker(key); err != nil {
-		logger.Info("DB - ", "Failed to delete worker from database: %v", err)
+	logger.Debug(requestID, "Removing worker with id %s", key)
+	if _, exists := r.workers[key]; exists {
+		delete(r.workers, key)
+		r.changed()
+	}
+	r.metrics.ForgetWorker(key)
+	if err := r.db.DeleteWorker(storeContext(ctx), key); err != nil {
+		logger.Error(requestID, "Failed to delete worker from database: %v", err)
 	}
 }
 
+// DeregisterWorker removes a worker on behalf of an API caller, which must present the token the worker ID
+// is bound to unless override is set. Removing an unknown worker is not an error.
+func (r *Registry) DeregisterWorker(ctx context.Context, id string, token string, override bool) error {
+	ctx, span := observability.StartSpan(ctx, "Registry.DeregisterWorker", workerAttributes(id))
+
+	// The token is checked and the worker removed under the same lock, so that a worker registering again
+	// with a new token in between is not removed by the holder of the previous one
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if worker, exists := r.workers[id]; exists && !override && !worker.matchesToken(token) {
+		r.logger.With(middleware.FieldWorkerID, id).Warn(middleware.GetRequestIDFromContext(ctx), "Rejected deregistration of worker %s: token mismatch", id)
+		observability.EndSpan(span, ErrTokenMismatch)
+		return ErrTokenMismatch
+	}
+
+	r.removeWorkerLocked(ctx, id)
+	span.End()
+	return nil
+}
+
 // GetWorkerHealth retrieves a worker by its address.
 func (r *Registry) GetWorkerHealth(url string) (ishealthy bool, found bool) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	logger := middleware.GetLogger()
+	logger := r.logger
 
+	host, port, _ := middleware.GetHostAndPortFromURL(url)
 	for key := range r.workers {
-		host, port, _ := middleware.GetHostAndPortFromURL(url)
-		if r.workers[key].Host == host && r.workers[key].HTTPPort == port {
-			logger.Debug("Cache - ", "Get worker %s health: %v", url, true)
+		worker := r.workers[key]
+		if (worker.Host == host || slices.Contains(worker.Addresses, host)) && worker.HTTPPort == port {
+			logger.Debug("", "Get worker %s health: %v", url, true)
 			return r.workers[key].IsHealthy, true
 		}
 	}
 
-	logger.Debug("Cache - ", "Get worker %s health: Not found", url)
+	logger.Debug("", "Get worker %s health: Not found", url)
 
 	return false, false
 }
@@ -248,19 +603,191 @@ func (r *Registry) GetHealthyWorkersURL() []string {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	logger := middleware.GetLogger()
-	logger.Debug("Cache - ", "Starting GetHealthyWorkersURL...")
+	logger := r.logger
+	logger.Debug("", "Starting GetHealthyWorkersURL...")
 
 	// By design only healthy workers are kept in the cache and the DB.
+	// Resolved workers are listed at each of their healthy addresses, the others at their host.
 	urls := make([]string, 0, len(r.workers))
 	for key := range r.workers {
-		host := r.workers[key].Host
 		port := strconv.Itoa(int(r.workers[key].HTTPPort))
-		url := net.JoinHostPort(host, port)
-		urls = append(urls, url)
+		hosts := r.workers[key].Addresses
+		if len(hosts) == 0 {
+			hosts = []string{r.workers[key].Host}
+		}
+		for _, host := range hosts {
+			urls = append(urls, net.JoinHostPort(host, port))
+		}
 	}
 
-	logger.Debug("Cache - ", "Completed GetHealthyWorkers.")
+	logger.Debug("", "Completed GetHealthyWorkers.")
 
 	return urls
 }
+
+// GetWorker returns a copy of the worker with the given ID.
+func (r *Registry) GetWorker(id string) (Worker, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	worker, exists := r.workers[id]
+	if !exists {
+		return Worker{}, false
+	}
+	return *worker, true
+}
+
+// Heartbeat marks a registered worker as healthy and returns a copy of it. The caller must present the token
+// the worker ID is bound to unless override is set.
+// It returns ErrWorkerNotFound if the worker is unknown, in which case it must register again.
+func (r *Registry) Heartbeat(ctx context.Context, id string, token string, override bool) (Worker, error) {
+	ctx, span := observability.StartSpan(ctx, "Registry.Heartbeat", workerAttributes(id))
+	worker, err := r.heartbeat(ctx, id, token, override)
+	observability.EndSpan(span, err)
+	return worker, err
+}
+
+// heartbeat implements Heartbeat, in its span.
+func (r *Registry) heartbeat(ctx context.Context, id string, token string, override bool) (Worker, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	logger := r.logger.With(middleware.FieldWorkerID, id)
+	requestID := middleware.GetRequestIDFromContext(ctx)
+	logger.Debug(requestID, "Heartbeat from worker ID %s", id)
+
+	worker, exists := r.workers[id]
+	if !exists {
+		return Worker{}, ErrWorkerNotFound
+	}
+	if !override && !worker.matchesToken(token) {
+		logger.Warn(requestID, "Rejected heartbeat of worker %s: token mismatch", id)
+		return Worker{}, ErrTokenMismatch
+	}
+
+	recovered := !worker.IsHealthy
+	worker.IsHealthy = true
+	worker.LastHealthCheck = time.Now()
+	if err := r.db.UpdateWorkerHealth(storeContext(ctx), id, true); err != nil {
+		logger.Error(requestID, "Failed to update worker in database: %v", err)
+	}
+
+	url := middleware.GetURLFromHostPort(worker.Host, worker.HTTPPort)
+	r.metrics.RecordWorkerHealth(id, url, true)
+
+	// Once the worker is healthy, so that the registry size counts it as such
+	if recovered {
+		r.changed()
+	}
+
+	return *worker, nil
+}
+
+// Snapshot returns a copy of every worker in the cache, sorted by ID.
+func (r *Registry) Snapshot() []Worker {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	workers := make([]Worker, 0, len(r.workers))
+	for _, worker := range r.workers {
+		workers = append(workers, *worker)
+	}
+	sort.Slice(workers, func(i, j int) bool { return workers[i].ID < workers[j].ID })
+
+	return workers
+}
+
+// Subscribe returns a channel that receives a signal whenever the set of workers or their health changes,
+// and a function to cancel the subscription. Signals are coalesced: a slow reader sees at most one pending signal.
+func (r *Registry) Subscribe() (<-chan struct{}, func()) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	ch := make(chan struct{}, 1)
+	r.subscribers[ch] = struct{}{}
+
+	cancel := func() {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		delete(r.subscribers, ch)
+	}
+	return ch, cancel
+}
+
+// Index returns the modification index of the registry, incremented on every change.
+func (r *Registry) Index() uint64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.index
+}
+
+// WaitForChange blocks until the modification index is greater than index or the context is done,
+// and returns the current modification index.
+func (r *Registry) WaitForChange(ctx context.Context, index uint64) uint64 {
+	for {
+		r.mutex.Lock()
+		current, changeCh := r.index, r.changeCh
+		r.mutex.Unlock()
+
+		if current > index {
+			return current
+		}
+
+		select {
+		case <-changeCh:
+		case <-ctx.Done():
+			return current
+		}
+	}
+}
+
+// changed bumps the modification index, records the size of the registry, and signals every waiter and subscriber
+// without blocking.
+// Must be called with the mutex held.
+func (r *Registry) changed() {
+	r.recordSize()
+	r.index++
+	close(r.changeCh)
+	r.changeCh = make(chan struct{})
+
+	for ch := range r.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// reconcileMetrics reports the health of the workers loaded from the database, and removes the series of the
+// workers that are not registered anymore.
+func (r *Registry) reconcileMetrics() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	workers := make([]observability.WorkerHealth, 0, len(r.workers))
+	for id, worker := range r.workers {
+		workers = append(workers, observability.WorkerHealth{
+			ID:      id,
+			Address: middleware.GetURLFromHostPort(worker.Host, worker.HTTPPort),
+			Healthy: worker.IsHealthy,
+		})
+	}
+	r.metrics.ResetWorkerHealth(workers)
+	r.recordSize()
+}
+
+// recordSize records the number of workers of each service, healthy or not.
+// Must be called with the mutex held.
+func (r *Registry) recordSize() {
+	counts := make(map[observability.WorkerCount]int)
+	for _, worker := range r.workers {
+		counts[observability.WorkerCount{Service: worker.Service, Healthy: worker.IsHealthy}]++
+	}
+	sizes := make([]observability.WorkerCount, 0, len(counts))
+	for count, n := range counts {
+		count.Count = n
+		sizes = append(sizes, count)
+	}
+	r.metrics.RecordRegistrySize(sizes)
+}
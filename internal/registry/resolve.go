@@ -0,0 +1,130 @@
+package registry
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"registry-service/internal/middleware"
+	"registry-service/internal/observability"
+	"slices"
+	"time"
+)
+
+const resolveTimeout = 5 * time.Second
+
+// isHostname reports whether the host of a worker is a hostname rather than an IP address.
+func isHostname(host string) bool {
+	_, err := netip.ParseAddr(host)
+	return err != nil
+}
+
+// startResolveLoop resolves the worker hostnames at the configured interval, and whenever a worker
+// registers with a new hostname.
+func (r *Registry) startResolveLoop() {
+	logger := r.logger
+	ticker := time.NewTicker(r.resolveInterval)
+	defer ticker.Stop()
+
+	r.ResolveAllWorkers()
+	for {
+		select {
+		case <-ticker.C:
+			r.ResolveAllWorkers()
+		case <-r.resolveNow:
+			r.ResolveAllWorkers()
+		case <-r.stopHealthCheck:
+			logger.Info("", "Stopping resolution loop...")
+			return
+		}
+	}
+}
+
+// requestResolution wakes up the resolution loop without blocking, if resolution is enabled.
+func (r *Registry) requestResolution() {
+	if r.resolveInterval <= 0 {
+		return
+	}
+	select {
+	case r.resolveNow <- struct{}{}:
+	default:
+	}
+}
+
+// ResolveAllWorkers resolves the hostname of every worker registered with one, and replaces the addresses
+// of the workers whose hostname resolves to other addresses. When a resolution fails, the previous addresses
+// are kept.
+func (r *Registry) ResolveAllWorkers() {
+	logger := r.logger
+	ctx, span := observability.StartSpan(context.Background(), "Registry.ResolveAllWorkers")
+	defer span.End()
+
+	r.mutex.Lock()
+	hosts := make(map[string]string)
+	for id, worker := range r.workers {
+		if isHostname(worker.Host) {
+			hosts[id] = worker.Host
+		}
+	}
+	r.mutex.Unlock()
+
+	resolved := make(map[string][]string) // Hostnames shared by several workers are resolved once
+	for id, host := range hosts {
+		addresses, ok := resolved[host]
+		if !ok {
+			var err error
+			if addresses, err = r.resolve(ctx, host); err != nil {
+				logger.Warn("", "Failed to resolve host %s of worker %s, keeping its previous addresses: %v", host, id, err)
+				continue
+			}
+			resolved[host] = addresses
+		}
+		r.setAddresses(ctx, id, host, addresses)
+	}
+}
+
+// resolve returns the sorted IPv4 and IPv6 addresses of host.
+func (r *Registry) resolve(ctx context.Context, host string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, resolveTimeout)
+	defer cancel()
+
+	ips, err := r.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addresses := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addr, ok := netip.AddrFromSlice(ip.IP)
+		if !ok {
+			continue
+		}
+		address := addr.Unmap().WithZone(ip.Zone).String()
+		if !slices.Contains(addresses, address) {
+			addresses = append(addresses, address)
+		}
+	}
+	slices.Sort(addresses)
+	return addresses, nil
+}
+
+// setAddresses replaces the addresses of the worker, unless its host changed since they were computed.
+func (r *Registry) setAddresses(ctx context.Context, id string, host string, addresses []string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	worker, exists := r.workers[id]
+	if !exists || worker.Host != host || slices.Equal(worker.Addresses, addresses) {
+		return
+	}
+
+	logger := r.logger.With(middleware.FieldWorkerID, id)
+	requestID := middleware.GetRequestIDFromContext(ctx)
+	logger.Debug(requestID, "Worker %s (%s) addresses changed to %v", id, host, addresses)
+	worker.Addresses = addresses
+	if err := r.db.UpdateWorkerAddresses(ctx, id, addresses); err != nil {
+		logger.Error(requestID, "Failed to update worker in database: %v", err)
+	}
+	r.changed()
+}
+
+// defaultLookup resolves hostnames with the system resolver.
+var defaultLookup = net.DefaultResolver.LookupIPAddr
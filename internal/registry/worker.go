@@ -1,11 +1,111 @@
 package registry
 
-import "time"
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"regexp"
+	"registry-service/internal/auth"
+	"registry-service/internal/middleware"
+	"strings"
+	"time"
+)
+
+const (
+	// MinTokenLength is the minimum length of a pre-provisioned worker token.
+	MinTokenLength = 16
+	// MaxIDLength is the maximum length of worker IDs and service names.
+	MaxIDLength = 128
+)
+
+// idPattern is the format of worker IDs and service names.
+var idPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:@-]*$`)
+
+var (
+	ErrWorkerNotFound = errors.New("worker is not registered")
+	ErrTokenMismatch  = errors.New("worker ID is bound to another token")
+	ErrInvalidToken   = errors.New("worker token is too short")
+)
 
 type Worker struct {
+	ID              string
+	Service         string
+	Tags            []string
 	Host            string
+	Addresses       []string // Addresses resolved from a hostname Host that passed the last health check, empty if not resolved
 	HTTPPort        int32
 	GRPCPort        int32
 	IsHealthy       bool
 	LastHealthCheck time.Time
+	tokenHash       string // SHA-256 of the token the worker ID is bound to, empty if unbound
+}
+
+// Registration is a registration request received from one of the APIs.
+type Registration struct {
+	ID       string
+	Service  string
+	Tags     []string
+	Host     string
+	HTTPPort int32
+	GRPCPort int32
+	Token    string // Worker token presented by the caller, empty if none
+}
+
+// ValidationError lists the problems of an invalid registration.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid registration: " + strings.Join(e.Problems, "; ")
+}
+
+// Validate checks the format of the ID and service name, the host and the port ranges of the registration,
+// and returns a ValidationError listing every problem.
+func (reg Registration) Validate() error {
+	var problems []string
+	problems = appendNameProblems(problems, "ID", reg.ID, true)
+	problems = appendNameProblems(problems, "service", reg.Service, false)
+	if !middleware.IsValidHost(reg.Host) {
+		problems = append(problems, fmt.Sprintf("host %q is not an IP address nor a hostname", reg.Host))
+	}
+	if reg.HTTPPort < 1 || reg.HTTPPort > 65535 {
+		problems = append(problems, fmt.Sprintf("HTTP port %d is not between 1 and 65535", reg.HTTPPort))
+	}
+	if reg.GRPCPort < 0 || reg.GRPCPort > 65535 {
+		problems = append(problems, fmt.Sprintf("gRPC port %d is not between 0 and 65535", reg.GRPCPort))
+	}
+	for _, tag := range reg.Tags {
+		if tag == "" {
+			problems = append(problems, "tags must not be empty")
+			break
+		}
+	}
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+func appendNameProblems(problems []string, field string, value string, required bool) []string {
+	switch {
+	case value == "":
+		if required {
+			problems = append(problems, field+" is required")
+		}
+	case len(value) > MaxIDLength:
+		problems = append(problems, fmt.Sprintf("%s must be at most %d characters long", field, MaxIDLength))
+	case !idPattern.MatchString(value):
+		problems = append(problems, fmt.Sprintf("%s %q must start with a letter or a digit and only contain letters, digits and . _ : @ -", field, value))
+	}
+	return problems
+}
+
+// matchesToken reports whether token is the one the worker is bound to. Unbound workers, registered
+// before tokens were introduced, accept any token until their next registration binds them.
+func (w *Worker) matchesToken(token string) bool {
+	if w.tokenHash == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(w.tokenHash), []byte(auth.HashKey(token))) == 1
 }
@@ -0,0 +1,340 @@
+package render
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"registry-service/internal/config"
+	"registry-service/internal/middleware"
+	"registry-service/internal/registry"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	defaultCommandTimeout = 30 * time.Second
+	defaultMaxWait        = 5 * time.Second
+	defaultReloadRetry    = time.Second // First retry of a failed command when there is no debounce
+)
+
+// Source is the registry view needed by the renderer.
+type Source interface {
+	Snapshot() []registry.Worker
+	Subscribe() (<-chan struct{}, func())
+}
+
+// Data is the value passed to the templates.
+type Data struct {
+	Workers        []registry.Worker // All the workers known by the registry
+	HealthyWorkers []registry.Worker // Subset of Workers that passed their last health check
+	GeneratedAt    time.Time
+}
+
+type target struct {
+	tmpl           *template.Template
+	destination    string
+	command        string
+	commandTimeout time.Duration
+	generatedAt    time.Time // GeneratedAt of the content written last, zero before the first write
+	reloadPending  bool      // The destination changed but the command has not succeeded since
+}
+
+// Options configures a renderer.
+type Options struct {
+	Debounce time.Duration      // Quiet period after the last change before rendering
+	MaxWait  time.Duration      // Longest delay of a render by changes that keep coming, 5s by default
+	Logger   *middleware.Logger // Nothing is logged when nil
+}
+
+// Renderer renders templates from the registry content each time it changes.
+type Renderer struct {
+	source      Source
+	targets     []*target
+	debounce    time.Duration
+	maxWait     time.Duration
+	logger      *middleware.Logger
+	renderMutex sync.Mutex // Serializes the renders of the loop and of RenderAll
+	stop        chan struct{}
+	done        chan struct{} // Closed when the loop returns, or on Stop when it never started
+
+	stateMutex sync.Mutex // Guards started and stopped
+	started    bool
+	stopped    bool
+}
+
+// templateFuncs are the helpers available in the templates in addition to the text/template builtins.
+var templateFuncs = template.FuncMap{
+	"hostport": func(host string, port int32) string {
+		return net.JoinHostPort(host, strconv.Itoa(int(port)))
+	},
+}
+
+// New parses the configured templates. Rendering starts with Start.
+func New(source Source, templates []config.TemplateConfig, opts Options) (*Renderer, error) {
+	maxWait := opts.MaxWait
+	if maxWait == 0 {
+		maxWait = defaultMaxWait
+	}
+	r := &Renderer{
+		source:   source,
+		debounce: opts.Debounce,
+		maxWait:  max(maxWait, opts.Debounce),
+		logger:   opts.Logger.Component("render"),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	for _, t := range templates {
+		if t.Source == "" || t.Destination == "" {
+			return nil, fmt.Errorf("template requires both source and destination (source %q, destination %q)", t.Source, t.Destination)
+		}
+		tmpl, err := template.New(filepath.Base(t.Source)).Funcs(templateFuncs).ParseFiles(t.Source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse template %s: %w", t.Source, err)
+		}
+		timeout := defaultCommandTimeout
+		if t.CommandTimeout > 0 {
+			timeout = time.Duration(t.CommandTimeout) * time.Millisecond
+		}
+		r.targets = append(r.targets, &target{
+			tmpl:           tmpl,
+			destination:    t.Destination,
+			command:        t.Command,
+			commandTimeout: timeout,
+		})
+	}
+
+	return r, nil
+}
+
+// Start renders all templates once, then re-renders them in the background whenever the registry changes.
+// Changes are debounced so that a burst of registrations or evictions results in a single render, which changes
+// that keep coming delay by MaxWait at most. The commands that failed are retried, with a backoff from the debounce
+// period up to MaxWait, until they succeed. It does nothing once the renderer started or stopped.
+func (r *Renderer) Start() {
+	r.stateMutex.Lock()
+	if r.started || r.stopped {
+		r.stateMutex.Unlock()
+		return
+	}
+	r.started = true
+	r.stateMutex.Unlock()
+
+	changes, cancel := r.source.Subscribe()
+	pending := r.renderAll()
+
+	go func() {
+		defer close(r.done)
+		defer cancel()
+
+		var (
+			timer *time.Timer
+			fire  <-chan time.Time
+			first time.Time     // Time of the first change not rendered yet, zero when there is none
+			retry time.Duration // Delay of the last retry of the failed commands, zero when none failed
+		)
+		schedule := func(delay time.Duration) {
+			if timer == nil {
+				timer = time.NewTimer(delay)
+			} else {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(delay)
+			}
+			fire = timer.C
+		}
+		scheduleRetry := func() {
+			switch {
+			case retry > 0:
+				retry = min(2*retry, r.maxWait)
+			case r.debounce > 0:
+				retry = r.debounce
+			default:
+				retry = min(defaultReloadRetry, r.maxWait)
+			}
+			schedule(retry)
+		}
+		if pending {
+			scheduleRetry()
+		}
+
+		for {
+			select {
+			case <-changes:
+				now := time.Now()
+				if first.IsZero() {
+					first = now
+				}
+				schedule(max(0, min(r.debounce, r.maxWait-now.Sub(first))))
+			case <-fire:
+				fire = nil
+				first = time.Time{}
+				if r.renderAll() {
+					scheduleRetry()
+				} else {
+					retry = 0
+				}
+			case <-r.stop:
+				if timer != nil {
+					timer.Stop()
+				}
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the background rendering and waits for an in-flight render to complete. It returns at once when the
+// renderer was never started.
+func (r *Renderer) Stop() {
+	r.stateMutex.Lock()
+	if !r.stopped {
+		r.stopped = true
+		close(r.stop)
+		if !r.started {
+			close(r.done)
+		}
+	}
+	r.stateMutex.Unlock()
+	<-r.done
+}
+
+// RenderAll renders every template from the current registry snapshot, and runs the commands of the destinations
+// that changed, or whose command failed since they last changed.
+func (r *Renderer) RenderAll() {
+	r.renderAll()
+}
+
+// renderAll implements RenderAll, and reports whether a command failed and must be retried.
+func (r *Renderer) renderAll() bool {
+	r.renderMutex.Lock()
+	defer r.renderMutex.Unlock()
+
+	logger := r.logger
+
+	workers := r.source.Snapshot()
+	data := Data{
+		Workers:        workers,
+		HealthyWorkers: make([]registry.Worker, 0, len(workers)),
+		GeneratedAt:    time.Now(),
+	}
+	for _, w := range workers {
+		if w.IsHealthy {
+			data.HealthyWorkers = append(data.HealthyWorkers, w)
+		}
+	}
+
+	pending := false
+	for _, t := range r.targets {
+		changed, err := t.render(data)
+		if err != nil {
+			logger.Error("", "Failed to render %s: %v", t.destination, err)
+			continue
+		}
+		if changed {
+			logger.Info("", "Rendered %s", t.destination)
+			t.reloadPending = true
+		} else if !t.reloadPending {
+			logger.Debug("", "%s is up to date", t.destination)
+			continue
+		}
+		if err := t.reload(logger); err != nil {
+			logger.Error("", "Reload command for %s failed, will retry: %v", t.destination, err)
+			pending = true
+			continue
+		}
+		t.reloadPending = false
+	}
+	return pending
+}
+
+// render executes the template and replaces the destination if its content changed. GeneratedAt is not a change:
+// the content is compared with the template executed at the time of the last write.
+func (t *target) render(data Data) (bool, error) {
+	current, err := os.ReadFile(t.destination)
+	exists := err == nil
+	if exists && !t.generatedAt.IsZero() {
+		previous := data
+		previous.GeneratedAt = t.generatedAt
+		var buf bytes.Buffer
+		if err := t.tmpl.Execute(&buf, previous); err != nil {
+			return false, err
+		}
+		if bytes.Equal(current, buf.Bytes()) {
+			return false, nil
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := t.tmpl.Execute(&buf, data); err != nil {
+		return false, err
+	}
+	if exists && bytes.Equal(current, buf.Bytes()) {
+		return false, nil
+	}
+
+	if err := writeFileAtomic(t.destination, buf.Bytes()); err != nil {
+		return false, err
+	}
+	t.generatedAt = data.GeneratedAt
+	return true, nil
+}
+
+// reload runs the configured command, if any.
+func (t *target) reload(logger *middleware.Logger) error {
+	if t.command == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.commandTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "/bin/sh", "-c", t.command).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(output))
+	}
+	logger.Debug("", "Reload command for %s succeeded: %s", t.destination, bytes.TrimSpace(output))
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it over path,
+// so readers never observe a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName) // No-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpName, mode); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, path)
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"registry-service/internal/auth"
+	"registry-service/internal/config"
+	"registry-service/internal/middleware"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// CreateKeyRequest is the body of POST /v1/admin/keys.
+type CreateKeyRequest struct {
+	Name      string   `json:"name"`
+	Key       string   `json:"key"` // Generated when empty
+	Scopes    []string `json:"scopes"`
+	ExpiresAt string   `json:"expires_at"`
+}
+
+// CreateKeyResponse describes the created key. The secret is only returned at creation.
+type CreateKeyResponse struct {
+	auth.KeyInfo
+	Key string `json:"key"`
+}
+
+// UpdateKeyRequest is the body of PATCH /v1/admin/keys/{name}.
+type UpdateKeyRequest struct {
+	ExpiresAt string `json:"expires_at"` // Empty to remove the expiry
+}
+
+// parseExpiry parses an optional RFC 3339 timestamp.
+func parseExpiry(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func listKeysHandler(w http.ResponseWriter, r *http.Request, authn *auth.Authenticator) {
+	writeJSON(w, r, http.StatusOK, authn.KeyStore().List())
+}
+
+func createKeyHandler(w http.ResponseWriter, r *http.Request, authn *auth.Authenticator) {
+	requestID := middleware.GetRequestIDFromContext(r.Context())
+
+	var req CreateKeyRequest
+	if err := middleware.DecodeJSON(r, &req); err != nil {
+		middleware.WriteBodyError(w, r, err)
+		return
+	}
+	scopes, err := auth.ParseScopes(req.Scopes)
+	if err != nil {
+		middleware.WriteError(w, r, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	expiresAt, err := parseExpiry(req.ExpiresAt)
+	if err != nil {
+		middleware.WriteError(w, r, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "Invalid expires_at: "+err.Error())
+		return
+	}
+	secret := req.Key
+	if secret == "" {
+		if secret, err = auth.GenerateSecret(); err != nil {
+			middleware.WriteError(w, r, http.StatusInternalServerError, middleware.ErrCodeInternal, "Failed to generate the key")
+			return
+		}
+	}
+
+	info, err := authn.KeyStore().Create(req.Name, secret, scopes, expiresAt)
+	if errors.Is(err, auth.ErrKeyExists) {
+		middleware.WriteError(w, r, http.StatusConflict, middleware.ErrCodeConflict, "Key "+req.Name+" already exists")
+		return
+	}
+	if errors.Is(err, auth.ErrInvalidKey) {
+		middleware.WriteError(w, r, http.StatusBadRequest, middleware.ErrCodeValidationFailed, "Invalid key", err.Error())
+		return
+	}
+	if err != nil {
+		middleware.WriteError(w, r, http.StatusInternalServerError, middleware.ErrCodeInternal, err.Error())
+		return
+	}
+
+	identity, _ := auth.IdentityFromContext(r.Context())
+	middleware.LoggerFromContext(r.Context()).Info(requestID, "API key %s created by %s", req.Name, identity)
+	writeJSON(w, r, http.StatusCreated, CreateKeyResponse{KeyInfo: info, Key: secret})
+}
+
+func updateKeyHandler(w http.ResponseWriter, r *http.Request, authn *auth.Authenticator) {
+	requestID := middleware.GetRequestIDFromContext(r.Context())
+	name := mux.Vars(r)["name"]
+
+	var req UpdateKeyRequest
+	if err := middleware.DecodeJSON(r, &req); err != nil {
+		middleware.WriteBodyError(w, r, err)
+		return
+	}
+	expiresAt, err := parseExpiry(req.ExpiresAt)
+	if err != nil {
+		middleware.WriteError(w, r, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "Invalid expires_at: "+err.Error())
+		return
+	}
+
+	info, err := authn.KeyStore().SetExpiry(name, expiresAt)
+	if errors.Is(err, auth.ErrKeyNotFound) {
+		middleware.WriteError(w, r, http.StatusNotFound, middleware.ErrCodeNotFound, "Key "+name+" does not exist")
+		return
+	}
+	if err != nil {
+		middleware.WriteError(w, r, http.StatusInternalServerError, middleware.ErrCodeInternal, err.Error())
+		return
+	}
+
+	identity, _ := auth.IdentityFromContext(r.Context())
+	middleware.LoggerFromContext(r.Context()).Info(requestID, "API key %s expiry set to %q by %s", name, req.ExpiresAt, identity)
+	writeJSON(w, r, http.StatusOK, info)
+}
+
+func revokeKeyHandler(w http.ResponseWriter, r *http.Request, authn *auth.Authenticator) {
+	requestID := middleware.GetRequestIDFromContext(r.Context())
+	name := mux.Vars(r)["name"]
+
+	err := authn.KeyStore().Revoke(name)
+	if errors.Is(err, auth.ErrKeyNotFound) {
+		middleware.WriteError(w, r, http.StatusNotFound, middleware.ErrCodeNotFound, "Key "+name+" does not exist")
+		return
+	}
+	if err != nil {
+		middleware.WriteError(w, r, http.StatusInternalServerError, middleware.ErrCodeInternal, err.Error())
+		return
+	}
+
+	identity, _ := auth.IdentityFromContext(r.Context())
+	middleware.LoggerFromContext(r.Context()).Info(requestID, "API key %s revoked by %s", name, identity)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// configHandler returns the effective configuration, with the reloaded fields and without the secrets.
+func configHandler(w http.ResponseWriter, r *http.Request, current func() config.Config) {
+	if current == nil {
+		middleware.WriteError(w, r, http.StatusNotFound, middleware.ErrCodeNotFound, "The configuration is not exposed")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, current().Redacted())
+}
+
+// setupAdminRoutes mounts the administration endpoints on the /v1 router.
+func setupAdminRoutes(v1 *mux.Router, validator *specValidator, opts Options) {
+	v1.HandleFunc("/admin/keys", validator.RequireScope(auth.ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+		listKeysHandler(w, r, opts.Authenticator)
+	})).Methods("GET")
+	v1.HandleFunc("/admin/keys", validator.RequireScope(auth.ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+		createKeyHandler(w, r, opts.Authenticator)
+	})).Methods("POST")
+	v1.HandleFunc("/admin/keys/{name}", validator.RequireScope(auth.ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+		updateKeyHandler(w, r, opts.Authenticator)
+	})).Methods("PATCH")
+	v1.HandleFunc("/admin/keys/{name}", validator.RequireScope(auth.ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+		revokeKeyHandler(w, r, opts.Authenticator)
+	})).Methods("DELETE")
+	v1.HandleFunc("/admin/config", validator.RequireScope(auth.ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+		configHandler(w, r, opts.Config)
+	})).Methods("GET")
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"registry-service/internal/config"
+	"registry-service/internal/middleware"
+	"registry-service/internal/observability"
+	"registry-service/internal/tlsutil"
+)
+
+// metricsPath is the path of the Prometheus metrics, on the metrics server and on the main server.
+const metricsPath = "/metrics"
+
+// StartMetricsServer starts the server of the Prometheus metrics on the configured address, over https when a
+// certificate is configured and behind basic authentication when credentials are. It returns the server, whose
+// Addr is the address it listens on, or nil when the server is disabled, i.e. the address is empty or none.
+// The channel receives the error of the server when it stops serving before it is closed, and is closed when the
+// server returns.
+func StartMetricsServer(cfg config.MetricsConfig, logger *middleware.Logger) (*http.Server, <-chan error, error) {
+	if cfg.Address == "" || cfg.Address == "none" {
+		return nil, nil, nil
+	}
+	address := cfg.Address
+
+	// The server has its own mux, so that it does not expose the handlers of the default one
+	metricsMux := http.NewServeMux()
+	handler := observability.MetricsHandler()
+	if cfg.Username != "" {
+		handler = basicAuth(cfg.Username, cfg.Password, handler)
+	}
+	metricsMux.Handle(metricsPath, handler)
+	srv := &http.Server{Handler: metricsMux}
+
+	if cfg.CertFile != "" {
+		tlsConfig, err := tlsutil.NewServerConfig(config.TLSConfig{CertFile: cfg.CertFile, KeyFile: cfg.KeyFile}, logger)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load the TLS configuration of the metrics server: %w", err)
+		}
+		srv.TLSConfig = tlsConfig
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, nil, err
+	}
+	srv.Addr = listener.Addr().String()
+
+	log.Printf("Starting metrics server on %s...", srv.Addr)
+	return srv, serve(srv, listener), nil
+}
+
+// serve serves the connections of listener in the background, over https when the server has a TLS configuration.
+// The channel receives the error of the server when it stops serving before it is closed, and is closed when the
+// server returns.
+func serve(srv *http.Server, listener net.Listener) <-chan error {
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		var err error
+		if srv.TLSConfig != nil {
+			// The certificate is provided by the TLS configuration
+			err = srv.ServeTLS(listener, "", "")
+		} else {
+			err = srv.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			errs <- err
+		}
+	}()
+	return errs
+}
+
+// basicAuth is a middleware that requires the credentials of the basic authentication scheme.
+func basicAuth(username string, password string, next http.Handler) http.Handler {
+	// The hashes have the same length whatever the credentials, so that the comparison takes a constant time
+	wantUser, wantPassword := sha256.Sum256([]byte(username)), sha256.Sum256([]byte(password))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		gotUser, gotPassword := sha256.Sum256([]byte(user)), sha256.Sum256([]byte(pass))
+		if !ok || subtle.ConstantTimeCompare(gotUser[:], wantUser[:])&subtle.ConstantTimeCompare(gotPassword[:], wantPassword[:]) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="metrics", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
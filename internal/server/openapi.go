@@ -0,0 +1,381 @@
+package server
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"registry-service/internal/auth"
+	"registry-service/internal/middleware"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// openAPISpec is the OpenAPI document of the /v1 API, served at /openapi.json and used to validate requests.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+const schemaRefPrefix = "#/components/schemas/"
+
+// schema is the subset of the OpenAPI schema object supported by the validator.
+type schema struct {
+	Ref                  string             `json:"$ref"`
+	Type                 string             `json:"type"`
+	Required             []string           `json:"required"`
+	Properties           map[string]*schema `json:"properties"`
+	AdditionalProperties *bool              `json:"additionalProperties"`
+	Items                *schema            `json:"items"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+	MinLength            *int               `json:"minLength"`
+	MaxLength            *int               `json:"maxLength"`
+	MinItems             *int               `json:"minItems"`
+	Pattern              string             `json:"pattern"`
+	Enum                 []interface{}      `json:"enum"`
+}
+
+type parameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required"`
+	Schema   *schema `json:"schema"`
+}
+
+type mediaType struct {
+	Schema *schema `json:"schema"`
+}
+
+type requestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]mediaType `json:"content"`
+}
+
+type operation struct {
+	Parameters  []parameter  `json:"parameters"`
+	RequestBody *requestBody `json:"requestBody"`
+}
+
+type openAPIDocument struct {
+	Servers []struct {
+		URL string `json:"url"`
+	} `json:"servers"`
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]*schema `json:"schemas"`
+	} `json:"components"`
+}
+
+// specValidator validates requests against the operations of an OpenAPI document.
+type specValidator struct {
+	operations map[string]*operation // Indexed by "METHOD /full/path/{template}"
+	schemas    map[string]*schema
+	patterns   map[string]*regexp.Regexp
+}
+
+// newSpecValidator parses an OpenAPI document.
+func newSpecValidator(spec []byte) (*specValidator, error) {
+	var doc openAPIDocument
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI document: %w", err)
+	}
+
+	basePath := ""
+	if len(doc.Servers) > 0 {
+		basePath = strings.TrimSuffix(doc.Servers[0].URL, "/")
+	}
+
+	v := &specValidator{
+		operations: make(map[string]*operation),
+		schemas:    doc.Components.Schemas,
+		patterns:   make(map[string]*regexp.Regexp),
+	}
+
+	for path, item := range doc.Paths {
+		var common []parameter
+		if raw, ok := item["parameters"]; ok {
+			if err := json.Unmarshal(raw, &common); err != nil {
+				return nil, fmt.Errorf("invalid parameters of %s: %w", path, err)
+			}
+		}
+		for method, raw := range item {
+			if method == "parameters" {
+				continue
+			}
+			var op operation
+			if err := json.Unmarshal(raw, &op); err != nil {
+				return nil, fmt.Errorf("invalid operation %s %s: %w", method, path, err)
+			}
+			op.Parameters = append(common, op.Parameters...)
+			v.operations[strings.ToUpper(method)+" "+basePath+path] = &op
+		}
+	}
+
+	// Compile the patterns once
+	var compile func(s *schema) error
+	compile = func(s *schema) error {
+		if s == nil {
+			return nil
+		}
+		if s.Pattern != "" {
+			re, err := regexp.Compile(s.Pattern)
+			if err != nil {
+				return fmt.Errorf("invalid pattern %q: %w", s.Pattern, err)
+			}
+			v.patterns[s.Pattern] = re
+		}
+		for _, p := range s.Properties {
+			if err := compile(p); err != nil {
+				return err
+			}
+		}
+		return compile(s.Items)
+	}
+	for _, s := range v.schemas {
+		if err := compile(s); err != nil {
+			return nil, err
+		}
+	}
+	for _, op := range v.operations {
+		for _, p := range op.Parameters {
+			if err := compile(p.Schema); err != nil {
+				return nil, err
+			}
+		}
+		if op.RequestBody != nil {
+			for _, media := range op.RequestBody.Content {
+				if err := compile(media.Schema); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	return v, nil
+}
+
+// RequireScope serves handler to the callers granted scope, once their request is validated by Middleware.
+// The scope is checked first so that the callers without it do not learn the request schema of the endpoint.
+func (v *specValidator) RequireScope(scope auth.Scope, handler http.HandlerFunc) http.HandlerFunc {
+	return middleware.RequireScope(scope, v.Middleware(handler).ServeHTTP)
+}
+
+// Middleware rejects the requests that do not match the OpenAPI operation of their route.
+// It must be installed on a mux router so that the route template is known.
+func (v *specValidator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if route == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		op, ok := v.operations[r.Method+" "+template]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var problems []string
+		query := r.URL.Query()
+		for _, p := range op.Parameters {
+			if p.In != "query" {
+				continue
+			}
+			values, present := query[p.Name]
+			if !present {
+				if p.Required {
+					problems = append(problems, fmt.Sprintf("query parameter %s is required", p.Name))
+				}
+				continue
+			}
+			v.validateParameter("query parameter "+p.Name, values[0], p.Schema, &problems)
+		}
+
+		if op.RequestBody != nil {
+			bodyBytes, err := io.ReadAll(r.Body)
+			if err != nil {
+				if middleware.IsBodyTooLarge(err) {
+					middleware.WriteBodyError(w, r, middleware.BodyError(err))
+					return
+				}
+				middleware.WriteError(w, r, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "Unable to read request body")
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+
+			if len(bytes.TrimSpace(bodyBytes)) == 0 {
+				if op.RequestBody.Required {
+					problems = append(problems, "request body is required")
+				}
+			} else if media, ok := op.RequestBody.Content["application/json"]; ok {
+				decoder := json.NewDecoder(bytes.NewReader(bodyBytes))
+				decoder.UseNumber()
+				var body interface{}
+				if err := decoder.Decode(&body); err != nil {
+					middleware.WriteBodyError(w, r, middleware.BodyError(err))
+					return
+				}
+				v.validate("body", body, media.Schema, &problems)
+			}
+		}
+
+		if len(problems) > 0 {
+			middleware.LoggerFromContext(r.Context()).Debug(middleware.GetRequestIDFromContext(r.Context()), "Request validation failed: %v", problems)
+			middleware.WriteError(w, r, http.StatusBadRequest, middleware.ErrCodeValidationFailed, "Request does not match the API specification", problems...)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validateParameter converts a query parameter to the type of its schema and validates it.
+func (v *specValidator) validateParameter(path string, raw string, s *schema, problems *[]string) {
+	s = v.resolve(s)
+	if s == nil {
+		return
+	}
+
+	var value interface{} = raw
+	switch s.Type {
+	case "boolean":
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			*problems = append(*problems, fmt.Sprintf("%s must be a boolean", path))
+			return
+		}
+		value = b
+	case "integer", "number":
+		value = json.Number(raw)
+	}
+	v.validate(path, value, s, problems)
+}
+
+// validate appends to problems every mismatch between value, decoded with json.Decoder.UseNumber, and the schema.
+func (v *specValidator) validate(path string, value interface{}, s *schema, problems *[]string) {
+	s = v.resolve(s)
+	if s == nil {
+		return
+	}
+
+	switch s.Type {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			*problems = append(*problems, fmt.Sprintf("%s must be an object", path))
+			return
+		}
+		for _, name := range s.Required {
+			if _, ok := obj[name]; !ok {
+				*problems = append(*problems, fmt.Sprintf("%s.%s is required", path, name))
+			}
+		}
+		names := make([]string, 0, len(obj))
+		for name := range obj {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			property, known := s.Properties[name]
+			if !known {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					*problems = append(*problems, fmt.Sprintf("%s.%s is not a known field", path, name))
+				}
+				continue
+			}
+			v.validate(path+"."+name, obj[name], property, problems)
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			*problems = append(*problems, fmt.Sprintf("%s must be an array", path))
+			return
+		}
+		if s.MinItems != nil && len(items) < *s.MinItems {
+			*problems = append(*problems, fmt.Sprintf("%s must have at least %d items", path, *s.MinItems))
+		}
+		for i, item := range items {
+			v.validate(fmt.Sprintf("%s[%d]", path, i), item, s.Items, problems)
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			*problems = append(*problems, fmt.Sprintf("%s must be a string", path))
+			return
+		}
+		length := utf8.RuneCountInString(str)
+		if s.MinLength != nil && length < *s.MinLength {
+			*problems = append(*problems, fmt.Sprintf("%s must be at least %d characters long", path, *s.MinLength))
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			*problems = append(*problems, fmt.Sprintf("%s must be at most %d characters long", path, *s.MaxLength))
+		}
+		if re, ok := v.patterns[s.Pattern]; ok && !re.MatchString(str) {
+			*problems = append(*problems, fmt.Sprintf("%s must match %s", path, s.Pattern))
+		}
+	case "integer", "number":
+		num, ok := value.(json.Number)
+		if !ok {
+			*problems = append(*problems, fmt.Sprintf("%s must be a %s", path, s.Type))
+			return
+		}
+		f, err := num.Float64()
+		if err != nil {
+			*problems = append(*problems, fmt.Sprintf("%s must be a %s", path, s.Type))
+			return
+		}
+		if s.Type == "integer" {
+			if _, err := num.Int64(); err != nil {
+				*problems = append(*problems, fmt.Sprintf("%s must be an integer", path))
+				return
+			}
+		}
+		if s.Minimum != nil && f < *s.Minimum {
+			*problems = append(*problems, fmt.Sprintf("%s must be greater than or equal to %v", path, *s.Minimum))
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			*problems = append(*problems, fmt.Sprintf("%s must be less than or equal to %v", path, *s.Maximum))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			*problems = append(*problems, fmt.Sprintf("%s must be a boolean", path))
+			return
+		}
+	}
+
+	if len(s.Enum) > 0 {
+		for _, allowed := range s.Enum {
+			if fmt.Sprint(allowed) == fmt.Sprint(value) {
+				return
+			}
+		}
+		*problems = append(*problems, fmt.Sprintf("%s must be one of %v", path, s.Enum))
+	}
+}
+
+// resolve follows a reference to a component schema.
+func (v *specValidator) resolve(s *schema) *schema {
+	for s != nil && s.Ref != "" {
+		s = v.schemas[strings.TrimPrefix(s.Ref, schemaRefPrefix)]
+	}
+	return s
+}
+
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(openAPISpec); err != nil {
+		middleware.LoggerFromContext(r.Context()).Debug(middleware.GetRequestIDFromContext(r.Context()), "Error writing response: %v", err)
+	}
+}
@@ -2,19 +2,27 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"registry-service/internal/auth"
+	"registry-service/internal/config"
+	"registry-service/internal/consul"
 	"registry-service/internal/middleware"
 	"registry-service/internal/observability"
+	"registry-service/internal/ratelimit"
 	"registry-service/internal/registry"
-	"strings"
+	"registry-service/internal/tlsutil"
+	"strconv"
 
 	"github.com/gorilla/mux"
 )
 
 func healthcheckHandler(w http.ResponseWriter, r *http.Request) {
 	requestID := middleware.GetRequestIDFromContext(r.Context())
-	logger := middleware.GetLogger()
+	logger := middleware.LoggerFromContext(r.Context())
 	logger.Debug(requestID, "Handling /healthcheck request")
 
 	w.WriteHeader(http.StatusOK)
@@ -25,30 +33,48 @@ func healthcheckHandler(w http.ResponseWriter, r *http.Request) {
 
 func registerHandler(w http.ResponseWriter, r *http.Request, reg *registry.Registry) {
 	requestID := middleware.GetRequestIDFromContext(r.Context())
-	logger := middleware.GetLogger()
+	logger := middleware.LoggerFromContext(r.Context())
 	logger.Debug(requestID, "Handling /register request")
 
-	remoteAddr := r.RemoteAddr
-	ip := remoteAddr
-	if colonIndex := strings.LastIndex(remoteAddr, ":"); colonIndex != -1 {
-		ip = remoteAddr[:colonIndex]
-	}
-
 	var requestData struct {
 		ID       string `json:"id"`
+		Host     string `json:"host"` // Only accepted from trusted sources, defaults to the address of the caller
 		HTTPPort int32  `json:"httpport"`
 		GRPCPort int32  `json:"grpcport"`
 	}
 
-	err := json.NewDecoder(r.Body).Decode(&requestData)
+	if err := middleware.DecodeJSON(r, &requestData); err != nil {
+		middleware.WriteBodyError(w, r, err)
+		logger.Debug(requestID, "Invalid request body: %v", err)
+		return
+	}
+
+	ip, err := middleware.RequestWorkerHost(r, requestData.Host)
 	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		logger.Debug(requestID, "Invalid request body")
+		writeRegistryError(w, r, requestData.ID, err)
 		return
 	}
 
 	logger.Debug(requestID, "Worker ID : %s\n\tIP : %s\n\tHTTP Port : %d\n\tGRPC Port : %d\n", requestData.ID, ip, requestData.HTTPPort, requestData.GRPCPort)
-	reg.RegisterWorker(requestData.ID, ip, requestData.HTTPPort, requestData.GRPCPort)
+	token, override, err := middleware.WorkerToken(r, requestData.ID)
+	if err != nil {
+		writeRegistryError(w, r, requestData.ID, err)
+		return
+	}
+	_, issued, err := reg.Register(r.Context(), registry.Registration{
+		ID:       requestData.ID,
+		Host:     ip,
+		HTTPPort: requestData.HTTPPort,
+		GRPCPort: requestData.GRPCPort,
+		Token:    token,
+	}, override)
+	if err != nil {
+		writeRegistryError(w, r, requestData.ID, err)
+		return
+	}
+	if issued != "" {
+		w.Header().Set(middleware.WorkerTokenHeader, issued)
+	}
 
 	w.WriteHeader(http.StatusOK)
 	if _, err := w.Write([]byte("Worker registered")); err != nil {
@@ -56,24 +82,47 @@ func registerHandler(w http.ResponseWriter, r *http.Request, reg *registry.Regis
 	}
 }
 
+// writeRegistryError writes the error returned by the registry for an operation on a worker.
+func writeRegistryError(w http.ResponseWriter, r *http.Request, id string, err error) {
+	var validationErr *registry.ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		middleware.WriteError(w, r, http.StatusBadRequest, middleware.ErrCodeValidationFailed, "Invalid registration", validationErr.Problems...)
+	case errors.Is(err, registry.ErrTokenMismatch):
+		middleware.WriteError(w, r, http.StatusForbidden, middleware.ErrCodeForbidden, "Worker "+id+" is bound to another token")
+	case errors.Is(err, middleware.ErrUntrustedHost):
+		middleware.WriteError(w, r, http.StatusForbidden, middleware.ErrCodeForbidden, err.Error())
+	case errors.Is(err, middleware.ErrInvalidHost):
+		middleware.WriteError(w, r, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, err.Error())
+	case errors.Is(err, auth.ErrWorkerIdentityMismatch):
+		middleware.WriteError(w, r, http.StatusForbidden, middleware.ErrCodeForbidden, "The client certificate does not name worker "+id)
+	case errors.Is(err, registry.ErrInvalidToken):
+		middleware.WriteError(w, r, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "The worker token must be at least "+strconv.Itoa(registry.MinTokenLength)+" characters long")
+	case errors.Is(err, registry.ErrWorkerNotFound):
+		middleware.WriteError(w, r, http.StatusNotFound, middleware.ErrCodeNotFound, "Worker "+id+" is not registered")
+	default:
+		middleware.WriteError(w, r, http.StatusInternalServerError, middleware.ErrCodeInternal, err.Error())
+	}
+}
+
 type HealthResponse struct {
 	HealthStatus string `json:"health_status"`
 }
 
 func workerHealthHandler(w http.ResponseWriter, r *http.Request, reg *registry.Registry) {
 	requestID := middleware.GetRequestIDFromContext(r.Context())
-	logger := middleware.GetLogger()
+	logger := middleware.LoggerFromContext(r.Context())
 
 	url := r.URL.Query().Get("address")
 	if url == "" {
-		http.Error(w, "Missing address", http.StatusBadRequest)
+		middleware.WriteError(w, r, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "Missing address")
 		return
 	}
 	logger.Debug(requestID, "Handling /worker/health request for address : %s", url)
 
 	bIsHealthy, found := reg.GetWorkerHealth(url)
 	if !found {
-		http.NotFound(w, r)
+		middleware.WriteError(w, r, http.StatusNotFound, middleware.ErrCodeNotFound, "No worker registered at "+url)
 		return
 	}
 
@@ -85,6 +134,7 @@ func workerHealthHandler(w http.ResponseWriter, r *http.Request, reg *registry.R
 		HealthStatus: health_status,
 	}
 
+	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(data); err != nil {
 		logger.Debug(requestID, "Error encoding response: %v", err)
 	}
@@ -92,58 +142,149 @@ func workerHealthHandler(w http.ResponseWriter, r *http.Request, reg *registry.R
 
 func healthyWorkersHandler(w http.ResponseWriter, r *http.Request, reg *registry.Registry) {
 	requestID := middleware.GetRequestIDFromContext(r.Context())
-	logger := middleware.GetLogger()
+	logger := middleware.LoggerFromContext(r.Context())
 	logger.Debug(requestID, "Handling /workers/healthy request")
 
 	addresses := reg.GetHealthyWorkersURL()
+	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(addresses); err != nil {
 		logger.Debug(requestID, "Error encoding response: %v", err)
 	}
 }
 
-func setupRoutes(router *mux.Router, reg *registry.Registry) {
-	router.HandleFunc("/healthcheck", healthcheckHandler).Methods("GET")
-	router.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	middleware.WriteError(w, r, http.StatusNotFound, middleware.ErrCodeNotFound, "No endpoint at "+r.URL.Path)
+}
+
+func methodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	middleware.WriteError(w, r, http.StatusMethodNotAllowed, middleware.ErrCodeMethodNotAllowed, "Method "+r.Method+" is not allowed on "+r.URL.Path)
+}
+
+// setupRoutes mounts the unversioned endpoints, kept for existing workers, the /v1 API validated by validator and
+// the Consul compatible API.
+func setupRoutes(router *mux.Router, reg *registry.Registry, validator *specValidator, opts Options) {
+	router.HandleFunc("/openapi.json", middleware.RequireScope(auth.ScopeRead, openAPIHandler)).Methods("GET")
+	router.HandleFunc("/healthcheck", middleware.RequireScope(auth.ScopeRead, healthcheckHandler)).Methods("GET")
+	router.HandleFunc("/register", middleware.RequireScope(auth.ScopeRegister, func(w http.ResponseWriter, r *http.Request) {
 		registerHandler(w, r, reg)
-	}).Methods("POST")
-	router.HandleFunc("/worker/health", func(w http.ResponseWriter, r *http.Request) {
+	})).Methods("POST")
+	router.HandleFunc("/worker/health", middleware.RequireScope(auth.ScopeRead, func(w http.ResponseWriter, r *http.Request) {
 		workerHealthHandler(w, r, reg)
-	}).Methods("GET")
-	router.HandleFunc("/workers/healthy", func(w http.ResponseWriter, r *http.Request) {
+	})).Methods("GET")
+	router.HandleFunc("/workers/healthy", middleware.RequireScope(auth.ScopeRead, func(w http.ResponseWriter, r *http.Request) {
 		healthyWorkersHandler(w, r, reg)
-	}).Methods("GET")
+	})).Methods("GET")
+
+	if opts.MountMetrics {
+		router.HandleFunc(metricsPath, middleware.RequireScope(auth.ScopeRead, observability.MetricsHandler().ServeHTTP)).Methods("GET")
+	}
+
+	// Consul compatible catalog, health and agent endpoints
+	consul.NewAPI(reg, opts.ConsulDatacenter).RegisterRoutes(router)
+
+	setupV1Routes(router, reg, validator, opts)
 }
 
-func setupMiddleware(router *mux.Router) {
-	router.Use(middleware.RequestID)
-	router.Use(middleware.LoggerMiddleware)
-	router.Use(middleware.AuthMiddleware)
-	router.Use(observability.MetricsMiddleware)
+// setupMiddleware installs the middlewares of the routes. gorilla/mux serves the requests matching no route without
+// them, so the not found and method not allowed handlers are wrapped in the same ones, but the authentication:
+// those requests are answered the same whatever their credentials.
+func setupMiddleware(router *mux.Router, opts Options) {
+	common := []mux.MiddlewareFunc{
+		middleware.UseLogger(opts.Logger.Component("http")),
+		middleware.UseTrustedNetworks(opts.TrustedNetworks),
+		middleware.RequestID,
+		middleware.Tracing,
+		opts.Metrics.Middleware, // Measures the rejected requests too
+		middleware.ErrorHandler,
+		opts.Limiter.ClientIPMiddleware,
+		middleware.MaxBodySize(opts.MaxBodyBytes),
+		middleware.LoggerMiddleware,
+	}
+	router.Use(common...)
+	router.Use(middleware.Authenticate(opts.Authenticator))
+	router.Use(opts.Limiter.IdentityMiddleware)
+
+	router.NotFoundHandler = chain(http.HandlerFunc(notFoundHandler), common)
+	router.MethodNotAllowedHandler = chain(http.HandlerFunc(methodNotAllowedHandler), common)
+}
+
+// chain wraps handler in the middlewares, the first one being the outermost like with Router.Use.
+func chain(handler http.Handler, middlewares []mux.MiddlewareFunc) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
 }
 
-func startHTTPServer(srv *http.Server, ready chan struct{}) {
-	log.Printf("Starting HTTP server on %s...", srv.Addr)
+// startHTTPServer listens on the address of the server and serves its connections in the background.
+func startHTTPServer(srv *http.Server, ready chan struct{}) (<-chan error, error) {
+	listener, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if srv.TLSConfig != nil {
+		log.Printf("Starting HTTPS server on %s...", srv.Addr)
+	} else {
+		log.Printf("Starting HTTP server on %s...", srv.Addr)
+	}
 	close(ready)
-	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("HTTP server stopped: %v", err)
-		}
-	}()
+	return serve(srv, listener), nil
+}
+
+// Options are the settings and the dependencies of an HTTP server. Several servers with different options may run
+// in the same process.
+type Options struct {
+	Port             string
+	TLS              config.TLSConfig
+	MaxBodyBytes     int64
+	ConsulDatacenter string // Defaults to dc1
+	Logger           *middleware.Logger
+	Authenticator    *auth.Authenticator
+	Limiter          *ratelimit.Limiter             // Nil to disable rate limiting
+	TrustedNetworks  *middleware.TrustedNetworks    // Nil to trust no proxy nor source
+	Config           func() config.Config           // The effective configuration exposed to administrators, nil to hide it
+	MountMetrics     bool                           // Serves GET /metrics to the callers with the read scope
+	Metrics          *observability.RegistryMetrics // Records the requests, defaults to the metrics of the registry
 }
 
-// StartServer starts the HTTP server for the registry service and returns the server instance.
-func StartServer(reg *registry.Registry, router *mux.Router, ready chan struct{}, port string) *http.Server {
-	setupMiddleware(router)
-	setupRoutes(router, reg)
+// StartServer starts the HTTP server for the registry service and returns the server instance. The channel
+// receives the error of the server when it stops serving before it is closed, and is closed when the server returns.
+func StartServer(reg *registry.Registry, router *mux.Router, ready chan struct{}, opts Options) (*http.Server, <-chan error, error) {
+	if opts.Authenticator == nil {
+		return nil, nil, errors.New("the HTTP server requires an authenticator")
+	}
+	if opts.ConsulDatacenter == "" {
+		opts.ConsulDatacenter = "dc1"
+	}
+	if opts.Metrics == nil {
+		opts.Metrics = observability.NewRegistryMetrics("")
+		if reg != nil {
+			opts.Metrics = reg.Metrics()
+		}
+	}
+	validator, err := newSpecValidator(openAPISpec)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load the OpenAPI document: %w", err)
+	}
 
 	srv := &http.Server{
-		Addr:    ":" + port,
+		Addr:    ":" + opts.Port,
 		Handler: router,
 	}
+	if opts.TLS.CertFile != "" {
+		tlsConfig, err := tlsutil.NewServerConfig(opts.TLS, opts.Logger)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load the TLS configuration: %w", err)
+		}
+		srv.TLSConfig = tlsConfig
+	}
 
-	startHTTPServer(srv, ready)
-
-	go observability.ServeMetrics(":9090")
+	setupMiddleware(router, opts)
+	setupRoutes(router, reg, validator, opts)
 
-	return srv
+	errs, err := startHTTPServer(srv, ready)
+	if err != nil {
+		return nil, nil, err
+	}
+	return srv, errs, nil
 }
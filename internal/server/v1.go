@@ -0,0 +1,201 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"registry-service/internal/auth"
+	"registry-service/internal/middleware"
+	"registry-service/internal/registry"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// WorkerResponse is the representation of a worker in the /v1 API.
+type WorkerResponse struct {
+	ID              string    `json:"id"`
+	Service         string    `json:"service"`
+	Tags            []string  `json:"tags"`
+	Host            string    `json:"host"`
+	Addresses       []string  `json:"addresses,omitempty"` // Resolved addresses when the host is a hostname
+	HTTPPort        int32     `json:"httpport"`
+	GRPCPort        int32     `json:"grpcport"`
+	Healthy         bool      `json:"healthy"`
+	LastHealthCheck time.Time `json:"last_health_check"`
+}
+
+// RegisterResponse is the body of a successful registration. The token is only returned when the
+// registry issued one, on the first registration of the worker ID.
+type RegisterResponse struct {
+	WorkerResponse
+	Token string `json:"token,omitempty"`
+}
+
+// StatusResponse is the body of /v1/healthcheck.
+type StatusResponse struct {
+	Status string `json:"status"`
+}
+
+// RegisterRequest is the body of the registration endpoints.
+type RegisterRequest struct {
+	ID       string   `json:"id"`
+	Service  string   `json:"service"`
+	Tags     []string `json:"tags"`
+	Host     string   `json:"host"` // Only accepted from trusted sources, defaults to the address of the caller
+	HTTPPort int32    `json:"httpport"`
+	GRPCPort int32    `json:"grpcport"`
+}
+
+func newWorkerResponse(worker registry.Worker) WorkerResponse {
+	tags := worker.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	return WorkerResponse{
+		ID:              worker.ID,
+		Service:         worker.Service,
+		Tags:            tags,
+		Host:            worker.Host,
+		Addresses:       worker.Addresses,
+		HTTPPort:        worker.HTTPPort,
+		GRPCPort:        worker.GRPCPort,
+		Healthy:         worker.IsHealthy,
+		LastHealthCheck: worker.LastHealthCheck,
+	}
+}
+
+// writeJSON writes data as a JSON response with the given status.
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		middleware.LoggerFromContext(r.Context()).Debug(middleware.GetRequestIDFromContext(r.Context()), "Error encoding response: %v", err)
+	}
+}
+
+func v1HealthcheckHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, StatusResponse{Status: "healthy"})
+}
+
+func v1RegisterHandler(w http.ResponseWriter, r *http.Request, reg *registry.Registry) {
+	requestID := middleware.GetRequestIDFromContext(r.Context())
+	logger := middleware.LoggerFromContext(r.Context())
+	logger.Debug(requestID, "Handling /v1/register request")
+
+	var req RegisterRequest
+	if err := middleware.DecodeJSON(r, &req); err != nil {
+		middleware.WriteBodyError(w, r, err)
+		return
+	}
+
+	host, err := middleware.RequestWorkerHost(r, req.Host)
+	if err != nil {
+		writeRegistryError(w, r, req.ID, err)
+		return
+	}
+	token, override, err := middleware.WorkerToken(r, req.ID)
+	if err != nil {
+		writeRegistryError(w, r, req.ID, err)
+		return
+	}
+	worker, issued, err := reg.Register(r.Context(), registry.Registration{
+		ID:       req.ID,
+		Service:  req.Service,
+		Tags:     req.Tags,
+		Host:     host,
+		HTTPPort: req.HTTPPort,
+		GRPCPort: req.GRPCPort,
+		Token:    token,
+	}, override)
+	if err != nil {
+		writeRegistryError(w, r, req.ID, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, RegisterResponse{WorkerResponse: newWorkerResponse(worker), Token: issued})
+}
+
+func v1ListWorkersHandler(w http.ResponseWriter, r *http.Request, reg *registry.Registry) {
+	query := r.URL.Query()
+	service := query.Get("service")
+	healthyOnly := query.Get("healthy") == "true" || query.Get("healthy") == "1"
+
+	workers := make([]WorkerResponse, 0)
+	for _, worker := range reg.Snapshot() {
+		if service != "" && worker.Service != service {
+			continue
+		}
+		if healthyOnly && !worker.IsHealthy {
+			continue
+		}
+		workers = append(workers, newWorkerResponse(worker))
+	}
+	writeJSON(w, r, http.StatusOK, workers)
+}
+
+func v1GetWorkerHandler(w http.ResponseWriter, r *http.Request, reg *registry.Registry) {
+	id := mux.Vars(r)["id"]
+	worker, found := reg.GetWorker(id)
+	if !found {
+		middleware.WriteError(w, r, http.StatusNotFound, middleware.ErrCodeNotFound, "Worker "+id+" is not registered")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, newWorkerResponse(worker))
+}
+
+func v1DeregisterHandler(w http.ResponseWriter, r *http.Request, reg *registry.Registry) {
+	id := mux.Vars(r)["id"]
+	token, override, err := middleware.WorkerToken(r, id)
+	if err == nil {
+		err = reg.DeregisterWorker(r.Context(), id, token, override)
+	}
+	if err != nil {
+		writeRegistryError(w, r, id, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func v1HeartbeatHandler(w http.ResponseWriter, r *http.Request, reg *registry.Registry) {
+	id := mux.Vars(r)["id"]
+	token, override, err := middleware.WorkerToken(r, id)
+	if err != nil {
+		writeRegistryError(w, r, id, err)
+		return
+	}
+	worker, err := reg.Heartbeat(r.Context(), id, token, override)
+	if err != nil {
+		writeRegistryError(w, r, id, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, newWorkerResponse(worker))
+}
+
+// setupV1Routes mounts the versioned API, validated against the OpenAPI document by validator.
+func setupV1Routes(router *mux.Router, reg *registry.Registry, validator *specValidator, opts Options) {
+	v1 := router.PathPrefix("/v1").Subrouter()
+
+	v1.HandleFunc("/healthcheck", validator.RequireScope(auth.ScopeRead, v1HealthcheckHandler)).Methods("GET")
+	v1.HandleFunc("/register", validator.RequireScope(auth.ScopeRegister, func(w http.ResponseWriter, r *http.Request) {
+		v1RegisterHandler(w, r, reg)
+	})).Methods("POST")
+	v1.HandleFunc("/workers", validator.RequireScope(auth.ScopeRead, func(w http.ResponseWriter, r *http.Request) {
+		v1ListWorkersHandler(w, r, reg)
+	})).Methods("GET")
+	v1.HandleFunc("/workers/healthy", validator.RequireScope(auth.ScopeRead, func(w http.ResponseWriter, r *http.Request) {
+		healthyWorkersHandler(w, r, reg)
+	})).Methods("GET")
+	v1.HandleFunc("/workers/{id}", validator.RequireScope(auth.ScopeRead, func(w http.ResponseWriter, r *http.Request) {
+		v1GetWorkerHandler(w, r, reg)
+	})).Methods("GET")
+	v1.HandleFunc("/workers/{id}", validator.RequireScope(auth.ScopeRegister, func(w http.ResponseWriter, r *http.Request) {
+		v1DeregisterHandler(w, r, reg)
+	})).Methods("DELETE")
+	v1.HandleFunc("/workers/{id}/heartbeat", validator.RequireScope(auth.ScopeRegister, func(w http.ResponseWriter, r *http.Request) {
+		v1HeartbeatHandler(w, r, reg)
+	})).Methods("POST")
+	v1.HandleFunc("/worker/health", validator.RequireScope(auth.ScopeRead, func(w http.ResponseWriter, r *http.Request) {
+		workerHealthHandler(w, r, reg)
+	})).Methods("GET")
+
+	setupAdminRoutes(v1, validator, opts)
+}
@@ -0,0 +1,216 @@
+// Package tlsutil builds the TLS configurations of the registry from certificate files,
+// reloading the files when they change so that certificates can be renewed without a restart.
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"registry-service/internal/config"
+	"registry-service/internal/middleware"
+	"sync"
+	"time"
+)
+
+const defaultReloadInterval = 5 * time.Second
+
+// Client authentication modes of the server
+const (
+	ClientAuthNone    = "none"
+	ClientAuthRequest = "request"
+	ClientAuthRequire = "require"
+)
+
+// reloader keeps a certificate and a CA pool loaded from files, reloading them when their modification time changes.
+// The files are checked at most once per interval, when a TLS handshake needs them.
+type reloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	interval time.Duration
+	logger   *middleware.Logger
+
+	mutex     sync.Mutex
+	cert      *tls.Certificate
+	pool      *x509.CertPool
+	modTimes  map[string]time.Time
+	checkedAt time.Time
+}
+
+func newReloader(certFile string, keyFile string, caFile string, intervalMs int, logger *middleware.Logger) (*reloader, error) {
+	r := &reloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+		interval: defaultReloadInterval,
+		logger:   logger.Component("tls"),
+		modTimes: make(map[string]time.Time),
+	}
+	if intervalMs > 0 {
+		r.interval = time.Duration(intervalMs) * time.Millisecond
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	r.checkedAt = time.Now()
+	return r, nil
+}
+
+// load reads the files. Must be called with the mutex held, or before the reloader is shared.
+func (r *reloader) load() error {
+	modTimes := make(map[string]time.Time)
+	for _, file := range []string{r.certFile, r.keyFile, r.caFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	var cert *tls.Certificate
+	if r.certFile != "" {
+		c, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load certificate: %w", err)
+		}
+		cert = &c
+	}
+
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		var err error
+		if pool, err = LoadCertPool(r.caFile); err != nil {
+			return err
+		}
+	}
+
+	r.cert, r.pool, r.modTimes = cert, pool, modTimes
+	return nil
+}
+
+// current returns the certificate and CA pool, reloading them first if the files changed.
+// A failed reload is logged and the previous files are kept.
+func (r *reloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if time.Since(r.checkedAt) >= r.interval {
+		r.checkedAt = time.Now()
+		if r.changed() {
+			if err := r.load(); err != nil {
+				r.logger.Warn("", "Failed to reload the certificates, keeping the previous ones: %v", err)
+			} else {
+				r.logger.Info("", "Reloaded the certificates")
+			}
+		}
+	}
+	return r.cert, r.pool
+}
+
+// changed must be called with the mutex held.
+func (r *reloader) changed() bool {
+	for file, modTime := range r.modTimes {
+		info, err := os.Stat(file)
+		if err != nil || !info.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadCertPool reads a PEM bundle of CA certificates.
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in CA bundle %s", file)
+	}
+	return pool, nil
+}
+
+// NewServerConfig returns the TLS configuration of the HTTP and gRPC servers, negotiating HTTP/2 or HTTP/1.1.
+// The certificate and the client CA bundle are reloaded when their files change, for the connections accepted
+// afterwards, and the reloads are logged.
+func NewServerConfig(cfg config.TLSConfig, logger *middleware.Logger) (*tls.Config, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, errors.New("tls: cert_file and key_file are required")
+	}
+
+	var clientAuth tls.ClientAuthType
+	switch cfg.ClientAuth {
+	case "", ClientAuthNone:
+		clientAuth = tls.NoClientCert
+	case ClientAuthRequest:
+		clientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		clientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("tls: unknown client_auth %q", cfg.ClientAuth)
+	}
+	if clientAuth != tls.NoClientCert && cfg.ClientCAFile == "" {
+		return nil, errors.New("tls: client_ca_file is required to verify client certificates")
+	}
+
+	r, err := newReloader(cfg.CertFile, cfg.KeyFile, cfg.ClientCAFile, cfg.ReloadIntervalMs, logger)
+	if err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: clientAuth,
+		// The configuration of the handshake replaces the one of the server, which declares the protocols
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// The client CAs cannot be swapped through a callback, so every handshake gets a configuration built
+		// from the current files
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := r.current()
+			c := base.Clone()
+			c.Certificates = []tls.Certificate{*cert}
+			c.ClientCAs = pool
+			return c, nil
+		},
+	}, nil
+}
+
+// NewClientConfig returns the TLS configuration of a client verifying the servers with the CA bundle, or the system
+// roots when caFile is empty, and presenting the client certificate when certFile is set. The client certificate
+// is reloaded when its files change, and the reloads are logged.
+func NewClientConfig(caFile string, certFile string, keyFile string, serverName string, logger *middleware.Logger) (*tls.Config, error) {
+	c := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+	}
+	if caFile != "" {
+		pool, err := LoadCertPool(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+		c.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("tls: both the client certificate and key are required")
+		}
+		r, err := newReloader(certFile, keyFile, "", 0, logger)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+		c.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			return cert, nil
+		}
+	}
+	return c, nil
+}
@@ -2,13 +2,23 @@ package integration
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"encoding/pem"
+	"fmt"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"registry-service/internal/auth"
 	"registry-service/internal/config"
+	"registry-service/internal/consul"
 	"registry-service/internal/database"
+	"registry-service/internal/grpcserver"
+	"registry-service/internal/grpcserver/registrypb"
 	"registry-service/internal/middleware"
+	"registry-service/internal/observability"
 	"registry-service/internal/registry"
 	"registry-service/internal/server"
 	"testing"
@@ -16,21 +26,39 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 // Test Setup:
 // - The init function ensures that configuration settings are loaded from the config.json file before tests are executed.
+var (
+	testConfig        config.Config
+	testLogger        *middleware.Logger
+	testAuthenticator *auth.Authenticator
+)
+
 func init() {
 	// Load the configuration from the config file
-	config.LoadConfig("config.json")
-	// Initialize the logger
-	middleware.InitLogger(config.AppConfig.LogLevel)
+	var err error
+	if testConfig, err = config.Load("config.json", nil); err != nil {
+		log.Fatalf("Failed to load config file: %v", err)
+	}
+	// Create the logger
+	testLogger = middleware.NewLogger(testConfig.LogLevel)
+	// Load the API keys
+	if testAuthenticator, err = auth.NewAuthenticator(testConfig); err != nil {
+		log.Fatalf("Failed to load API keys: %v", err)
+	}
 }
 
 // - setupIntegrationDB initializes a clean database state for integration tests.
 func setupIntegrationDB(t *testing.T) *database.MongoDB {
 	// Connect to the MongoDB instance
-	db, err := database.NewMongoDB(config.AppConfig.DB.URI, config.AppConfig.DB.Name, config.AppConfig.DB.Collection)
+	db, err := database.NewMongoDB(testConfig.DB.URI, testConfig.DB.Name, testConfig.DB.Collection, testLogger)
 	assert.NoError(t, err, "Failed to connect to test database")
 
 	// Clear the existing collection to start fresh
@@ -40,13 +68,41 @@ func setupIntegrationDB(t *testing.T) *database.MongoDB {
 	return db
 }
 
+// - newTestRegistry creates a registry with the check interval of the test configuration.
+func newTestRegistry(t *testing.T, db *database.MongoDB, opts registry.Options) *registry.Registry {
+	if opts.CheckInterval == 0 {
+		opts.CheckInterval = time.Duration(testConfig.CheckIntervalMs) * time.Millisecond
+	}
+	opts.Logger = testLogger
+	reg, err := registry.New(db, opts)
+	if err != nil {
+		t.Fatalf("Failed to create the registry: %v", err)
+	}
+	return reg
+}
+
+// - testServerOptions returns the options of a server authenticating the keys of the test configuration.
+func testServerOptions() server.Options {
+	return server.Options{
+		MaxBodyBytes:  testConfig.MaxBodyBytes,
+		Logger:        testLogger,
+		Authenticator: testAuthenticator,
+	}
+}
+
 // - setupTestServer starts a test HTTP server for the registry service.
-func setupTestServer(db *database.MongoDB) (*httptest.Server, *registry.Registry) {
-	checkInterval := time.Duration(config.AppConfig.CheckIntervalMs) * time.Millisecond
-	reg := registry.NewRegistry(db, checkInterval)
+func setupTestServer(t *testing.T, db *database.MongoDB) (*httptest.Server, *registry.Registry) {
+	return setupTestServerWithOptions(t, db, testServerOptions())
+}
+
+// - setupTestServerWithOptions starts a test HTTP server for the registry service with the options.
+func setupTestServerWithOptions(t *testing.T, db *database.MongoDB, opts server.Options) (*httptest.Server, *registry.Registry) {
+	reg := newTestRegistry(t, db, registry.Options{})
 
 	router := mux.NewRouter()
-	server.StartServer(reg, router, make(chan struct{}), "")
+	if _, _, err := server.StartServer(reg, router, make(chan struct{}), opts); err != nil {
+		t.Fatalf("Failed to start the server: %v", err)
+	}
 
 	return httptest.NewServer(router), reg
 }
@@ -86,16 +142,16 @@ func TestIntegrationRegisterWorker(t *testing.T) {
 	db := setupIntegrationDB(t)
 	defer db.Disconnect()
 
-	ts, _ := setupTestServer(db)
+	ts, _ := setupTestServer(t, db)
 	defer ts.Close()
 
 	ip := "127.0.0.1"
-	resp, err := registerWorker(ts.URL, "workerID-test-1", 1234, 4321, config.AppConfig.APIKey)
+	resp, err := registerWorker(ts.URL, "workerID-test-1", 1234, 4321, testConfig.APIKey)
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
 
 	// Verify worker is registered in the database
-	workers, err := db.GetAllWorkers()
+	workers, err := db.GetAllWorkers(context.Background())
 	assert.NoError(t, err)
 	assert.Len(t, workers, 1)
 	assert.Equal(t, ip, workers[0]["host"])
@@ -108,7 +164,7 @@ func TestIntegrationGetWorkerHealth(t *testing.T) {
 	db := setupIntegrationDB(t)
 	defer db.Disconnect()
 
-	ts, reg := setupTestServer(db)
+	ts, reg := setupTestServer(t, db)
 	defer ts.Close()
 
 	address := "1.2.3.4"
@@ -119,7 +175,7 @@ func TestIntegrationGetWorkerHealth(t *testing.T) {
 	assert.NoError(t, err)
 
 	// Include API Key in the request header
-	req.Header.Set("X-API-Key", config.AppConfig.APIKey)
+	req.Header.Set("X-API-Key", testConfig.APIKey)
 
 	resp, err := http.DefaultClient.Do(req)
 	assert.NoError(t, err)
@@ -138,7 +194,7 @@ func TestIntegrationGetHealthyWorkers(t *testing.T) {
 	db := setupIntegrationDB(t)
 	defer db.Disconnect()
 
-	ts, reg := setupTestServer(db)
+	ts, reg := setupTestServer(t, db)
 	defer ts.Close()
 
 	address := "1.2.3.4"
@@ -149,7 +205,7 @@ func TestIntegrationGetHealthyWorkers(t *testing.T) {
 	assert.NoError(t, err)
 
 	// Include API Key in the request header
-	req.Header.Set("X-API-Key", config.AppConfig.APIKey)
+	req.Header.Set("X-API-Key", testConfig.APIKey)
 
 	resp, err := http.DefaultClient.Do(req)
 	assert.NoError(t, err)
@@ -169,7 +225,7 @@ func TestIntegrationHealthCheckLoop(t *testing.T) {
 	db := setupIntegrationDB(t)
 	defer db.Disconnect()
 
-	ts, reg := setupTestServer(db)
+	ts, reg := setupTestServer(t, db)
 	defer ts.Close()
 
 	// Start a mock server to simulate the worker
@@ -199,7 +255,7 @@ func TestIntegrationHealthCheckLoop(t *testing.T) {
 	assert.NoError(t, err)
 
 	// Include API Key in the request header
-	req.Header.Set("X-API-Key", config.AppConfig.APIKey)
+	req.Header.Set("X-API-Key", testConfig.APIKey)
 
 	resp, err := http.DefaultClient.Do(req)
 	assert.NoError(t, err)
@@ -212,3 +268,389 @@ func TestIntegrationHealthCheckLoop(t *testing.T) {
 
 	db.ClearCollection()
 }
+
+// TestIntegrationConsulHealthService tests the Consul compatible health endpoint, including blocking queries.
+func TestIntegrationConsulHealthService(t *testing.T) {
+	db := setupIntegrationDB(t)
+	defer db.Disconnect()
+
+	ts, reg := setupTestServer(t, db)
+	defer ts.Close()
+
+	reg.RegisterServiceWorker("workerID-test-5", "web", []string{"v1"}, "1.2.3.4", 80, 0)
+
+	req, err := http.NewRequest("GET", ts.URL+"/v1/health/service/web?passing", nil)
+	assert.NoError(t, err)
+	req.Header.Set("X-Consul-Token", testConfig.APIKey)
+
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var entries []consul.ServiceEntry
+	err = json.NewDecoder(resp.Body).Decode(&entries)
+	resp.Body.Close()
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "1.2.3.4", entries[0].Service.Address)
+	assert.Equal(t, 80, entries[0].Service.Port)
+	assert.Equal(t, "passing", entries[0].Checks[0].Status)
+
+	// A blocking query returns as soon as the registry changes
+	index := resp.Header.Get("X-Consul-Index")
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		reg.RegisterServiceWorker("workerID-test-6", "web", nil, "1.2.3.5", 80, 0)
+	}()
+
+	req, err = http.NewRequest("GET", ts.URL+"/v1/health/service/web?index="+index+"&wait=10s", nil)
+	assert.NoError(t, err)
+	req.Header.Set("X-Consul-Token", testConfig.APIKey)
+
+	start := time.Now()
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second, "Blocking query should return on change")
+	assert.NotEqual(t, index, resp.Header.Get("X-Consul-Index"))
+
+	err = json.NewDecoder(resp.Body).Decode(&entries)
+	resp.Body.Close()
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+
+	db.ClearCollection()
+}
+
+// TestIntegrationGRPCRegisterAndWatch tests the registration of a worker through the gRPC API and the Watch stream.
+func TestIntegrationGRPCRegisterAndWatch(t *testing.T) {
+	db := setupIntegrationDB(t)
+	defer db.Disconnect()
+
+	reg := newTestRegistry(t, db, registry.Options{})
+	defer reg.StopHealthCheck()
+
+	srv, _, err := grpcserver.StartServer(reg, grpcserver.Options{Port: "50551", Logger: testLogger, Authenticator: testAuthenticator})
+	assert.NoError(t, err)
+	defer srv.Stop()
+
+	conn, err := grpc.NewClient("localhost:50551", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.NoError(t, err)
+	defer conn.Close()
+	client := registrypb.NewRegistryServiceClient(conn)
+
+	// Calls without the API key are rejected
+	_, err = client.ListWorkers(context.Background(), &registrypb.ListWorkersRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", testConfig.APIKey)
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	stream, err := client.Watch(ctx, &registrypb.WatchRequest{Service: "grpc-test"})
+	assert.NoError(t, err)
+	initial, err := stream.Recv()
+	assert.NoError(t, err)
+	assert.Empty(t, initial.Workers)
+
+	resp, err := client.Register(ctx, &registrypb.RegisterRequest{Id: "workerID-test-7", Service: "grpc-test", HttpPort: 8080, GrpcPort: 9090})
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", resp.Worker.Host)
+
+	update, err := stream.Recv()
+	assert.NoError(t, err)
+	assert.Greater(t, update.Index, initial.Index)
+	assert.Len(t, update.Workers, 1)
+	assert.Equal(t, "workerID-test-7", update.Workers[0].Id)
+
+	_, err = client.Heartbeat(ctx, &registrypb.HeartbeatRequest{Id: "unknown"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	db.ClearCollection()
+}
+
+// TestIntegrationWorkerTokens tests that a worker ID is bound to the token issued at its first registration.
+func TestIntegrationWorkerTokens(t *testing.T) {
+	db := setupIntegrationDB(t)
+	defer db.Disconnect()
+
+	authn, err := auth.NewAuthenticator(config.Config{
+		APIKey: "legacy-secret",
+		APIKeys: []config.APIKeyConfig{
+			{Name: "workers", Key: "workers-secret", Scopes: []string{"register"}},
+			{Name: "operator", Key: "operator-secret", Scopes: []string{"register", "override"}},
+		},
+	})
+	assert.NoError(t, err)
+
+	opts := testServerOptions()
+	opts.Authenticator = authn
+	ts, _ := setupTestServerWithOptions(t, db, opts)
+	defer ts.Close()
+
+	sendAs := func(apiKey string, method string, path string, body string, token string) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+path, bytes.NewBufferString(body))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-Key", apiKey)
+		if token != "" {
+			req.Header.Set("X-Worker-Token", token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		return resp
+	}
+	send := func(method string, path string, body string, token string) *http.Response {
+		return sendAs("workers-secret", method, path, body, token)
+	}
+
+	resp := send("POST", "/v1/register", `{"id": "workerID-test-8", "httpport": 8080}`, "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var registered server.RegisterResponse
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&registered))
+	resp.Body.Close()
+	assert.NotEmpty(t, registered.Token, "A token should be issued on the first registration")
+
+	// Another holder of the API key cannot take over the worker ID
+	resp = send("POST", "/v1/register", `{"id": "workerID-test-8", "httpport": 9999}`, "")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp = send("POST", "/v1/workers/workerID-test-8/heartbeat", "", "stolen-token-0123456789")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp = send("DELETE", "/v1/workers/workerID-test-8", "", "")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// Nor can the holders of the legacy api_key, although it has the admin scope
+	resp = sendAs("legacy-secret", "POST", "/v1/register", `{"id": "workerID-test-8", "httpport": 9999}`, "")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp = sendAs("legacy-secret", "POST", "/v1/workers/workerID-test-8/heartbeat", "", "")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp = sendAs("legacy-secret", "DELETE", "/v1/workers/workerID-test-8", "", "")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// A key granted the override scope may act on the worker without its token
+	resp = sendAs("operator-secret", "POST", "/v1/workers/workerID-test-8/heartbeat", "", "")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The worker itself can
+	resp = send("POST", "/v1/workers/workerID-test-8/heartbeat", "", registered.Token)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = send("DELETE", "/v1/workers/workerID-test-8", "", registered.Token)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	// A pre-provisioned token is not returned
+	resp = send("POST", "/register", `{"id": "workerID-test-9", "httpport": 8080}`, "provisioned-token-0123456789")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("X-Worker-Token"))
+	resp = send("POST", "/register", `{"id": "workerID-test-9", "httpport": 8080}`, "provisioned-token-0123456789")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	db.ClearCollection()
+}
+
+// TestIntegrationHTTPSProbe verifies that workers are probed over https with the probe credential instead of the API key.
+func TestIntegrationHTTPSProbe(t *testing.T) {
+	db := setupIntegrationDB(t)
+	defer db.Disconnect()
+
+	var credential, apiKey, probeID string
+	mockWorker := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		credential, apiKey = r.Header.Get("Authorization"), r.Header.Get("X-API-Key")
+		probeID = r.Header.Get(middleware.RequestIDHeader)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer mockWorker.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: mockWorker.Certificate().Raw}), 0600)
+	assert.NoError(t, err)
+
+	reg := newTestRegistry(t, db, registry.Options{
+		CheckInterval: time.Hour,
+		Probe:         config.ProbeConfig{Scheme: "https", CAFile: caFile, Header: "Authorization", Credential: "Bearer probe-secret"},
+	})
+	defer reg.StopHealthCheck()
+
+	host, port, err := middleware.GetHostAndPortFromURL(mockWorker.URL)
+	assert.NoError(t, err)
+	reg.RegisterWorker("workerID-test-10", host, port, 0)
+
+	reg.CheckAllWorkers()
+
+	worker, found := reg.GetWorker("workerID-test-10")
+	assert.True(t, found, "The worker should pass the https health check")
+	assert.True(t, worker.IsHealthy)
+	assert.Equal(t, "Bearer probe-secret", credential)
+	assert.Empty(t, apiKey, "The API key of the registry should not be sent to the workers")
+	assert.True(t, middleware.ValidRequestID(probeID), "Each probe should carry its own ID")
+
+	db.ClearCollection()
+}
+
+// TestIntegrationHostnameWorker verifies that workers registered with a hostname are resolved, checked at each
+// of their addresses and listed at their healthy ones.
+func TestIntegrationHostnameWorker(t *testing.T) {
+	db := setupIntegrationDB(t)
+	defer db.Disconnect()
+
+	var hostHeader string
+	mockWorker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hostHeader = r.Host
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer mockWorker.Close()
+
+	reg := newTestRegistry(t, db, registry.Options{CheckInterval: time.Hour, ResolveInterval: time.Hour})
+	defer reg.StopHealthCheck()
+
+	_, port, err := middleware.GetHostAndPortFromURL(mockWorker.URL)
+	assert.NoError(t, err)
+	reg.RegisterWorker("workerID-test-11", "localhost", port, 0)
+
+	reg.ResolveAllWorkers()
+	worker, _ := reg.GetWorker("workerID-test-11")
+	assert.Contains(t, worker.Addresses, "127.0.0.1", "localhost should be resolved")
+
+	// The mock worker only listens on 127.0.0.1: any other address of localhost fails the check and is dropped
+	reg.CheckAllWorkers()
+
+	worker, found := reg.GetWorker("workerID-test-11")
+	assert.True(t, found, "The worker should pass the health check at one of its addresses")
+	assert.Equal(t, []string{"127.0.0.1"}, worker.Addresses)
+	assert.Equal(t, fmt.Sprintf("localhost:%d", port), hostHeader, "The hostname should be sent in the Host header")
+	assert.Equal(t, []string{fmt.Sprintf("127.0.0.1:%d", port)}, reg.GetHealthyWorkersURL())
+
+	db.ClearCollection()
+}
+
+// metricValue returns the value of the counter or gauge name with the labels, 0 when there is no such series.
+func metricValue(t *testing.T, name string, labels map[string]string) float64 {
+	families, err := observability.Gatherer().Gather()
+	assert.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, metric := range family.GetMetric() {
+			for _, pair := range metric.GetLabel() {
+				if value, ok := labels[pair.GetName()]; ok && value != pair.GetValue() {
+					continue metrics
+				}
+			}
+			if metric.Counter != nil {
+				return metric.Counter.GetValue()
+			}
+			return metric.Gauge.GetValue()
+		}
+	}
+	return 0
+}
+
+// TestIntegrationProbeMetrics verifies that the failed probes are counted by reason, and that the series of the
+// workers evicted after failing them are removed.
+func TestIntegrationProbeMetrics(t *testing.T) {
+	db := setupIntegrationDB(t)
+	defer db.Disconnect()
+
+	// The worker recovers after failing two probes
+	probes := 0
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if probes++; probes <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer flaky.Close()
+	stopped := httptest.NewServer(http.NotFoundHandler())
+	stopped.Close() // Its port refuses the connections
+
+	reg := newTestRegistry(t, db, registry.Options{CheckInterval: time.Hour})
+	defer reg.StopHealthCheck()
+
+	for id, url := range map[string]string{"workerID-test-12": flaky.URL, "workerID-test-13": stopped.URL} {
+		host, port, err := middleware.GetHostAndPortFromURL(url)
+		assert.NoError(t, err)
+		reg.RegisterWorker(id, host, port, 0)
+	}
+	evicted := map[string]string{"id": "workerID-test-13"}
+	assert.Equal(t, 1.0, metricValue(t, "worker_health_status", evicted))
+	evictions := metricValue(t, "worker_evictions_total", nil)
+
+	reg.CheckAllWorkers()
+
+	assert.Equal(t, 2.0, metricValue(t, "health_probe_failures_total", map[string]string{"worker": "workerID-test-12", "reason": "non_200"}))
+	assert.Equal(t, 1.0, metricValue(t, "worker_health_status", map[string]string{"id": "workerID-test-12"}))
+	assert.Equal(t, evictions+1, metricValue(t, "worker_evictions_total", nil))
+	assert.Equal(t, 0.0, metricValue(t, "worker_health_status", evicted), "The series of the evicted worker should be removed")
+	assert.Equal(t, 0.0, metricValue(t, "health_probe_failures_total", map[string]string{"worker": "workerID-test-13", "reason": "refused"}))
+
+	db.ClearCollection()
+}
+
+// TestIntegrationWorkerMetricsLifecycle verifies that the health status of a worker follows its address, that it
+// is removed on deregistration, and that a new registry reports the workers loaded from the database only.
+func TestIntegrationWorkerMetricsLifecycle(t *testing.T) {
+	db := setupIntegrationDB(t)
+	defer db.Disconnect()
+
+	reg := newTestRegistry(t, db, registry.Options{CheckInterval: time.Hour})
+	reg.RegisterWorker("workerID-test-14", "127.0.0.1", 8081, 0)
+	reg.RegisterWorker("workerID-test-14", "127.0.0.2", 8081, 0)
+	assert.Equal(t, 0.0, metricValue(t, "worker_health_status", map[string]string{"id": "workerID-test-14", "address": "http://127.0.0.1:8081"}))
+	assert.Equal(t, 1.0, metricValue(t, "worker_health_status", map[string]string{"id": "workerID-test-14", "address": "http://127.0.0.2:8081"}))
+
+	reg.RegisterWorker("workerID-test-15", "127.0.0.1", 8082, 0)
+	assert.NoError(t, reg.DeregisterWorker(context.Background(), "workerID-test-15", "", true))
+	assert.Equal(t, 0.0, metricValue(t, "worker_health_status", map[string]string{"id": "workerID-test-15"}))
+	reg.StopHealthCheck()
+
+	// The series of the workers unknown to the database are dropped when a registry starts, but not the series
+	// of the other registries of the process
+	observability.NewRegistryMetrics(db.Namespace()).RecordWorkerHealth("workerID-test-16", "http://127.0.0.1:8083", true)
+	observability.NewRegistryMetrics("other.workers").RecordWorkerHealth("workerID-test-17", "http://127.0.0.1:8084", true)
+	reg = newTestRegistry(t, db, registry.Options{CheckInterval: time.Hour})
+	defer reg.StopHealthCheck()
+	assert.Equal(t, 0.0, metricValue(t, "worker_health_status", map[string]string{"id": "workerID-test-16"}))
+	assert.Equal(t, 1.0, metricValue(t, "worker_health_status", map[string]string{"registry": "other.workers", "id": "workerID-test-17"}))
+	assert.Equal(t, 1.0, metricValue(t, "worker_health_status", map[string]string{"id": "workerID-test-14", "address": "http://127.0.0.2:8081"}))
+
+	db.ClearCollection()
+}
+
+// TestIntegrationHeartbeatRecovery verifies that a worker brought back by a heartbeat is counted as healthy in the
+// registry size.
+func TestIntegrationHeartbeatRecovery(t *testing.T) {
+	db := setupIntegrationDB(t)
+	defer db.Disconnect()
+
+	reg := newTestRegistry(t, db, registry.Options{CheckInterval: time.Hour})
+	defer reg.StopHealthCheck()
+
+	_, token, err := reg.Register(context.Background(), registry.Registration{ID: "workerID-test-18", Service: "recovery", Host: "127.0.0.1", HTTPPort: 8085}, false)
+	assert.NoError(t, err)
+	size := func(state string) float64 {
+		return metricValue(t, "registry_workers", map[string]string{"registry": db.Namespace(), "service": "recovery", "state": state})
+	}
+
+	reg.UpdateHealth(context.Background(), "workerID-test-18", false)
+	assert.Equal(t, 1.0, size("unhealthy"))
+	assert.Equal(t, 0.0, size("healthy"))
+
+	_, err = reg.Heartbeat(context.Background(), "workerID-test-18", token, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 0.0, size("unhealthy"))
+	assert.Equal(t, 1.0, size("healthy"), "The worker should be counted as healthy after its heartbeat")
+
+	db.ClearCollection()
+}
@@ -0,0 +1,225 @@
+package unit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"registry-service/internal/auth"
+	"registry-service/internal/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestKeyStoreFromConfig verifies that keys are loaded from the legacy api_key, the api_keys entries
+// and the hashed key file, with their scopes.
+func TestKeyStoreFromConfig(t *testing.T) {
+	keysFile := filepath.Join(t.TempDir(), "keys.json")
+	content := `[{"name": "dashboard", "key_sha256": "` + auth.HashKey("dashboard-secret") + `", "scopes": ["read"]}]`
+	if err := os.WriteFile(keysFile, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write keys file: %v", err)
+	}
+
+	store, err := auth.NewKeyStoreFromConfig(config.Config{
+		APIKey: "legacy-secret",
+		APIKeys: []config.APIKeyConfig{
+			{Name: "workers", Key: "workers-secret", Scopes: []string{"register"}},
+		},
+		APIKeysFile: keysFile,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, store.Len())
+
+	identity, ok := store.Authenticate("legacy-secret")
+	assert.True(t, ok)
+	assert.Equal(t, auth.DefaultKeyName, identity.Name)
+	assert.True(t, identity.HasScope(auth.ScopeRegister), "The admin scope grants every scope")
+	assert.False(t, identity.HasScope(auth.ScopeOverride), "The admin scope does not grant the override scope")
+
+	identity, ok = store.Authenticate("workers-secret")
+	assert.True(t, ok)
+	assert.Equal(t, "workers", identity.Name)
+	assert.True(t, identity.HasScope(auth.ScopeRegister))
+	assert.False(t, identity.HasScope(auth.ScopeRead))
+
+	identity, ok = store.Authenticate("dashboard-secret")
+	assert.True(t, ok)
+	assert.Equal(t, "dashboard", identity.Name)
+	assert.True(t, identity.HasScope(auth.ScopeRead))
+
+	_, ok = store.Authenticate("unknown-secret")
+	assert.False(t, ok)
+	_, ok = store.Authenticate("")
+	assert.False(t, ok)
+}
+
+// TestKeyStoreRejectsInvalidKeys verifies that misconfigured keys are reported.
+func TestKeyStoreRejectsInvalidKeys(t *testing.T) {
+	_, err := auth.NewKeyStoreFromConfig(config.Config{APIKeys: []config.APIKeyConfig{{Name: "k", Key: "s", Scopes: []string{"write"}}}})
+	assert.Error(t, err, "Unknown scopes should be rejected")
+
+	_, err = auth.NewKeyStoreFromConfig(config.Config{APIKeys: []config.APIKeyConfig{{Name: "k", KeySHA256: "not-hex", Scopes: []string{"read"}}}})
+	assert.Error(t, err, "Invalid hashes should be rejected")
+
+	_, err = auth.NewKeyStoreFromConfig(config.Config{APIKeys: []config.APIKeyConfig{
+		{Name: "k", Key: "s1", Scopes: []string{"read"}},
+		{Name: "k", Key: "s2", Scopes: []string{"read"}},
+	}})
+	assert.Error(t, err, "Duplicate names should be rejected")
+}
+
+// TestWorkerOverride verifies that only the credentials granted the override scope, and the client certificates on
+// the IDs they name, may act on a worker without its token: the legacy api_key shared by the workers may not.
+func TestWorkerOverride(t *testing.T) {
+	store, err := auth.NewKeyStoreFromConfig(config.Config{
+		APIKey:  "legacy-secret",
+		APIKeys: []config.APIKeyConfig{{Name: "operator", Key: "operator-secret", Scopes: []string{"register", "override"}}},
+	})
+	assert.NoError(t, err)
+
+	legacy, _ := store.Authenticate("legacy-secret")
+	override, err := legacy.WorkerOverride("worker-1")
+	assert.NoError(t, err)
+	assert.False(t, override, "The default api_key should not bypass the worker tokens")
+
+	operator, _ := store.Authenticate("operator-secret")
+	override, err = operator.WorkerOverride("worker-1")
+	assert.NoError(t, err)
+	assert.True(t, override)
+
+	cert := &auth.Identity{Name: "worker-1", Method: auth.MethodClientCert, Scopes: []auth.Scope{auth.ScopeRegister}, Subjects: []string{"worker-1"}}
+	override, err = cert.WorkerOverride("worker-1")
+	assert.NoError(t, err)
+	assert.True(t, override)
+	_, err = cert.WorkerOverride("worker-2")
+	assert.ErrorIs(t, err, auth.ErrWorkerIdentityMismatch)
+
+	var anonymous *auth.Identity
+	override, err = anonymous.WorkerOverride("worker-1")
+	assert.NoError(t, err)
+	assert.False(t, override)
+}
+
+// TestScopeEnforcement verifies that the routes require the scope matching their purpose.
+func TestScopeEnforcement(t *testing.T) {
+	authn, err := auth.NewAuthenticator(config.Config{APIKeys: []config.APIKeyConfig{{Name: "reader", Key: "reader-secret", Scopes: []string{"read"}}}})
+	assert.NoError(t, err)
+
+	opts := testServerOptions()
+	opts.Authenticator = authn
+	router := newTestRouter(opts)
+
+	req := httptest.NewRequest("POST", "/register", nil)
+	req.Header.Set("X-API-Key", "reader-secret")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	req = httptest.NewRequest("GET", "/v1/healthcheck", nil)
+	req.Header.Set("X-API-Key", "reader-secret")
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+// TestIndependentServers verifies that servers started with different credentials in the same process do not
+// share them.
+func TestIndependentServers(t *testing.T) {
+	routers := make(map[string]http.Handler)
+	for _, key := range []string{"first-secret", "second-secret"} {
+		authn, err := auth.NewAuthenticator(config.Config{APIKey: key})
+		assert.NoError(t, err)
+		opts := testServerOptions()
+		opts.Authenticator = authn
+		routers[key] = newTestRouter(opts)
+	}
+
+	for key, router := range routers {
+		for other := range routers {
+			req := httptest.NewRequest("GET", "/v1/healthcheck", nil)
+			req.Header.Set("X-API-Key", other)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if other == key {
+				assert.Equal(t, http.StatusOK, rec.Code)
+			} else {
+				assert.Equal(t, http.StatusUnauthorized, rec.Code, "The key of the other server should be rejected")
+			}
+		}
+	}
+}
+
+// TestKeyRotation verifies that keys created, expired and revoked at runtime are persisted across restarts.
+func TestKeyRotation(t *testing.T) {
+	cfg := config.Config{
+		APIKey:           "old-secret",
+		APIKeysStateFile: filepath.Join(t.TempDir(), "keys-state.json"),
+	}
+
+	store, err := auth.NewKeyStoreFromConfig(cfg)
+	assert.NoError(t, err)
+
+	// Overlap: the new key is added while the old one remains valid until its expiry
+	_, err = store.Create("new", "new-secret", []auth.Scope{auth.ScopeAdmin}, time.Time{})
+	assert.NoError(t, err)
+	_, err = store.Create("new", "other-secret", []auth.Scope{auth.ScopeRead}, time.Time{})
+	assert.ErrorIs(t, err, auth.ErrKeyExists)
+	_, err = store.Create("empty", "empty-secret", []auth.Scope{}, time.Time{})
+	assert.ErrorIs(t, err, auth.ErrInvalidKey, "A key without scope is a client error")
+
+	info, err := store.SetExpiry(auth.DefaultKeyName, time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	assert.False(t, info.Expired)
+	_, ok := store.Authenticate("old-secret")
+	assert.True(t, ok, "The old key should remain valid until it expires")
+
+	_, err = store.SetExpiry(auth.DefaultKeyName, time.Now().Add(-time.Second))
+	assert.NoError(t, err)
+	_, ok = store.Authenticate("old-secret")
+	assert.False(t, ok, "Expired keys should be rejected")
+
+	// The changes survive a restart
+	store, err = auth.NewKeyStoreFromConfig(cfg)
+	assert.NoError(t, err)
+	_, ok = store.Authenticate("old-secret")
+	assert.False(t, ok, "The expiry of the configured key should be persisted")
+	_, ok = store.Authenticate("new-secret")
+	assert.True(t, ok, "The key created at runtime should be persisted")
+
+	assert.NoError(t, store.Revoke("new"))
+	assert.ErrorIs(t, store.Revoke("new"), auth.ErrKeyNotFound)
+
+	store, err = auth.NewKeyStoreFromConfig(cfg)
+	assert.NoError(t, err)
+	_, ok = store.Authenticate("new-secret")
+	assert.False(t, ok, "The revocation should be persisted")
+	assert.Equal(t, 1, store.Len())
+}
+
+// TestReloadKeepsRuntimeChanges verifies that a reload of the configuration applies the configured keys without
+// undoing the keys revoked or created at runtime, even when they are not persisted.
+func TestReloadKeepsRuntimeChanges(t *testing.T) {
+	cfg := config.Config{APIKeys: []config.APIKeyConfig{
+		{Name: "revoked", Key: "revoked-secret", Scopes: []string{"read"}},
+		{Name: "kept", Key: "kept-secret", Scopes: []string{"read"}},
+	}}
+	authn, err := auth.NewAuthenticator(cfg)
+	assert.NoError(t, err)
+	store := authn.KeyStore()
+	assert.NoError(t, store.Revoke("revoked"))
+	_, err = store.Create("runtime", "runtime-secret", []auth.Scope{auth.ScopeRead}, time.Time{})
+	assert.NoError(t, err)
+
+	cfg.APIKeys = append(cfg.APIKeys, config.APIKeyConfig{Name: "added", Key: "added-secret", Scopes: []string{"read"}})
+	assert.NoError(t, authn.ReloadKeys(cfg))
+
+	_, ok := authn.KeyStore().Authenticate("revoked-secret")
+	assert.False(t, ok, "The key revoked at runtime should stay revoked")
+	for _, secret := range []string{"kept-secret", "runtime-secret", "added-secret"} {
+		_, ok = authn.KeyStore().Authenticate(secret)
+		assert.True(t, ok, secret)
+	}
+}
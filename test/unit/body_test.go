@@ -0,0 +1,70 @@
+package unit
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"registry-service/internal/middleware"
+	"registry-service/internal/registry"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRequestBodyLimit verifies that bodies larger than max_body_bytes are rejected with 413.
+func TestRequestBodyLimit(t *testing.T) {
+	opts := testServerOptions()
+	opts.MaxBodyBytes = 64
+	router := newTestRouter(opts)
+	body := `{"id": "worker-1", "httpport": 8080, "tags": ["` + strings.Repeat("a", 100) + `"]}`
+
+	rec := serve(router, "POST", "/v1/register", body)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	assert.Contains(t, rec.Body.String(), middleware.ErrCodePayloadTooLarge)
+
+	rec = serve(router, "POST", "/register", body)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+}
+
+// TestStrictDecoding verifies that unknown fields and mistyped values are rejected with a message naming them.
+func TestStrictDecoding(t *testing.T) {
+	router := newSpecTestRouter()
+
+	tests := []struct {
+		body    string
+		message string
+	}{
+		{`{"id": "worker-1", "httpport": 8080, "htpport": 8081}`, `unknown field "htpport"`},
+		{`{"id": "worker-1", "httpport": "8080"}`, "field httpport must be an integer, not string"},
+		{`{"id": "worker-1", "httpport": 8080`, "the JSON is truncated"},
+		{`{"id": "worker-1", "httpport": 8080} {}`, "unexpected data after the JSON object"},
+		{``, "the request body is empty"},
+	}
+	for _, test := range tests {
+		rec := serve(router, "POST", "/register", test.body)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, test.body)
+
+		var resp middleware.ErrorResponse
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		assert.Contains(t, resp.Error.Message, test.message, test.body)
+	}
+}
+
+// TestRegistrationValidation verifies that every problem of a registration is reported.
+func TestRegistrationValidation(t *testing.T) {
+	assert.NoError(t, registry.Registration{ID: "worker-1.eu:a@b", Service: "web", Host: "2001:db8::1", HTTPPort: 8080}.Validate())
+	assert.NoError(t, registry.Registration{ID: "worker-1", Host: "worker-1.example.com", HTTPPort: 65535, GRPCPort: 9090}.Validate())
+
+	err := registry.Registration{ID: "-worker 1", Service: "web/api", Host: "not a host", HTTPPort: 0, GRPCPort: 70000, Tags: []string{""}}.Validate()
+	var validationErr *registry.ValidationError
+	assert.ErrorAs(t, err, &validationErr)
+	assert.Len(t, validationErr.Problems, 6)
+
+	err = registry.Registration{ID: strings.Repeat("a", registry.MaxIDLength+1), Host: "1.2.3.4", HTTPPort: 80}.Validate()
+	assert.ErrorContains(t, err, "at most 128 characters")
+
+	rec := serve(newSpecTestRouter(), "POST", "/v1/register", `{"id": "worker 1", "httpport": 8080}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), middleware.ErrCodeValidationFailed)
+}
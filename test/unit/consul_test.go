@@ -0,0 +1,151 @@
+package unit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"registry-service/internal/auth"
+	"registry-service/internal/consul"
+	"registry-service/internal/registry"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeConsulSource is an in-memory consul.Source used to test the blocking queries without a database.
+type fakeConsulSource struct {
+	mutex   sync.Mutex
+	index   uint64
+	changed chan struct{}
+	workers []registry.Worker
+}
+
+func newFakeConsulSource(index uint64) *fakeConsulSource {
+	return &fakeConsulSource{index: index, changed: make(chan struct{})}
+}
+
+func (s *fakeConsulSource) Snapshot() []registry.Worker {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]registry.Worker(nil), s.workers...)
+}
+
+func (s *fakeConsulSource) Index() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.index
+}
+
+func (s *fakeConsulSource) WaitForChange(ctx context.Context, index uint64) uint64 {
+	for {
+		s.mutex.Lock()
+		current, changed := s.index, s.changed
+		s.mutex.Unlock()
+		if current > index {
+			return current
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return current
+		}
+	}
+}
+
+func (s *fakeConsulSource) Register(context.Context, registry.Registration, bool) (registry.Worker, string, error) {
+	return registry.Worker{}, "", nil
+}
+
+func (s *fakeConsulSource) DeregisterWorker(context.Context, string, string, bool) error {
+	return nil
+}
+
+// add registers a worker and wakes up the blocking queries.
+func (s *fakeConsulSource) add(worker registry.Worker) {
+	s.mutex.Lock()
+	s.workers = append(s.workers, worker)
+	s.index++
+	close(s.changed)
+	s.changed = make(chan struct{})
+	s.mutex.Unlock()
+}
+
+// newConsulRouter serves the Consul endpoints of the source.
+func newConsulRouter(src consul.Source) *mux.Router {
+	router := mux.NewRouter()
+	consul.NewAPI(src, "dc1").RegisterRoutes(router)
+	return router
+}
+
+// consulQuery runs a catalog request with a read identity and returns the response and its duration.
+func consulQuery(router http.Handler, query string) (*httptest.ResponseRecorder, time.Duration) {
+	req := httptest.NewRequest(http.MethodGet, "/v1/catalog/services"+query, nil)
+	req = req.WithContext(auth.WithIdentity(req.Context(), &auth.Identity{Name: "test", Scopes: []auth.Scope{auth.ScopeRead}}))
+	rr := httptest.NewRecorder()
+	start := time.Now()
+	router.ServeHTTP(rr, req)
+	return rr, time.Since(start)
+}
+
+// TestConsulBlockingQuery verifies that a blocking query returns on a change of the registry or when the wait elapses.
+func TestConsulBlockingQuery(t *testing.T) {
+	src := newFakeConsulSource(100)
+	router := newConsulRouter(src)
+
+	rr, elapsed := consulQuery(router, "?index=100&wait=50ms")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "100", rr.Header().Get("X-Consul-Index"))
+	assert.GreaterOrEqual(t, elapsed, 50*time.Millisecond, "The query should wait for a change")
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		src.add(registry.Worker{ID: "ID1", Service: "api"})
+	}()
+	rr, elapsed = consulQuery(router, "?index=100&wait=5s")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "101", rr.Header().Get("X-Consul-Index"))
+	assert.Contains(t, rr.Body.String(), `"api"`)
+	assert.Less(t, elapsed, time.Second, "The query should return on the change")
+
+	rr, elapsed = consulQuery(router, "?index=100")
+	assert.Equal(t, "101", rr.Header().Get("X-Consul-Index"))
+	assert.Less(t, elapsed, time.Second, "An older index should be answered at once")
+}
+
+// TestConsulIndexReset verifies that an index greater than the one of the registry, as held by a client across a
+// restart, is answered at once with the current index so that the client resets it.
+func TestConsulIndexReset(t *testing.T) {
+	src := newFakeConsulSource(100)
+	router := newConsulRouter(src)
+
+	rr, elapsed := consulQuery(router, "?index=500&wait=5s")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "100", rr.Header().Get("X-Consul-Index"))
+	assert.Less(t, elapsed, time.Second)
+}
+
+// TestConsulWaitParsing verifies the index and wait parameters of the blocking queries.
+func TestConsulWaitParsing(t *testing.T) {
+	router := newConsulRouter(newFakeConsulSource(100))
+
+	for _, query := range []string{"?index=abc", "?index=-1", "?index=100&wait=soon", "?index=100&wait=-1s"} {
+		rr, _ := consulQuery(router, query)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, query)
+	}
+
+	// A bare number is a number of seconds
+	rr, elapsed := consulQuery(router, "?index=100&wait=1")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.GreaterOrEqual(t, elapsed, time.Second)
+	assert.Less(t, elapsed, 5*time.Second)
+
+	// Without index, the query does not block
+	rr, elapsed = consulQuery(router, "?wait=5s")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "100", rr.Header().Get("X-Consul-Index"))
+	assert.Less(t, elapsed, time.Second)
+}
@@ -0,0 +1,74 @@
+package unit
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"path/filepath"
+	"testing"
+
+	"registry-service/internal/config"
+	"registry-service/internal/grpcserver"
+	"registry-service/internal/grpcserver/registrypb"
+	"registry-service/internal/tlsutil"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// TestGRPCTLS verifies that the gRPC server serves the TLS configuration, authenticates the verified client
+// certificates like the HTTP server, and reports its stop on the error channel.
+func TestGRPCTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile, caFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.crt")
+	serverCert, serverKey := ca.issue(t, 10, "localhost")
+	writeFile(t, certFile, serverCert)
+	writeFile(t, keyFile, serverKey)
+	writeFile(t, caFile, ca.pem)
+
+	// The registry is not reached: the calls are rejected by the authentication
+	srv, errs, err := grpcserver.StartServer(nil, grpcserver.Options{
+		Port: "50561",
+		TLS: config.TLSConfig{
+			CertFile:     certFile,
+			KeyFile:      keyFile,
+			ClientCAFile: caFile,
+			ClientAuth:   tlsutil.ClientAuthRequest,
+		},
+		Logger:        testLogger,
+		Authenticator: testAuthenticator,
+	})
+	assert.NoError(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.pem)
+	clientCert, clientKey := ca.issue(t, 20, "worker-1")
+	pair, err := tls.X509KeyPair(clientCert, clientKey)
+	assert.NoError(t, err)
+	newClient := func(certificates ...tls.Certificate) registrypb.RegistryServiceClient {
+		conn, err := grpc.NewClient("localhost:50561", grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{RootCAs: roots, Certificates: certificates})))
+		assert.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return registrypb.NewRegistryServiceClient(conn)
+	}
+
+	_, err = newClient().ListWorkers(context.Background(), &registrypb.ListWorkersRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), "A connection without certificate nor key should be rejected")
+
+	// The client certificates are granted the register scope only
+	_, err = newClient(pair).ListWorkers(context.Background(), &registrypb.ListWorkersRequest{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Contains(t, status.Convert(err).Message(), "read scope")
+
+	_, err = newClient(pair).Heartbeat(context.Background(), &registrypb.HeartbeatRequest{Id: "worker-2"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "The certificate does not name worker-2")
+
+	srv.Stop()
+	err, open := <-errs
+	assert.NoError(t, err)
+	assert.False(t, open, "The channel should be closed without error once the server is stopped")
+}
@@ -0,0 +1,170 @@
+package unit
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"registry-service/internal/auth"
+	"registry-service/internal/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testSigner signs tokens with an RSA key published in a local JWKS.
+type testSigner struct {
+	key *rsa.PrivateKey
+	kid string
+}
+
+func newTestSigner(t *testing.T, kid string) *testSigner {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate the key: %v", err)
+	}
+	return &testSigner{key: key, kid: kid}
+}
+
+// jwks returns the JSON Web Key Set publishing the public key of the signers.
+func jwks(signers ...*testSigner) []byte {
+	keys := make([]map[string]string, 0, len(signers))
+	for _, s := range signers {
+		keys = append(keys, map[string]string{
+			"kty": "RSA",
+			"kid": s.kid,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(s.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(s.key.E)).Bytes()),
+		})
+	}
+	data, _ := json.Marshal(map[string]interface{}{"keys": keys})
+	return data
+}
+
+// sign returns an RS256 token carrying the claims.
+func (s *testSigner) sign(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": s.kid})
+	payload, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// TestJWTValidation verifies the signature and claims checks and the mapping of claims to scopes.
+func TestJWTValidation(t *testing.T) {
+	signer := newTestSigner(t, "key-1")
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(jwksFile, jwks(signer), 0600); err != nil {
+		t.Fatalf("Failed to write JWKS: %v", err)
+	}
+
+	validator, err := auth.NewJWTValidator(config.JWTConfig{
+		JWKSFile:     jwksFile,
+		Issuer:       "https://idp.example.com",
+		Audience:     "registry",
+		ScopeClaim:   "groups",
+		ScopeMapping: map[string][]string{"dashboards": {"read"}, "operators": {"read", "admin"}},
+	})
+	assert.NoError(t, err)
+
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"sub":    "grafana",
+			"iss":    "https://idp.example.com",
+			"aud":    []string{"registry", "other"},
+			"exp":    time.Now().Add(time.Hour).Unix(),
+			"groups": []string{"dashboards", "operators"},
+		}
+	}
+
+	identity, err := validator.Authenticate(signer.sign(valid()))
+	assert.NoError(t, err)
+	assert.Equal(t, "grafana", identity.Name)
+	assert.Equal(t, auth.MethodJWT, identity.Method)
+	assert.Equal(t, []auth.Scope{auth.ScopeRead}, identity.Scopes, "Only the read scope is allowed by default")
+
+	claims := valid()
+	claims["exp"] = time.Now().Add(-time.Hour).Unix()
+	_, err = validator.Authenticate(signer.sign(claims))
+	assert.ErrorIs(t, err, auth.ErrTokenExpired)
+
+	claims = valid()
+	claims["aud"] = "other"
+	_, err = validator.Authenticate(signer.sign(claims))
+	assert.ErrorIs(t, err, auth.ErrInvalidToken, "Tokens for another audience should be rejected")
+
+	claims = valid()
+	claims["iss"] = "https://evil.example.com"
+	_, err = validator.Authenticate(signer.sign(claims))
+	assert.ErrorIs(t, err, auth.ErrInvalidToken, "Tokens from another issuer should be rejected")
+
+	forger := newTestSigner(t, "key-1")
+	_, err = validator.Authenticate(forger.sign(valid()))
+	assert.ErrorIs(t, err, auth.ErrInvalidToken, "Tokens signed by another key should be rejected")
+
+	// alg none must never be accepted
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"key-1"}`))
+	payload, _ := json.Marshal(valid())
+	_, err = validator.Authenticate(header + "." + base64.RawURLEncoding.EncodeToString(payload) + ".")
+	assert.ErrorIs(t, err, auth.ErrInvalidToken)
+}
+
+// TestJWTBearerAuthentication verifies that bearer tokens, verified with a key set fetched from its URL,
+// are accepted next to API keys with the scopes of their claims.
+func TestJWTBearerAuthentication(t *testing.T) {
+	signer := newTestSigner(t, "key-1")
+	published := jwks(signer)
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(published)
+	}))
+	defer idp.Close()
+
+	cfg := testConfig
+	cfg.JWT = config.JWTConfig{JWKSURL: idp.URL}
+	authn, err := auth.NewAuthenticator(cfg)
+	assert.NoError(t, err)
+
+	opts := testServerOptions()
+	opts.Authenticator = authn
+	router := newTestRouter(opts)
+	claims := map[string]interface{}{"sub": "dashboard", "exp": time.Now().Add(time.Hour).Unix(), "scope": "read register"}
+
+	req := httptest.NewRequest("GET", "/v1/healthcheck", nil)
+	req.Header.Set("Authorization", "Bearer "+signer.sign(claims))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	req = httptest.NewRequest("POST", "/register", nil)
+	req.Header.Set("Authorization", "Bearer "+signer.sign(claims))
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code, "Bearer tokens should only grant the allowed scopes")
+
+	req = httptest.NewRequest("GET", "/v1/healthcheck", nil)
+	req.Header.Set("Authorization", "Bearer not.a.token")
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, rec.Header().Get("WWW-Authenticate"), "invalid_token")
+
+	// The API key keeps working
+	req = httptest.NewRequest("GET", "/v1/healthcheck", nil)
+	req.Header.Set("X-API-Key", testConfig.APIKey)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
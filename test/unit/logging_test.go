@@ -0,0 +1,132 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"registry-service/internal/middleware"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// decodeRecords decodes the JSON records written by a logger, one per line.
+func decodeRecords(t *testing.T, output *bytes.Buffer) []map[string]interface{} {
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var record map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &record))
+		records = append(records, record)
+	}
+	output.Reset()
+	return records
+}
+
+// TestStructuredLogger verifies that the JSON records carry the level, the message and the fields.
+func TestStructuredLogger(t *testing.T) {
+	var output bytes.Buffer
+	logger, err := middleware.NewLoggerWithOptions(middleware.LoggerOptions{Level: "debug", Format: "json", Output: &output})
+	assert.NoError(t, err)
+
+	logger.Component("registry").With(middleware.FieldWorkerID, "worker-1", middleware.FieldDuration, 1500*time.Microsecond).
+		Warn("request-1", "Worker %s is %s\n", "worker-1", "late")
+
+	records := decodeRecords(t, &output)
+	assert.Len(t, records, 1)
+	assert.Equal(t, "WARN", records[0]["level"])
+	assert.Equal(t, "Worker worker-1 is late", records[0]["msg"])
+	assert.Equal(t, "request-1", records[0][middleware.FieldRequestID])
+	assert.Equal(t, "worker-1", records[0][middleware.FieldWorkerID])
+	assert.Equal(t, "registry", records[0][middleware.FieldComponent])
+	assert.Equal(t, 1.5, records[0][middleware.FieldDuration], "durations are written in milliseconds")
+
+	logger.Info("", "No request")
+	records = decodeRecords(t, &output)
+	assert.Len(t, records, 1)
+	assert.NotContains(t, records[0], middleware.FieldRequestID)
+
+	_, err = middleware.NewLoggerWithOptions(middleware.LoggerOptions{Format: "xml"})
+	assert.Error(t, err)
+	_, err = middleware.NewLoggerWithOptions(middleware.LoggerOptions{Level: "verbose"})
+	assert.Error(t, err)
+}
+
+// TestComponentLevels verifies that the levels of the components override the level of the logger and can be
+// changed at runtime, including for the loggers already derived.
+func TestComponentLevels(t *testing.T) {
+	var output bytes.Buffer
+	logger, err := middleware.NewLoggerWithOptions(middleware.LoggerOptions{
+		Level:           "info",
+		ComponentLevels: map[string]string{"db": "error"},
+		Format:          "json",
+		Output:          &output,
+	})
+	assert.NoError(t, err)
+	db := logger.Component("db")
+	probe := logger.Component("probe")
+
+	db.Warn("", "dropped")
+	db.Error("", "kept")
+	probe.Debug("", "dropped")
+	probe.Info("", "kept")
+	for _, record := range decodeRecords(t, &output) {
+		assert.Equal(t, "kept", record["msg"])
+	}
+
+	assert.NoError(t, logger.SetLevel("warn"))
+	assert.NoError(t, logger.SetComponentLevels(map[string]string{"probe": "debug"}))
+	assert.True(t, probe.DebugEnabled())
+	assert.False(t, logger.Enabled(0), "info messages should be dropped at the warn level")
+	db.Warn("", "kept")
+	assert.Len(t, decodeRecords(t, &output), 1, "the db level is no longer overridden")
+
+	assert.Error(t, logger.SetComponentLevels(map[string]string{"db": "verbose"}))
+
+	// A nil logger discards the messages
+	var silent *middleware.Logger
+	silent.Component("db").With(middleware.FieldWorkerID, "worker-1").Error("", "dropped")
+	assert.False(t, silent.DebugEnabled())
+}
+
+// TestRequestID verifies that valid request IDs sent by the callers are kept, and that the others are replaced.
+func TestRequestID(t *testing.T) {
+	assert.True(t, middleware.ValidRequestID("0f8fad5b-d9cb-469f-a165-70867728950e"))
+	assert.True(t, middleware.ValidRequestID("trace:abc/12+3=="))
+	assert.False(t, middleware.ValidRequestID(""))
+	assert.False(t, middleware.ValidRequestID("id\nlevel=ERROR"), "IDs must not forge log records")
+	assert.False(t, middleware.ValidRequestID(strings.Repeat("a", 129)))
+
+	router := newSpecTestRouter()
+	get := func(requestID string) string {
+		req := httptest.NewRequest("GET", "/v1/healthcheck", nil)
+		req.Header.Set("X-API-Key", testConfig.APIKey)
+		if requestID != "" {
+			req.Header.Set(middleware.RequestIDHeader, requestID)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		return rec.Header().Get(middleware.RequestIDHeader)
+	}
+
+	assert.Equal(t, "client-request-1", get("client-request-1"))
+	generated := get("")
+	assert.True(t, middleware.ValidRequestID(generated))
+	assert.NotEqual(t, generated, get(""), "Each request should have its own ID")
+	replaced := get("not a valid id")
+	assert.NotEqual(t, "not a valid id", replaced)
+	assert.True(t, middleware.ValidRequestID(replaced))
+
+	// The ID is logged by the operations run on behalf of the request
+	ctx := middleware.ContextWithRequestID(context.Background(), "client-request-1")
+	assert.Equal(t, "client-request-1", middleware.GetRequestIDFromContext(ctx))
+	assert.Empty(t, middleware.GetRequestIDFromContext(context.Background()))
+}
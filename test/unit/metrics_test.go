@@ -0,0 +1,287 @@
+package unit
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"registry-service/internal/config"
+	"registry-service/internal/observability"
+	"registry-service/internal/ratelimit"
+	"registry-service/internal/server"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+// metricValue returns the value of the counter or gauge name with the labels, or the number of observations of the
+// histogram, 0 when there is no such series.
+func metricValue(t *testing.T, name string, labels map[string]string) float64 {
+	families, err := observability.Gatherer().Gather()
+	assert.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			if !hasLabels(metric, labels) {
+				continue
+			}
+			switch {
+			case metric.Counter != nil:
+				return metric.Counter.GetValue()
+			case metric.Gauge != nil:
+				return metric.Gauge.GetValue()
+			case metric.Histogram != nil:
+				return float64(metric.Histogram.GetSampleCount())
+			}
+		}
+	}
+	return 0
+}
+
+func hasLabels(metric *dto.Metric, labels map[string]string) bool {
+	matched := 0
+	for _, pair := range metric.GetLabel() {
+		if value, ok := labels[pair.GetName()]; ok {
+			if value != pair.GetValue() {
+				return false
+			}
+			matched++
+		}
+	}
+	return matched == len(labels)
+}
+
+// TestHealthCheckMetrics verifies that the probes are counted by worker and failure reason, and that the cycles
+// longer than the check interval are counted as overlaps.
+func TestHealthCheckMetrics(t *testing.T) {
+	metrics := observability.NewRegistryMetrics("probes")
+	worker := map[string]string{"registry": "probes", "worker": "metrics-worker"}
+	refused := map[string]string{"registry": "probes", "worker": "metrics-worker", "reason": observability.ProbeRefused}
+
+	metrics.RecordProbe("metrics-worker", 10*time.Millisecond, "")
+	metrics.RecordProbe("metrics-worker", time.Millisecond, observability.ProbeRefused)
+	assert.Equal(t, 2.0, metricValue(t, "health_probe_duration_seconds", worker))
+	assert.Equal(t, 1.0, metricValue(t, "health_probe_failures_total", refused))
+
+	metrics.RecordCheckCycle(50*time.Millisecond, 100*time.Millisecond)
+	metrics.RecordCheckCycle(150*time.Millisecond, 100*time.Millisecond)
+	assert.Equal(t, 1.0, metricValue(t, "health_check_cycle_overlaps_total", map[string]string{"registry": "probes"}))
+}
+
+// TestRegistrySizeMetric verifies that the registry size replaces the previous series of the registry, so that the
+// services without workers are not reported anymore, and keeps the series of the other registries.
+func TestRegistrySizeMetric(t *testing.T) {
+	metrics, other := observability.NewRegistryMetrics("size"), observability.NewRegistryMetrics("other-size")
+	other.RecordRegistrySize([]observability.WorkerCount{{Service: "batch", Healthy: true, Count: 5}})
+	metrics.RecordRegistrySize([]observability.WorkerCount{
+		{Service: "api", Healthy: true, Count: 3},
+		{Service: "api", Healthy: false, Count: 1},
+		{Service: "batch", Healthy: true, Count: 2},
+	})
+	assert.Equal(t, 3.0, metricValue(t, "registry_workers", map[string]string{"registry": "size", "service": "api", "state": "healthy"}))
+	assert.Equal(t, 1.0, metricValue(t, "registry_workers", map[string]string{"registry": "size", "service": "api", "state": "unhealthy"}))
+
+	metrics.RecordRegistrySize([]observability.WorkerCount{{Service: "api", Healthy: true, Count: 4}})
+	assert.Equal(t, 4.0, metricValue(t, "registry_workers", map[string]string{"registry": "size", "service": "api", "state": "healthy"}))
+	assert.Equal(t, 0.0, metricValue(t, "registry_workers", map[string]string{"registry": "size", "service": "batch", "state": "healthy"}))
+	assert.Equal(t, 5.0, metricValue(t, "registry_workers", map[string]string{"registry": "other-size", "service": "batch", "state": "healthy"}),
+		"The series of the other registry should be kept")
+}
+
+// TestHTTPMetrics verifies that the requests are labeled with the template of their route and the status of the
+// response, including the responses written without WriteHeader, the rejected requests and the requests matching
+// no route.
+func TestHTTPMetrics(t *testing.T) {
+	router := newSpecTestRouter()
+	spec := map[string]string{"method": "GET", "endpoint": "/openapi.json", "status": "200"}
+	worker := map[string]string{"method": "GET", "endpoint": "/v1/workers/{id}", "status": "401"}
+	requests := metricValue(t, "http_requests_total", spec)
+	rejected := metricValue(t, "http_requests_total", worker)
+
+	rec := serve(router, "GET", "/openapi.json", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, requests+1, metricValue(t, "http_requests_total", spec))
+	assert.Equal(t, requests+1, metricValue(t, "http_request_duration_seconds", spec))
+	assert.Equal(t, requests+1, metricValue(t, "http_response_size_bytes", spec))
+
+	for _, id := range []string{"worker-1", "worker-2"} {
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", "/v1/workers/"+id, nil))
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	}
+	assert.Equal(t, rejected+2, metricValue(t, "http_requests_total", worker), "The worker IDs should not be labels")
+
+	// The requests matching no route share one series per method and status
+	notFound := map[string]string{"method": "GET", "endpoint": observability.UnmatchedEndpoint, "status": "404"}
+	notAllowed := map[string]string{"method": "PUT", "endpoint": observability.UnmatchedEndpoint, "status": "405"}
+	missing, wrongMethod := metricValue(t, "http_requests_total", notFound), metricValue(t, "http_requests_total", notAllowed)
+	for _, path := range []string{"/unknown", "/v1/unknown/path"} {
+		assert.Equal(t, http.StatusNotFound, serve(router, "GET", path, "").Code)
+	}
+	assert.Equal(t, http.StatusMethodNotAllowed, serve(router, "PUT", "/openapi.json", "").Code)
+	assert.Equal(t, missing+2, metricValue(t, "http_requests_total", notFound))
+	assert.Equal(t, wrongMethod+1, metricValue(t, "http_requests_total", notAllowed))
+	assert.Equal(t, 0.0, metricValue(t, "http_requests_total", map[string]string{"endpoint": "/unknown"}))
+	assert.Equal(t, 0.0, metricValue(t, "http_requests_in_flight", nil))
+}
+
+// TestInstanceMetrics verifies that two instances in one process record their requests, throttled requests and
+// database operations in their own series.
+func TestInstanceMetrics(t *testing.T) {
+	limiter, err := ratelimit.NewLimiter(config.RateLimitConfig{PerIP: config.RateConfig{Rate: 0.001, Burst: 1}})
+	assert.NoError(t, err)
+
+	routers := make(map[string]http.Handler)
+	for _, name := range []string{"first", "second"} {
+		opts := testServerOptions()
+		opts.Metrics = observability.NewRegistryMetrics(name)
+		opts.Limiter = limiter
+		routers[name] = newTestRouter(opts)
+	}
+	spec := func(name string, status string) map[string]string {
+		return map[string]string{"registry": name, "method": "GET", "endpoint": "/openapi.json", "status": status}
+	}
+	throttled := func(name string) map[string]string {
+		return map[string]string{"registry": name, "limit": ratelimit.LimitIP}
+	}
+
+	// The limiter is shared: the second request of the client is throttled on the second instance
+	assert.Equal(t, http.StatusOK, serve(routers["first"], "GET", "/openapi.json", "").Code)
+	assert.Equal(t, http.StatusTooManyRequests, serve(routers["second"], "GET", "/openapi.json", "").Code)
+	assert.Equal(t, 1.0, metricValue(t, "http_requests_total", spec("first", "200")))
+	assert.Equal(t, 0.0, metricValue(t, "http_requests_total", spec("first", "429")))
+	assert.Equal(t, 0.0, metricValue(t, "http_requests_total", spec("second", "200")))
+	assert.Equal(t, 1.0, metricValue(t, "http_requests_total", spec("second", "429")))
+	assert.Equal(t, 0.0, metricValue(t, "throttled_requests_total", throttled("first")))
+	assert.Equal(t, 1.0, metricValue(t, "throttled_requests_total", throttled("second")))
+
+	first, second := observability.NewRegistryMetrics("first"), observability.NewRegistryMetrics("second")
+	first.RecordGRPCRequest("/registry.v1.RegistryService/ListWorkers", "OK", time.Millisecond)
+	second.RecordStorageOperation("UpdateWorkerHealth", time.Millisecond, errors.New("unreachable"))
+	assert.Equal(t, 1.0, metricValue(t, "grpc_requests_total", map[string]string{"registry": "first"}))
+	assert.Equal(t, 0.0, metricValue(t, "grpc_requests_total", map[string]string{"registry": "second"}))
+	assert.Equal(t, 0.0, metricValue(t, "storage_operation_errors_total", map[string]string{"registry": "first"}))
+	assert.Equal(t, 1.0, metricValue(t, "storage_operation_errors_total", map[string]string{"registry": "second"}))
+}
+
+// TestWorkerMetricsCleanup verifies that the series of a worker are removed when it leaves or changes address, and
+// that a reset keeps the given workers only, and the workers of the other registries.
+func TestWorkerMetricsCleanup(t *testing.T) {
+	metrics, other := observability.NewRegistryMetrics("cleanup"), observability.NewRegistryMetrics("other-cleanup")
+	other.RecordWorkerHealth("cleanup-1", "http://10.0.0.9:8080", true)
+	other.RecordWorkerHealth("cleanup-4", "http://10.0.0.4:8080", true)
+
+	metrics.RecordWorkerHealth("cleanup-1", "http://10.0.0.1:8080", true)
+	metrics.RecordProbe("cleanup-1", time.Millisecond, observability.ProbeTimeout)
+	metrics.ForgetWorker("cleanup-1")
+	assert.Equal(t, 0.0, metricValue(t, "worker_health_status", map[string]string{"registry": "cleanup", "id": "cleanup-1"}))
+	assert.Equal(t, 0.0, metricValue(t, "health_probe_duration_seconds", map[string]string{"worker": "cleanup-1"}))
+	assert.Equal(t, 0.0, metricValue(t, "health_probe_failures_total", map[string]string{"worker": "cleanup-1"}))
+	assert.Equal(t, 1.0, metricValue(t, "worker_health_status", map[string]string{"registry": "other-cleanup", "id": "cleanup-1"}),
+		"The worker with the same ID in the other registry should be kept")
+
+	metrics.RecordWorkerHealth("cleanup-2", "http://10.0.0.1:8080", true)
+	metrics.ForgetWorkerAddress("cleanup-2", "http://10.0.0.1:8080")
+	metrics.RecordWorkerHealth("cleanup-2", "http://10.0.0.2:8080", true)
+	assert.Equal(t, 0.0, metricValue(t, "worker_health_status", map[string]string{"id": "cleanup-2", "address": "http://10.0.0.1:8080"}))
+	assert.Equal(t, 1.0, metricValue(t, "worker_health_status", map[string]string{"id": "cleanup-2", "address": "http://10.0.0.2:8080"}))
+
+	metrics.ResetWorkerHealth([]observability.WorkerHealth{{ID: "cleanup-3", Address: "http://10.0.0.3:8080", Healthy: true}})
+	assert.Equal(t, 0.0, metricValue(t, "worker_health_status", map[string]string{"id": "cleanup-2"}))
+	assert.Equal(t, 1.0, metricValue(t, "worker_health_status", map[string]string{"id": "cleanup-3"}))
+	assert.Equal(t, 1.0, metricValue(t, "worker_health_status", map[string]string{"id": "cleanup-4"}), "The other registry should not be reset")
+}
+
+// TestMetricsServer verifies that the metrics server requires the configured credentials and serves over https
+// with the configured certificate, and that several servers can listen in one process. They expose the same
+// metrics, which are global to the process. The errors of the servers are returned instead of ending the process.
+func TestMetricsServer(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile := filepath.Join(dir, "metrics.crt"), filepath.Join(dir, "metrics.key")
+	cert, key := ca.issue(t, 30, "localhost")
+	writeFile(t, certFile, cert)
+	writeFile(t, keyFile, key)
+
+	srv, errs, err := server.StartMetricsServer(config.MetricsConfig{
+		Address:  "127.0.0.1:0",
+		Username: "prometheus",
+		Password: "scrape-secret",
+		CertFile: certFile,
+		KeyFile:  keyFile,
+	}, testLogger)
+	assert.NoError(t, err)
+	defer srv.Close()
+	other, _, err := server.StartMetricsServer(config.MetricsConfig{Address: "127.0.0.1:0"}, testLogger)
+	assert.NoError(t, err)
+	defer other.Close()
+
+	_, _, err = server.StartMetricsServer(config.MetricsConfig{Address: other.Addr}, testLogger)
+	assert.Error(t, err, "The address of the other server is in use")
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.pem)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	scrape := func(username string, password string) *http.Response {
+		req, err := http.NewRequest("GET", "https://"+srv.Addr+"/metrics", nil)
+		assert.NoError(t, err)
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+		resp, err := client.Do(req)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		defer resp.Body.Close()
+		return resp
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, scrape("", "").StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, scrape("prometheus", "wrong-secret").StatusCode)
+	assert.Equal(t, http.StatusOK, scrape("prometheus", "scrape-secret").StatusCode)
+
+	resp, err := http.Get("http://" + other.Addr + "/metrics")
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(body), "http_requests_in_flight")
+
+	assert.NoError(t, srv.Close())
+	err, open := <-errs
+	assert.NoError(t, err)
+	assert.False(t, open, "The channel should be closed without error once the server is closed")
+
+	for _, address := range []string{"", "none"} {
+		srv, errs, err = server.StartMetricsServer(config.MetricsConfig{Address: address}, testLogger)
+		assert.NoError(t, err)
+		assert.Nil(t, srv, "The metrics server should be disabled")
+		assert.Nil(t, errs)
+	}
+}
+
+// TestMountedMetrics verifies that the metrics mounted on the main server require the read scope.
+func TestMountedMetrics(t *testing.T) {
+	opts := testServerOptions()
+	opts.MountMetrics = true
+	router := newTestRouter(opts)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = serve(router, "GET", "/metrics", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "http_requests_in_flight")
+
+	rec = serve(newSpecTestRouter(), "GET", "/metrics", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code, "The metrics should not be mounted by default")
+}
@@ -0,0 +1,83 @@
+package unit
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"registry-service/internal/middleware"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestGetIPFromRemoteAddr verifies the parsing of IPv4 and IPv6 remote addresses.
+func TestGetIPFromRemoteAddr(t *testing.T) {
+	assert.Equal(t, "192.0.2.1", middleware.GetIPFromRemoteAddr("192.0.2.1:1234"))
+	assert.Equal(t, "2001:db8::1", middleware.GetIPFromRemoteAddr("[2001:db8::1]:1234"))
+	assert.Equal(t, "::1", middleware.GetIPFromRemoteAddr("[::1]:80"))
+	assert.Equal(t, "2001:db8::1", middleware.GetIPFromRemoteAddr("2001:db8::1"))
+	assert.Equal(t, "192.0.2.1", middleware.GetIPFromRemoteAddr("192.0.2.1"))
+}
+
+// TestClientIP verifies that the forwarding headers are only honored from trusted proxies.
+func TestClientIP(t *testing.T) {
+	networks, err := middleware.NewTrustedNetworks([]string{"10.0.0.0/8", "2001:db8:ffff::/48"}, nil)
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.7")
+	assert.Equal(t, "192.0.2.1", networks.ClientIP(req), "Untrusted peers cannot spoof their address")
+
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.9, 198.51.100.7, 10.0.0.2")
+	assert.Equal(t, "198.51.100.7", networks.ClientIP(req), "The rightmost untrusted address is the client")
+
+	req.Header.Del("X-Forwarded-For")
+	req.Header.Set("Forwarded", `for=198.51.100.7;proto=https, for="[2001:db8::7]:4711"`)
+	assert.Equal(t, "2001:db8::7", networks.ClientIP(req))
+
+	req.RemoteAddr = "[2001:db8:ffff::1]:443"
+	req.Header.Set("Forwarded", "for=unknown")
+	assert.Equal(t, "2001:db8:ffff::1", networks.ClientIP(req), "Obfuscated addresses stop the chain")
+
+	var untrusted *middleware.TrustedNetworks
+	assert.Equal(t, "2001:db8:ffff::1", untrusted.ClientIP(req), "Without trusted networks, the forwarding headers are ignored")
+
+	_, err = middleware.NewTrustedNetworks([]string{"not-a-cidr"}, nil)
+	assert.Error(t, err)
+}
+
+// TestWorkerHost verifies that only trusted sources may register a worker at another address than their own,
+// or at a hostname.
+func TestWorkerHost(t *testing.T) {
+	networks, err := middleware.NewTrustedNetworks(nil, []string{"192.0.2.10"})
+	assert.NoError(t, err)
+
+	host, err := networks.WorkerHost("198.51.100.7", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "198.51.100.7", host)
+
+	host, err = networks.WorkerHost("198.51.100.7", "198.51.100.7")
+	assert.NoError(t, err)
+	assert.Equal(t, "198.51.100.7", host)
+
+	_, err = networks.WorkerHost("198.51.100.7", "203.0.113.9")
+	assert.ErrorIs(t, err, middleware.ErrUntrustedHost)
+
+	host, err = networks.WorkerHost("192.0.2.10", "2001:db8::9")
+	assert.NoError(t, err)
+	assert.Equal(t, "2001:db8::9", host)
+
+	_, err = networks.WorkerHost("192.0.2.10", "not an address")
+	assert.ErrorIs(t, err, middleware.ErrInvalidHost)
+
+	host, err = networks.WorkerHost("192.0.2.10", "Worker-1.example.com.")
+	assert.NoError(t, err)
+	assert.Equal(t, "worker-1.example.com", host, "Hostnames should be normalized")
+
+	_, err = networks.WorkerHost("198.51.100.7", "worker-1.example.com")
+	assert.ErrorIs(t, err, middleware.ErrUntrustedHost, "Only trusted sources may register hostnames")
+
+	_, err = networks.WorkerHost("192.0.2.10", "-worker.example.com")
+	assert.ErrorIs(t, err, middleware.ErrInvalidHost)
+}
@@ -0,0 +1,152 @@
+package unit
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"registry-service/internal/auth"
+	"registry-service/internal/config"
+	"registry-service/internal/middleware"
+	"registry-service/internal/server"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// testServerOptions returns the options of a server authenticating the keys of the test configuration.
+func testServerOptions() server.Options {
+	return server.Options{
+		Port:          "0",
+		MaxBodyBytes:  testConfig.MaxBodyBytes,
+		Logger:        testLogger,
+		Authenticator: testAuthenticator,
+		Config:        func() config.Config { return testConfig },
+	}
+}
+
+// newTestRouter returns the router of a server started with the options, without a registry: only requests
+// rejected before reaching the handlers can be sent to it.
+func newTestRouter(opts server.Options) *mux.Router {
+	router := mux.NewRouter()
+	if _, _, err := server.StartServer(nil, router, make(chan struct{}), opts); err != nil {
+		panic(err)
+	}
+	return router
+}
+
+// newSpecTestRouter returns the router of a server started with the test options.
+func newSpecTestRouter() *mux.Router {
+	return newTestRouter(testServerOptions())
+}
+
+func serve(router http.Handler, method string, target string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("X-API-Key", testConfig.APIKey)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+// TestOpenAPIDocument verifies that the OpenAPI document is served and is valid JSON.
+func TestOpenAPIDocument(t *testing.T) {
+	rec := serve(newSpecTestRouter(), "GET", "/openapi.json", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var doc map[string]interface{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &doc))
+	assert.Equal(t, "3.0.3", doc["openapi"])
+}
+
+// TestV1RegisterValidation verifies that registration bodies are validated against the OpenAPI document.
+func TestV1RegisterValidation(t *testing.T) {
+	rec := serve(newSpecTestRouter(), "POST", "/v1/register", `{"id": "", "httpport": 70000, "extra": true}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var resp middleware.ErrorResponse
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, middleware.ErrCodeValidationFailed, resp.Error.Code)
+	assert.NotEmpty(t, resp.Error.RequestID)
+	assert.ElementsMatch(t, []string{
+		"body.extra is not a known field",
+		"body.httpport must be less than or equal to 65535",
+		"body.id must be at least 1 characters long",
+	}, resp.Error.Details)
+
+	rec = serve(newSpecTestRouter(), "POST", "/v1/register", `{"id": "ID1", "httpport": "8080"`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, middleware.ErrCodeInvalidRequest, resp.Error.Code)
+}
+
+// TestV1CreateKeyValidation verifies that a key without scope is rejected as invalid, not as an internal error.
+func TestV1CreateKeyValidation(t *testing.T) {
+	rec := serve(newSpecTestRouter(), "POST", "/v1/admin/keys", `{"name": "empty", "scopes": []}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	var resp middleware.ErrorResponse
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, middleware.ErrCodeValidationFailed, resp.Error.Code)
+	assert.Equal(t, []string{"body.scopes must have at least 1 items"}, resp.Error.Details)
+}
+
+// TestV1ScopeBeforeValidation verifies that a caller without the scope of an endpoint is rejected before its
+// request is validated, so that the request schema is not disclosed to it.
+func TestV1ScopeBeforeValidation(t *testing.T) {
+	authn, err := auth.NewAuthenticator(config.Config{
+		APIKeys: []config.APIKeyConfig{{Name: "reader", Key: "reader-secret", Scopes: []string{"read"}}},
+	})
+	assert.NoError(t, err)
+	opts := testServerOptions()
+	opts.Authenticator = authn
+	router := newTestRouter(opts)
+
+	for _, target := range []string{"/v1/register", "/v1/admin/keys"} {
+		req := httptest.NewRequest("POST", target, strings.NewReader(`{"id": "", "scopes": [], "extra": true}`))
+		req.Header.Set("X-API-Key", "reader-secret")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusForbidden, rec.Code, target)
+
+		var resp middleware.ErrorResponse
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		assert.Equal(t, middleware.ErrCodeForbidden, resp.Error.Code, target)
+		assert.Empty(t, resp.Error.Details, target)
+	}
+}
+
+// TestV1ErrorEnvelopes verifies that routing and authentication errors use the JSON error envelope.
+func TestV1ErrorEnvelopes(t *testing.T) {
+	router := newSpecTestRouter()
+
+	var resp middleware.ErrorResponse
+	rec := serve(router, "GET", "/v1/worker/health", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, []string{"query parameter address is required"}, resp.Error.Details)
+
+	// The requests matching no route run through the middlewares too
+	rec = serve(router, "GET", "/v1/unknown", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, middleware.ErrCodeNotFound, resp.Error.Code)
+	assert.NotEmpty(t, resp.Error.RequestID)
+	assert.Equal(t, resp.Error.RequestID, rec.Header().Get(middleware.RequestIDHeader))
+
+	rec = serve(router, "PUT", "/openapi.json", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, middleware.ErrCodeMethodNotAllowed, resp.Error.Code)
+	assert.Equal(t, resp.Error.RequestID, rec.Header().Get(middleware.RequestIDHeader))
+	assert.NotEmpty(t, resp.Error.RequestID)
+
+	req := httptest.NewRequest("GET", "/v1/workers", nil)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, middleware.ErrCodeUnauthorized, resp.Error.Code)
+}
@@ -0,0 +1,74 @@
+package unit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"registry-service/internal/auth"
+	"registry-service/internal/config"
+	"registry-service/internal/ratelimit"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRateLimiter verifies that the buckets hold burst requests per credential and per route.
+func TestRateLimiter(t *testing.T) {
+	limiter, err := ratelimit.NewLimiter(config.RateLimitConfig{
+		PerKey: config.RateConfig{Rate: 0.1, Burst: 3},
+		Routes: map[string]config.RateConfig{"POST /v1/register": {Rate: 0.1, Burst: 1}},
+	})
+	assert.NoError(t, err)
+
+	worker := &auth.Identity{Name: "worker", Method: auth.MethodAPIKey}
+	other := &auth.Identity{Name: "other", Method: auth.MethodAPIKey}
+
+	ok, _, _ := limiter.AllowIdentity(worker, "POST", "/v1/register")
+	assert.True(t, ok)
+	ok, retryAfter, name := limiter.AllowIdentity(worker, "POST", "/v1/register")
+	assert.False(t, ok, "The route allows a single registration per burst")
+	assert.Equal(t, ratelimit.LimitRoute, name)
+	assert.Greater(t, retryAfter.Seconds(), 9.0)
+
+	ok, _, _ = limiter.AllowIdentity(other, "POST", "/v1/register")
+	assert.True(t, ok, "Each credential has its own buckets")
+
+	ok, _, _ = limiter.AllowIdentity(worker, "GET", "/v1/workers")
+	assert.True(t, ok, "The route limit only applies to its method")
+	ok, _, name = limiter.AllowIdentity(worker, "GET", "/v1/workers")
+	assert.False(t, ok)
+	assert.Equal(t, ratelimit.LimitKey, name, "The credential exhausted its per_key bucket")
+
+	_, err = ratelimit.NewLimiter(config.RateLimitConfig{Routes: map[string]config.RateConfig{"register": {Rate: 1}}})
+	assert.Error(t, err, "Routes must be paths")
+	_, err = ratelimit.NewLimiter(config.RateLimitConfig{PerIP: config.RateConfig{Rate: -1}})
+	assert.Error(t, err)
+}
+
+// TestRateLimitMiddleware verifies that the requests exceeding a limit are answered with 429 and Retry-After.
+func TestRateLimitMiddleware(t *testing.T) {
+	limiter, err := ratelimit.NewLimiter(config.RateLimitConfig{PerIP: config.RateConfig{Rate: 0.5, Burst: 2}})
+	assert.NoError(t, err)
+
+	opts := testServerOptions()
+	opts.Limiter = limiter
+	router := newTestRouter(opts)
+	get := func(remoteAddr string, apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/v1/healthcheck", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-API-Key", apiKey)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusOK, get("192.0.2.1:1234", testConfig.APIKey).Code)
+	assert.Equal(t, http.StatusUnauthorized, get("192.0.2.1:1234", "invalid").Code)
+
+	rec := get("192.0.2.1:1234", testConfig.APIKey)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code, "Requests with invalid keys should count too")
+	assert.Equal(t, "2", rec.Header().Get("Retry-After"))
+	assert.Contains(t, rec.Body.String(), "rate_limited")
+
+	assert.Equal(t, http.StatusOK, get("192.0.2.2:1234", testConfig.APIKey).Code, "Other clients should not be limited")
+}
@@ -1,11 +1,14 @@
 package unit
 
 import (
+	"context"
+	"log"
 	"strconv"
 	"sync"
 	"testing"
 	"time"
 
+	"registry-service/internal/auth"
 	"registry-service/internal/config"
 	"registry-service/internal/database"
 	"registry-service/internal/middleware"
@@ -17,17 +20,30 @@ import (
 // Test Setup:
 // - setupTestDB is used to initialize a clean database state before each test, ensuring that each test runs independently.
 // - The init function ensures that configuration settings are loaded from the config.json file before tests are executed.
+var (
+	testConfig        config.Config
+	testLogger        *middleware.Logger
+	testAuthenticator *auth.Authenticator
+)
+
 func init() {
 	// Load the configuration from the config file
-	config.LoadConfig("config.json")
-	// Initialize the logger
-	middleware.InitLogger(config.AppConfig.LogLevel)
+	var err error
+	if testConfig, err = config.Load("config.json", nil); err != nil {
+		log.Fatalf("Failed to load config file: %v", err)
+	}
+	// Create the logger
+	testLogger = middleware.NewLogger(testConfig.LogLevel)
+	// Load the API keys
+	if testAuthenticator, err = auth.NewAuthenticator(testConfig); err != nil {
+		log.Fatalf("Failed to load API keys: %v", err)
+	}
 }
 
 // setupTestDB initializes the test database and clears any existing data
 func setupTestDB(t *testing.T) *database.MongoDB {
 	// Connect to the MongoDB instance
-	db, err := database.NewMongoDB(config.AppConfig.DB.URI, config.AppConfig.DB.Name, config.AppConfig.DB.Collection)
+	db, err := database.NewMongoDB(testConfig.DB.URI, testConfig.DB.Name, testConfig.DB.Collection, testLogger)
 	if err != nil {
 		t.Fatalf("Failed to connect to test database: %v", err)
 	}
@@ -47,7 +63,7 @@ func TestRegisterWorker(t *testing.T) {
 	db := setupTestDB(t)
 	defer db.Disconnect()
 
-	checkInterval := time.Duration(config.AppConfig.CheckIntervalMs) * time.Millisecond
+	checkInterval := time.Duration(testConfig.CheckIntervalMs) * time.Millisecond
 	reg := registry.NewRegistry(db, checkInterval)
 
 	ip := "172.3.4.5"
@@ -58,7 +74,7 @@ func TestRegisterWorker(t *testing.T) {
 	assert.True(t, exists, "Worker should exist in registry")
 
 	// Assert that the worker is registered in the database
-	dbWorkers, err := db.GetAllWorkers()
+	dbWorkers, err := db.GetAllWorkers(context.Background())
 	assert.NoError(t, err, "Error retrieving workers from database")
 	assert.Len(t, dbWorkers, 1, "There should be one worker in the database")
 	assert.Equal(t, ip, dbWorkers[0]["host"], "Worker address in DB should match")
@@ -70,21 +86,21 @@ func TestUpdateHealth(t *testing.T) {
 	db := setupTestDB(t)
 	defer db.Disconnect()
 
-	checkInterval := time.Duration(config.AppConfig.CheckIntervalMs) * time.Millisecond
+	checkInterval := time.Duration(testConfig.CheckIntervalMs) * time.Millisecond
 	reg := registry.NewRegistry(db, checkInterval)
 
 	ip := "192.178.3.4"
 	reg.RegisterWorker("ID1234", ip, 3003, 4500)
 
 	// Update health status to false
-	reg.UpdateHealth("ID1234", false)
+	reg.UpdateHealth(context.Background(), "ID1234", false)
 
 	// Assert that the worker's health status is updated in memory
 	_, exists := reg.GetWorkerHealth(ip + ":3003")
 	assert.True(t, exists, "Worker should exist in registry")
 
 	// Assert that the worker's health status is updated in the database
-	dbWorkers, err := db.GetAllWorkers()
+	dbWorkers, err := db.GetAllWorkers(context.Background())
 	assert.NoError(t, err, "Error retrieving workers from database")
 	assert.False(t, dbWorkers[0]["is_healthy"].(bool), "Worker in DB should be unhealthy")
 }
@@ -95,7 +111,7 @@ func TestGetWorker(t *testing.T) {
 	db := setupTestDB(t)
 	defer db.Disconnect()
 
-	checkInterval := time.Duration(config.AppConfig.CheckIntervalMs) * time.Millisecond
+	checkInterval := time.Duration(testConfig.CheckIntervalMs) * time.Millisecond
 	reg := registry.NewRegistry(db, checkInterval)
 
 	ip := "178.36.90.66"
@@ -111,7 +127,7 @@ func TestGetHealthyWorkersAddress(t *testing.T) {
 	db := setupTestDB(t)
 	defer db.Disconnect()
 
-	checkInterval := time.Duration(config.AppConfig.CheckIntervalMs) * time.Millisecond
+	checkInterval := time.Duration(testConfig.CheckIntervalMs) * time.Millisecond
 	reg := registry.NewRegistry(db, checkInterval)
 
 	address1 := "198.36.3.4"
@@ -136,11 +152,11 @@ func TestLoadWorkersFromDB(t *testing.T) {
 
 	ip := "187.3.4.5"
 	id := "ID1234"
-	if err := db.InsertWorker(id, ip, 8763, 9789); err != nil {
+	if err := db.InsertWorker(context.Background(), id, ip, 8763, 9789); err != nil {
 		t.Fatalf("Failed to insert worker into database: %v", err)
 	}
 
-	checkInterval := time.Duration(config.AppConfig.CheckIntervalMs) * time.Millisecond
+	checkInterval := time.Duration(testConfig.CheckIntervalMs) * time.Millisecond
 	reg := registry.NewRegistry(db, checkInterval)
 
 	// Assert that the worker is loaded from the database into memory
@@ -154,7 +170,7 @@ func TestConcurrentRegistration(t *testing.T) {
 	db := setupTestDB(t)
 	defer db.Disconnect()
 
-	checkInterval := time.Duration(config.AppConfig.CheckIntervalMs) * time.Millisecond
+	checkInterval := time.Duration(testConfig.CheckIntervalMs) * time.Millisecond
 	reg := registry.NewRegistry(db, checkInterval)
 
 	var wg sync.WaitGroup
@@ -185,7 +201,7 @@ func TestConcurrentHealthUpdates(t *testing.T) {
 	db := setupTestDB(t)
 	defer db.Disconnect()
 
-	checkInterval := time.Duration(config.AppConfig.CheckIntervalMs) * time.Millisecond
+	checkInterval := time.Duration(testConfig.CheckIntervalMs) * time.Millisecond
 	reg := registry.NewRegistry(db, checkInterval)
 
 	// Register workers first
@@ -202,7 +218,7 @@ func TestConcurrentHealthUpdates(t *testing.T) {
 		wg.Add(1)
 		go func(id string) {
 			defer wg.Done()
-			reg.UpdateHealth(id, false)
+			reg.UpdateHealth(context.Background(), id, false)
 		}(id)
 	}
 
@@ -222,7 +238,7 @@ func TestConcurrentGetWorker(t *testing.T) {
 	db := setupTestDB(t)
 	defer db.Disconnect()
 
-	checkInterval := time.Duration(config.AppConfig.CheckIntervalMs) * time.Millisecond
+	checkInterval := time.Duration(testConfig.CheckIntervalMs) * time.Millisecond
 	reg := registry.NewRegistry(db, checkInterval)
 
 	numWorkers := 100
@@ -245,7 +261,7 @@ func TestConcurrentGetWorker(t *testing.T) {
 		wg.Add(1)
 		go func(id string) {
 			defer wg.Done()
-			reg.UpdateHealth(id, false)
+			reg.UpdateHealth(context.Background(), id, false)
 		}(id)
 	}
 
@@ -0,0 +1,230 @@
+package unit
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"registry-service/internal/config"
+	"registry-service/internal/registry"
+	"registry-service/internal/render"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSource is an in-memory render.Source used to test the renderer without a database.
+type fakeSource struct {
+	mutex   sync.Mutex
+	workers []registry.Worker
+	changes chan struct{}
+}
+
+func newFakeSource(workers ...registry.Worker) *fakeSource {
+	return &fakeSource{workers: workers, changes: make(chan struct{}, 1)}
+}
+
+func (s *fakeSource) Snapshot() []registry.Worker {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]registry.Worker(nil), s.workers...)
+}
+
+func (s *fakeSource) Subscribe() (<-chan struct{}, func()) {
+	return s.changes, func() {}
+}
+
+func (s *fakeSource) set(workers ...registry.Worker) {
+	s.mutex.Lock()
+	s.workers = workers
+	s.mutex.Unlock()
+	select {
+	case s.changes <- struct{}{}:
+	default:
+	}
+}
+
+// writeTemplate creates an nginx-like upstream template and returns the template and destination paths.
+func writeTemplate(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "upstream.tmpl")
+	tmpl := "upstream workers {\n{{- range .HealthyWorkers }}\n  server {{ hostport .Host .HTTPPort }};\n{{- end }}\n}\n"
+	if err := os.WriteFile(source, []byte(tmpl), 0644); err != nil {
+		t.Fatalf("Failed to write template: %v", err)
+	}
+	return source, filepath.Join(dir, "upstream.conf")
+}
+
+// TestRenderTemplate verifies that only healthy workers are rendered and that the reload command
+// only runs when the output changes.
+func TestRenderTemplate(t *testing.T) {
+	source, destination := writeTemplate(t)
+	counter := filepath.Join(filepath.Dir(destination), "reloads")
+
+	src := newFakeSource(
+		registry.Worker{ID: "ID1", Host: "1.2.3.4", HTTPPort: 8080, IsHealthy: true},
+		registry.Worker{ID: "ID2", Host: "::1", HTTPPort: 8081, IsHealthy: true},
+		registry.Worker{ID: "ID3", Host: "1.2.3.5", HTTPPort: 8082, IsHealthy: false},
+	)
+	r, err := render.New(src, []config.TemplateConfig{
+		{Source: source, Destination: destination, Command: "echo reload >> " + counter},
+	}, render.Options{Debounce: 10 * time.Millisecond, Logger: testLogger})
+	assert.NoError(t, err)
+
+	r.RenderAll()
+	r.RenderAll()
+
+	content, err := os.ReadFile(destination)
+	assert.NoError(t, err)
+	assert.Equal(t, "upstream workers {\n  server 1.2.3.4:8080;\n  server [::1]:8081;\n}\n", string(content))
+
+	reloads, err := os.ReadFile(counter)
+	assert.NoError(t, err)
+	assert.Equal(t, "reload\n", string(reloads), "Reload command should only run when the output changes")
+}
+
+// TestRenderDebounce verifies that a burst of registry changes is rendered once the registry settles, with a single
+// run of the reload command.
+func TestRenderDebounce(t *testing.T) {
+	source, destination := writeTemplate(t)
+	counter := filepath.Join(filepath.Dir(destination), "reloads")
+
+	src := newFakeSource()
+	r, err := render.New(src, []config.TemplateConfig{
+		{Source: source, Destination: destination, Command: "echo reload >> " + counter},
+	}, render.Options{Debounce: 50 * time.Millisecond})
+	assert.NoError(t, err)
+
+	r.Start()
+	defer r.Stop()
+
+	for i := 0; i < 5; i++ {
+		src.set(registry.Worker{ID: "ID1", Host: "1.2.3.4", HTTPPort: int32(8080 + i), IsHealthy: true})
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	assert.Eventually(t, func() bool {
+		content, err := os.ReadFile(destination)
+		return err == nil && string(content) == "upstream workers {\n  server 1.2.3.4:8084;\n}\n"
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// Once on start, then once for the burst
+	time.Sleep(150 * time.Millisecond)
+	reloads, err := os.ReadFile(counter)
+	assert.NoError(t, err)
+	assert.Equal(t, "reload\nreload\n", string(reloads))
+}
+
+// TestRenderMaxWait verifies that changes that keep coming do not delay the render beyond the maximum wait.
+func TestRenderMaxWait(t *testing.T) {
+	source, destination := writeTemplate(t)
+
+	src := newFakeSource()
+	r, err := render.New(src, []config.TemplateConfig{{Source: source, Destination: destination}}, render.Options{
+		Debounce: 100 * time.Millisecond,
+		MaxWait:  200 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+
+	r.Start()
+	defer r.Stop()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+				src.set(registry.Worker{ID: "ID1", Host: "1.2.3.4", HTTPPort: int32(8080 + i%100), IsHealthy: true})
+			}
+		}
+	}()
+
+	assert.Eventually(t, func() bool {
+		content, err := os.ReadFile(destination)
+		return err == nil && string(content) != "upstream workers {\n}\n"
+	}, time.Second, 10*time.Millisecond, "The changes should be rendered while they keep coming")
+}
+
+// TestRenderReloadRetry verifies that a failed reload command is retried although the content did not change again.
+func TestRenderReloadRetry(t *testing.T) {
+	source, destination := writeTemplate(t)
+	dir := filepath.Dir(destination)
+	counter, failed := filepath.Join(dir, "reloads"), filepath.Join(dir, "failed")
+
+	src := newFakeSource(registry.Worker{ID: "ID1", Host: "1.2.3.4", HTTPPort: 8080, IsHealthy: true})
+	r, err := render.New(src, []config.TemplateConfig{{
+		Source:      source,
+		Destination: destination,
+		// Fails the first time only
+		Command: "if [ ! -e " + failed + " ]; then touch " + failed + "; exit 1; fi; echo reload >> " + counter,
+	}}, render.Options{Debounce: 10 * time.Millisecond, MaxWait: 100 * time.Millisecond, Logger: testLogger})
+	assert.NoError(t, err)
+
+	r.Start()
+	defer r.Stop()
+
+	assert.Eventually(t, func() bool {
+		reloads, err := os.ReadFile(counter)
+		return err == nil && string(reloads) == "reload\n"
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// Nothing is retried once the command succeeded
+	time.Sleep(150 * time.Millisecond)
+	reloads, err := os.ReadFile(counter)
+	assert.NoError(t, err)
+	assert.Equal(t, "reload\n", string(reloads))
+}
+
+// TestRenderGeneratedAt verifies that the generation time alone is not a change of the content.
+func TestRenderGeneratedAt(t *testing.T) {
+	dir := t.TempDir()
+	source, destination, counter := filepath.Join(dir, "stamp.tmpl"), filepath.Join(dir, "stamp.conf"), filepath.Join(dir, "reloads")
+	assert.NoError(t, os.WriteFile(source, []byte("# {{ .GeneratedAt.UnixNano }}\n{{ len .Workers }}\n"), 0644))
+
+	src := newFakeSource(registry.Worker{ID: "ID1", Host: "1.2.3.4", HTTPPort: 8080, IsHealthy: true})
+	r, err := render.New(src, []config.TemplateConfig{
+		{Source: source, Destination: destination, Command: "echo reload >> " + counter},
+	}, render.Options{Debounce: 10 * time.Millisecond})
+	assert.NoError(t, err)
+
+	r.RenderAll()
+	first, err := os.ReadFile(destination)
+	assert.NoError(t, err)
+	r.RenderAll()
+	second, err := os.ReadFile(destination)
+	assert.NoError(t, err)
+	assert.Equal(t, string(first), string(second), "The destination should not be rewritten")
+
+	src.set()
+	r.RenderAll()
+	reloads, err := os.ReadFile(counter)
+	assert.NoError(t, err)
+	assert.Equal(t, "reload\nreload\n", string(reloads), "Only the change of the workers should run the command")
+}
+
+// TestRenderStopWithoutStart verifies that a renderer that never started can be stopped, and not started afterwards.
+func TestRenderStopWithoutStart(t *testing.T) {
+	source, destination := writeTemplate(t)
+	r, err := render.New(newFakeSource(), []config.TemplateConfig{{Source: source, Destination: destination}}, render.Options{})
+	assert.NoError(t, err)
+
+	stopped := make(chan struct{})
+	go func() {
+		r.Stop()
+		r.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Stop should not block when the renderer never started")
+	}
+
+	r.Start()
+	_, err = os.Stat(destination)
+	assert.True(t, os.IsNotExist(err), "A stopped renderer should not start")
+}
@@ -0,0 +1,189 @@
+package unit
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"registry-service/internal/auth"
+	"registry-service/internal/config"
+	"registry-service/internal/tlsutil"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testCA issues certificates for the TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate the CA key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create the CA: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM certificate and key for the names, usable by servers and clients.
+func (ca *testCA) issue(t *testing.T, serial int64, dnsNames ...string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate the key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Failed to issue the certificate: %v", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
+
+// TestTLSClientCertificates verifies that verified client certificates authenticate workers, which may only act on
+// the worker IDs named by their certificate, and that the server certificate is reloaded when its files change.
+func TestTLSClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile, caFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.crt")
+	serverCert, serverKey := ca.issue(t, 10, "localhost")
+	writeFile(t, certFile, serverCert)
+	writeFile(t, keyFile, serverKey)
+	writeFile(t, caFile, ca.pem)
+
+	tlsConfig, err := tlsutil.NewServerConfig(config.TLSConfig{
+		CertFile:         certFile,
+		KeyFile:          keyFile,
+		ClientCAFile:     caFile,
+		ClientAuth:       tlsutil.ClientAuthRequest,
+		ReloadIntervalMs: 1,
+	}, testLogger)
+	assert.NoError(t, err)
+
+	cfg := testConfig
+	cfg.TLS.ClientCertScopes = []string{"read", "register"}
+	authn, err := auth.NewAuthenticator(cfg)
+	assert.NoError(t, err)
+
+	opts := testServerOptions()
+	opts.Authenticator = authn
+	ts := httptest.NewUnstartedServer(newTestRouter(opts))
+	ts.TLS = tlsConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.pem)
+	clientCert, clientKey := ca.issue(t, 20, "worker-1")
+	pair, err := tls.X509KeyPair(clientCert, clientKey)
+	assert.NoError(t, err)
+	newClient := func(certificates ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: certificates},
+			DisableKeepAlives: true,
+		}}
+	}
+
+	resp, err := newClient().Get(ts.URL + "/v1/healthcheck")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "A connection without certificate nor key should be rejected")
+
+	resp, err = newClient(pair).Get(ts.URL + "/v1/healthcheck")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = newClient(pair).Post(ts.URL+"/v1/workers/worker-2/heartbeat", "application/json", nil)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "The certificate does not name worker-2")
+
+	// Renewal of the server certificate
+	serverCert, serverKey = ca.issue(t, 11, "localhost")
+	writeFile(t, certFile, serverCert)
+	writeFile(t, keyFile, serverKey)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	time.Sleep(10 * time.Millisecond)
+
+	resp, err = newClient(pair).Get(ts.URL + "/v1/healthcheck")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, int64(11), resp.TLS.PeerCertificates[0].SerialNumber.Int64(), "The renewed certificate should be served")
+}
+
+// TestTLSProtocols verifies that the configurations of the handshakes negotiate HTTP/2, and HTTP/1.1 with the
+// clients that do not support HTTP/2.
+func TestTLSProtocols(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	serverCert, serverKey := ca.issue(t, 10, "localhost")
+	writeFile(t, certFile, serverCert)
+	writeFile(t, keyFile, serverKey)
+
+	tlsConfig, err := tlsutil.NewServerConfig(config.TLSConfig{CertFile: certFile, KeyFile: keyFile}, testLogger)
+	assert.NoError(t, err)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.EnableHTTP2 = true
+	ts.TLS = tlsConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.pem)
+	for protocol, client := range map[string]*http.Client{
+		"HTTP/2.0": {Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}, ForceAttemptHTTP2: true}},
+		"HTTP/1.1": {Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}},
+	} {
+		resp, err := client.Get(ts.URL)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, protocol, resp.Proto)
+	}
+}
@@ -0,0 +1,74 @@
+package unit
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"registry-service/internal/config"
+	"registry-service/internal/observability"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+)
+
+// exportedSpan is the part of the spans written by the stdout exporter checked by the tests.
+type exportedSpan struct {
+	Name        string
+	SpanContext struct{ TraceID, SpanID string }
+	Parent      struct{ TraceID, SpanID string }
+	Attributes  []struct {
+		Key   string
+		Value struct{ Value interface{} }
+	}
+}
+
+func (s exportedSpan) attribute(key string) interface{} {
+	for _, a := range s.Attributes {
+		if a.Key == key {
+			return a.Value.Value
+		}
+	}
+	return nil
+}
+
+// TestTracing verifies that the requests are traced in spans named after their route, that continue the trace
+// of the caller.
+func TestTracing(t *testing.T) {
+	var output bytes.Buffer
+	provider, err := observability.NewTracerProvider(config.TracingConfig{Exporter: "stdout"}, &output)
+	assert.NoError(t, err)
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(previous)
+
+	const traceID, parentID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	req := httptest.NewRequest("GET", "/v1/healthcheck", nil)
+	req.Header.Set("X-API-Key", testConfig.APIKey)
+	req.Header.Set("X-Request-ID", "traced-request")
+	req.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-01")
+	rec := httptest.NewRecorder()
+	newSpecTestRouter().ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var span exportedSpan
+	assert.NoError(t, json.NewDecoder(&output).Decode(&span))
+	assert.Equal(t, "GET /v1/healthcheck", span.Name)
+	assert.Equal(t, traceID, span.SpanContext.TraceID, "The span should join the trace of the caller")
+	assert.Equal(t, parentID, span.Parent.SpanID)
+	assert.Equal(t, "/v1/healthcheck", span.attribute("http.route"))
+	assert.Equal(t, "traced-request", span.attribute("registry.request.id"))
+	assert.EqualValues(t, http.StatusOK, span.attribute("http.response.status_code"))
+}
+
+// TestTracingDisabled verifies that no provider is created without an exporter, and that unknown exporters are rejected.
+func TestTracingDisabled(t *testing.T) {
+	provider, err := observability.NewTracerProvider(config.TracingConfig{Exporter: "none"}, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, provider)
+
+	_, err = observability.NewTracerProvider(config.TracingConfig{Exporter: "jaeger"}, nil)
+	assert.Error(t, err)
+}